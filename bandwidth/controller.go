@@ -0,0 +1,172 @@
+package bandwidth
+
+import (
+	"fmt"
+	"image-sync/config"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	OutsideWindowFinish   = "finish"   //窗口关闭后正在传输的镜像按照全局带宽上限继续传输
+	OutsideWindowThrottle = "throttle" //窗口关闭后正在传输的镜像限速到 throttleLimit
+)
+
+type window struct {
+	start int // 一天中的第几分钟
+	end   int
+	rate  int64
+}
+
+// Controller 管理全局以及每个目标镜像仓库的限速器，并按照时间窗口调整全局带宽
+type Controller struct {
+	lock          sync.Mutex
+	global        *Limiter
+	targets       map[string]*Limiter
+	limit         int64
+	windows       []window
+	outsideWindow string
+	throttleRate  int64
+	transferred   int64 //经过 Reader 的累计字节数，使用 atomic 读写
+}
+
+func NewController(bandwidthConfig config.BandwidthConfig, targets []config.TargetConfig) (*Controller, error) {
+	c := &Controller{
+		global:        NewLimiter(0),
+		targets:       make(map[string]*Limiter),
+		outsideWindow: bandwidthConfig.OutsideWindow,
+	}
+	var err error
+	if c.limit, err = config.ParseRate(bandwidthConfig.Limit); err != nil {
+		return nil, err
+	}
+	if c.throttleRate, err = config.ParseRate(bandwidthConfig.ThrottleLimit); err != nil {
+		return nil, err
+	}
+	switch c.outsideWindow {
+	case "":
+		c.outsideWindow = OutsideWindowFinish
+	case OutsideWindowFinish, OutsideWindowThrottle:
+	default:
+		return nil, fmt.Errorf("unsupported outsideWindow:%s", c.outsideWindow)
+	}
+	for _, w := range bandwidthConfig.Windows {
+		start, err := config.ParseClock(w.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := config.ParseClock(w.End)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := config.ParseRate(w.Limit)
+		if err != nil {
+			return nil, err
+		}
+		c.windows = append(c.windows, window{start: start, end: end, rate: rate})
+	}
+	for _, target := range targets {
+		rate, err := config.ParseRate(target.Bandwidth)
+		if err != nil {
+			return nil, err
+		}
+		if rate > 0 {
+			c.targets[normalizeHost(target.Addr)] = NewLimiter(rate)
+		}
+	}
+	c.Apply(time.Now())
+	return c, nil
+}
+
+// Enabled 是否配置了任何限速或时间窗口
+func (c *Controller) Enabled() bool {
+	return c.limit > 0 || len(c.windows) > 0 || len(c.targets) > 0
+}
+
+// Apply 根据当前时间设置全局带宽，返回当前是否处于允许传输的时间窗口内
+func (c *Controller) Apply(now time.Time) (open bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.windows) == 0 {
+		c.global.SetRate(c.limit)
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, w := range c.windows {
+		if w.contains(minute) {
+			c.global.SetRate(minRate(c.limit, w.rate))
+			return true
+		}
+	}
+	if c.outsideWindow == OutsideWindowThrottle {
+		c.global.SetRate(minRate(c.limit, c.throttleRate))
+	} else {
+		c.global.SetRate(c.limit)
+	}
+	return false
+}
+
+// Reader 返回受全局带宽以及 host 对应目标仓库带宽限制的 reader，读取的字节数计入 Transferred，
+// 只用于写入目标镜像仓库的方向，从源镜像仓库下载不受限制
+func (c *Controller) Reader(host string, reader io.Reader) io.Reader {
+	return &countingReader{reader: NewReader(reader, c.global, c.targets[normalizeHost(host)]), count: &c.transferred}
+}
+
+// CacheFillReader 返回受全局带宽限制的 reader，用于从源镜像仓库下载 blob 到本地缓存，
+// 下载与之后从缓存上传不同时进行，两者都计入全局带宽，但下载的字节数不计入 Transferred
+func (c *Controller) CacheFillReader(reader io.Reader) io.Reader {
+	return NewReader(reader, c.global)
+}
+
+// normalizeHost 统一镜像仓库地址的形式，去掉协议以及默认端口，
+// 配置中的 10.0.0.1 与 CONNECT 请求中的 10.0.0.1:443 对应同一个目标镜像仓库
+func normalizeHost(addr string) string {
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "https://"), "http://")
+	addr = strings.TrimSuffix(addr, "/")
+	if host, port, err := net.SplitHostPort(addr); err == nil && (port == "443" || port == "80") {
+		return host
+	}
+	return addr
+}
+
+// Transferred 经过 Reader 的累计字节数，用于统计实际的传输吞吐量
+func (c *Controller) Transferred() int64 {
+	return atomic.LoadInt64(&c.transferred)
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+func (w window) contains(minute int) bool {
+	if w.start == w.end {
+		return true
+	}
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	// 跨零点的窗口，例如 22:00-06:00
+	return minute >= w.start || minute < w.end
+}
+
+// minRate 返回两个带宽中较小的一个，0 表示不限速
+func minRate(a, b int64) int64 {
+	if a <= 0 {
+		return b
+	}
+	if b <= 0 || a < b {
+		return a
+	}
+	return b
+}
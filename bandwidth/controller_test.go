@@ -0,0 +1,48 @@
+package bandwidth
+
+import (
+	"image-sync/config"
+	"testing"
+)
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{addr: "10.0.0.1", want: "10.0.0.1"},
+		{addr: "10.0.0.1:443", want: "10.0.0.1"},
+		{addr: "10.0.0.1:80", want: "10.0.0.1"},
+		{addr: "10.0.0.1:32402", want: "10.0.0.1:32402"},
+		{addr: "https://harbor.example.com/", want: "harbor.example.com"},
+		{addr: "harbor.example.com:443", want: "harbor.example.com"},
+	}
+	for _, tt := range tests {
+		if got := normalizeHost(tt.addr); got != tt.want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestTargetLimiterMatchesConnectHost(t *testing.T) {
+	c, err := NewController(config.BandwidthConfig{}, []config.TargetConfig{
+		{Addr: "harbor.example.com", Bandwidth: "10MB/s"},
+		{Addr: "10.0.0.1:32402", Bandwidth: "20MB/s"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, rate := range map[string]int64{
+		"harbor.example.com:443": 10 << 20,
+		"harbor.example.com":     10 << 20,
+		"10.0.0.1:32402":         20 << 20,
+	} {
+		limiter := c.targets[normalizeHost(host)]
+		if limiter == nil || limiter.Rate() != rate {
+			t.Errorf("limiter of %s = %v, want rate %d", host, limiter, rate)
+		}
+	}
+	if c.targets[normalizeHost("other:443")] != nil {
+		t.Error("unconfigured host should have no target limiter")
+	}
+}
@@ -0,0 +1,93 @@
+package bandwidth
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter 令牌桶限速器，rate 为每秒允许通过的字节数，0 表示不限速
+type Limiter struct {
+	lock   sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate, last: time.Now()}
+}
+
+func (l *Limiter) SetRate(rate int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate != rate {
+		l.rate = rate
+		l.tokens = 0
+		l.last = time.Now()
+	}
+}
+
+func (l *Limiter) Rate() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
+
+// WaitN 消耗 n 个字节的令牌，令牌不足时阻塞到令牌补足为止
+func (l *Limiter) WaitN(n int) {
+	l.lock.Lock()
+	if l.rate <= 0 {
+		l.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	// 最多积攒 1 秒的令牌
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+type limitedReader struct {
+	reader   io.Reader
+	limiters []*Limiter
+}
+
+// NewReader 返回同时受所有 limiters 限速的 reader，nil 的 limiter 会被忽略
+func NewReader(reader io.Reader, limiters ...*Limiter) io.Reader {
+	r := &limitedReader{reader: reader}
+	for _, limiter := range limiters {
+		if limiter != nil {
+			r.limiters = append(r.limiters, limiter)
+		}
+	}
+	if len(r.limiters) == 0 {
+		return reader
+	}
+	return r
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	// 单次读取不超过 32KB，避免一次消耗过多令牌导致长时间阻塞
+	if len(p) > 32<<10 {
+		p = p[:32<<10]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		for _, limiter := range r.limiters {
+			limiter.WaitN(n)
+		}
+	}
+	return n, err
+}
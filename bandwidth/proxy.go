@@ -0,0 +1,88 @@
+package bandwidth
+
+import (
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/secret"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// StartProxy 在本地启动一个限速的 HTTP 代理，image-syncer 等子进程通过 HTTPS_PROXY 使用该代理，
+// 经过代理上传的流量受 Controller 的限速控制并计入 Transferred，返回代理地址
+func (c *Controller) StartProxy() (proxyURL string, err error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	server := &http.Server{Handler: http.HandlerFunc(c.serveProxy)}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			glog.Errorf("bandwidth proxy exit,err:%v", secret.RedactError(err))
+		}
+	}()
+	return "http://" + listener.Addr().String(), nil
+}
+
+func (c *Controller) serveProxy(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		c.serveTunnel(w, r)
+		return
+	}
+	c.serveForward(w, r)
+}
+
+// serveTunnel 处理 HTTPS 请求的 CONNECT 隧道，只有发往镜像仓库的方向（推送到目标镜像仓库的上传）限速，
+// 从源镜像仓库下载的方向不限速，否则同一份数据的下载和上传会各自消耗一次带宽
+func (c *Controller) serveTunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	if _, err = client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		client.Close()
+		upstream.Close()
+		return
+	}
+	go func() {
+		io.Copy(upstream, c.Reader(r.Host, client))
+		upstream.Close()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+}
+
+// serveForward 处理普通 HTTP 请求（非 https 的镜像仓库），与隧道一样只有请求 body 限速
+func (c *Controller) serveForward(w http.ResponseWriter, r *http.Request) {
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	if r.Body != nil {
+		req.Body = io.NopCloser(c.Reader(r.URL.Host, r.Body))
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
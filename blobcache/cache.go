@@ -0,0 +1,325 @@
+package blobcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tmpPrefix = ".tmp-"
+
+// Cache 本地磁盘上按 digest 保存 blob 的缓存，超过大小上限时按最近使用时间淘汰，
+// 写入以及第一次读取时都会校验 digest
+type Cache struct {
+	dir     string
+	maxSize int64
+	wrap    func(reader io.Reader) io.Reader
+	lock    sync.Mutex
+	size    int64
+	entries map[string]*entry
+	fetches map[string]*fetch
+}
+
+type entry struct {
+	size     int64
+	lastUsed time.Time
+	refs     int  //正在读取的个数，读取中的 blob 不会被淘汰
+	verified bool //本次运行中是否已经校验过 digest，打开缓存目录时已有的 blob 在第一次读取时校验
+}
+
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+// Open 打开缓存目录，以文件的修改时间作为最近使用时间，maxSize 为 0 表示不限制大小
+func Open(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "sha256"), 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c := &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		wrap:    func(reader io.Reader) io.Reader { return reader },
+		entries: make(map[string]*entry),
+		fetches: make(map[string]*fetch),
+	}
+	files, err := os.ReadDir(filepath.Join(dir, "sha256"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		c.entries["sha256:"+file.Name()] = &entry{size: info.Size(), lastUsed: info.ModTime()}
+		c.size += info.Size()
+	}
+	return c, nil
+}
+
+// SetLimit 设置下载 blob 到缓存时使用的限速，wrap 返回受限速的 reader
+func (c *Cache) SetLimit(wrap func(reader io.Reader) io.Reader) {
+	c.wrap = wrap
+}
+
+func (c *Cache) blobPath(digest string) (string, error) {
+	algorithm, hexDigest, ok := strings.Cut(digest, ":")
+	if !ok || algorithm != "sha256" || len(hexDigest) != sha256.Size*2 || strings.ContainsAny(hexDigest, "/\\.") {
+		return "", errors.Errorf("unsupported digest %q", digest)
+	}
+	return filepath.Join(c.dir, algorithm, hexDigest), nil
+}
+
+// Fetch 返回从 offset 开始的 blob 内容，缓存中没有时先通过 load 下载完整的 blob 到缓存，
+// 多个任务同时读取同一个 blob 时只下载一次；blob 超过缓存大小上限时直接调用 load
+func (c *Cache) Fetch(digest string, size, offset int64, load func(offset int64) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if c.maxSize > 0 && size > c.maxSize {
+		return load(offset)
+	}
+	for {
+		c.lock.Lock()
+		if _, ok := c.entries[digest]; ok {
+			c.lock.Unlock()
+			break
+		}
+		if current, ok := c.fetches[digest]; ok {
+			c.lock.Unlock()
+			<-current.done
+			if current.err != nil {
+				return nil, current.err
+			}
+			continue
+		}
+		current := &fetch{done: make(chan struct{})}
+		c.fetches[digest] = current
+		c.lock.Unlock()
+
+		current.err = c.put(digest, load)
+		c.lock.Lock()
+		delete(c.fetches, digest)
+		c.lock.Unlock()
+		close(current.done)
+		if current.err != nil {
+			return nil, current.err
+		}
+	}
+	reader, err := c.Open(digest, offset)
+	if os.IsNotExist(errors.Cause(err)) {
+		// 刚写入就被淘汰时直接读取
+		return load(offset)
+	}
+	return reader, err
+}
+
+// put 受限速地下载 blob 到临时文件，校验 digest 之后加入缓存
+func (c *Cache) put(digest string, load func(offset int64) (io.ReadCloser, error)) error {
+	blobPath, err := c.blobPath(digest)
+	if err != nil {
+		return err
+	}
+	reader, err := load(0)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tmpFile, err := os.CreateTemp(filepath.Dir(blobPath), tmpPrefix+"*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmpFile, hash), c.wrap(reader))
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return errors.Errorf("blob digest mismatch,expect %s,actual %s", digest, actual)
+	}
+	if err = os.Rename(tmpFile.Name(), blobPath); err != nil {
+		return errors.WithStack(err)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries[digest] = &entry{size: written, lastUsed: time.Now(), verified: true}
+	c.size += written
+	if c.maxSize > 0 {
+		c.evict(c.maxSize)
+	}
+	return nil
+}
+
+// Open 读取缓存中从 offset 开始的 blob，本次运行中第一次读取时先校验整个 blob 的 digest，
+// 不一致时从缓存中删除并返回错误。调用方可能只读取其中一部分（例如分块上传时按分块读取），因此不能在读取到末尾时才校验
+func (c *Cache) Open(digest string, offset int64) (io.ReadCloser, error) {
+	blobPath, err := c.blobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	current, ok := c.entries[digest]
+	if !ok {
+		c.lock.Unlock()
+		return nil, errors.WithStack(os.ErrNotExist)
+	}
+	current.refs++
+	current.lastUsed = time.Now()
+	verified := current.verified
+	c.lock.Unlock()
+
+	reader := &cachedReader{cache: c, digest: digest}
+	reader.file, err = os.Open(blobPath)
+	if err == nil {
+		os.Chtimes(blobPath, current.lastUsed, current.lastUsed)
+		if !verified {
+			err = c.verify(reader.file, digest)
+		}
+	}
+	if err == nil {
+		_, err = reader.file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		reader.Close()
+		return nil, errors.WithStack(err)
+	}
+	return reader, nil
+}
+
+// verify 校验缓存文件的 digest，不一致时删除该 blob
+func (c *Cache) verify(file *os.File, digest string) error {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return errors.WithStack(err)
+	}
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		glog.Warnf("cached blob %s is corrupted,actual digest %s,remove it", digest, actual)
+		c.Remove(digest)
+		return errors.Errorf("cached blob digest mismatch,expect %s,actual %s", digest, actual)
+	}
+	c.lock.Lock()
+	if current, ok := c.entries[digest]; ok {
+		current.verified = true
+	}
+	c.lock.Unlock()
+	return nil
+}
+
+type cachedReader struct {
+	cache  *Cache
+	digest string
+	file   *os.File
+	closed bool
+}
+
+func (r *cachedReader) Read(p []byte) (int, error) {
+	return r.file.Read(p)
+}
+
+func (r *cachedReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	r.cache.lock.Lock()
+	if current, ok := r.cache.entries[r.digest]; ok {
+		current.refs--
+	}
+	r.cache.lock.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// Remove 从缓存中删除 blob，例如上传后镜像仓库校验 digest 失败时
+func (c *Cache) Remove(digest string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if current, ok := c.entries[digest]; ok {
+		c.size -= current.size
+		delete(c.entries, digest)
+	}
+	if blobPath, err := c.blobPath(digest); err == nil {
+		os.Remove(blobPath)
+	}
+}
+
+// evict 按最近使用时间淘汰没有在读取的 blob，直到缓存大小不超过 maxSize，返回淘汰的个数以及大小
+func (c *Cache) evict(maxSize int64) (removed int, freed int64) {
+	if c.size <= maxSize {
+		return 0, 0
+	}
+	digests := make([]string, 0, len(c.entries))
+	for digest, current := range c.entries {
+		if current.refs == 0 {
+			digests = append(digests, digest)
+		}
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		return c.entries[digests[i]].lastUsed.Before(c.entries[digests[j]].lastUsed)
+	})
+	for _, digest := range digests {
+		if c.size <= maxSize {
+			break
+		}
+		blobPath, _ := c.blobPath(digest)
+		if err := os.Remove(blobPath); err != nil && !os.IsNotExist(err) {
+			glog.Warnf("remove cached blob %s failed,err:%v", digest, err)
+			continue
+		}
+		current := c.entries[digest]
+		c.size -= current.size
+		freed += current.size
+		removed++
+		delete(c.entries, digest)
+	}
+	return removed, freed
+}
+
+// Prune 删除下载中断留下的临时文件，并按最近使用时间淘汰 blob 直到缓存大小不超过 maxSize，
+// maxSize 为 0 时清空缓存，小于 0 时只删除临时文件
+func (c *Cache) Prune(maxSize int64) (removed int, freed int64, err error) {
+	files, err := os.ReadDir(filepath.Join(c.dir, "sha256"))
+	if err != nil {
+		return 0, 0, errors.WithStack(err)
+	}
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), tmpPrefix) {
+			continue
+		}
+		if info, err := file.Info(); err == nil {
+			freed += info.Size()
+		}
+		os.Remove(filepath.Join(c.dir, "sha256", file.Name()))
+		removed++
+	}
+	if maxSize < 0 {
+		return removed, freed, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	evicted, evictedSize := c.evict(maxSize)
+	return removed + evicted, freed + evictedSize, nil
+}
+
+// Size 缓存中 blob 的个数以及总大小
+func (c *Cache) Size() (count int, size int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries), c.size
+}
@@ -0,0 +1,179 @@
+package blobcache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func loader(data []byte, calls *int) func(offset int64) (io.ReadCloser, error) {
+	return func(offset int64) (io.ReadCloser, error) {
+		*calls++
+		return io.NopCloser(bytes.NewReader(data[offset:])), nil
+	}
+}
+
+// readAll 读取并关闭 Fetch 返回的 reader，出错时返回错误信息便于比较
+func readAll(reader io.ReadCloser, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func TestFetch(t *testing.T) {
+	cache, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("hello blob cache")
+	digest := digestOf(data)
+	var calls, limited int
+	cache.SetLimit(func(reader io.Reader) io.Reader {
+		limited++
+		return reader
+	})
+	if got := readAll(cache.Fetch(digest, int64(len(data)), 6, loader(data, &calls))); got != "blob cache" {
+		t.Errorf("Fetch() = %q, want %q", got, "blob cache")
+	}
+	if got := readAll(cache.Fetch(digest, int64(len(data)), 0, loader(data, &calls))); got != string(data) {
+		t.Errorf("Fetch() from cache = %q", got)
+	}
+	if calls != 1 || limited != 1 {
+		t.Errorf("load called %d times, limit applied %d times, want 1,1", calls, limited)
+	}
+
+	// 下载的内容与 digest 不一致时不写入缓存
+	bad := digestOf([]byte("other"))
+	if _, err = cache.Fetch(bad, int64(len(data)), 0, loader(data, &calls)); err == nil {
+		t.Error("Fetch() with digest mismatch should fail")
+	}
+	if count, size := cache.Size(); count != 1 || size != int64(len(data)) {
+		t.Errorf("Size() = %d,%d, want 1,%d", count, size, len(data))
+	}
+}
+
+func TestOpenVerifiesPartialRead(t *testing.T) {
+	dir := t.TempDir()
+	cache, _ := Open(dir, 0)
+	data := []byte(strings.Repeat("0123456789", 10))
+	digest := digestOf(data)
+	var calls int
+	if got := readAll(cache.Fetch(digest, int64(len(data)), 0, loader(data, &calls))); got != string(data) {
+		t.Fatalf("Fetch() = %q", got)
+	}
+	blobPath, _ := cache.blobPath(digest)
+	corrupted := append([]byte{}, data...)
+	corrupted[len(corrupted)-1] = 'x'
+	if err := os.WriteFile(blobPath, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新打开缓存目录后第一次读取时校验，只读取开头的一部分也能发现损坏
+	cache, _ = Open(dir, 0)
+	if reader, err := cache.Open(digest, 10); err == nil {
+		reader.Close()
+		t.Fatal("Open() corrupted blob should fail")
+	}
+	if _, err := os.Stat(blobPath); !os.IsNotExist(err) {
+		t.Errorf("corrupted blob should be removed, stat err = %v", err)
+	}
+	if count, _ := cache.Size(); count != 0 {
+		t.Errorf("Size() count = %d, want 0", count)
+	}
+	if got := readAll(cache.Fetch(digest, int64(len(data)), 90, loader(data, &calls))); got != "0123456789" {
+		t.Errorf("Fetch() after remove = %q", got)
+	}
+	if calls != 2 {
+		t.Errorf("load called %d times, want download again after corruption", calls)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	cache, _ := Open(t.TempDir(), 25)
+	blobs := [][]byte{[]byte("aaaaaaaaaa"), []byte("bbbbbbbbbb"), []byte("cccccccccc")}
+	var calls int
+	var readers []io.ReadCloser
+	for i, data := range blobs {
+		reader, err := cache.Fetch(digestOf(data), int64(len(data)), 0, loader(data, &calls))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			// 读取中的 blob 不会被淘汰
+			readers = append(readers, reader)
+		} else {
+			reader.Close()
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := cache.Open(digestOf(blobs[1]), 0); err == nil {
+		t.Error("least recently used blob not in use should be evicted")
+	}
+	for _, i := range []int{0, 2} {
+		reader, err := cache.Open(digestOf(blobs[i]), 0)
+		if err != nil {
+			t.Errorf("blob %d should be kept, err = %v", i, err)
+			continue
+		}
+		reader.Close()
+	}
+	for _, reader := range readers {
+		reader.Close()
+	}
+
+	// 超过缓存大小上限的 blob 直接下载，不写入缓存
+	large := []byte(strings.Repeat("d", 30))
+	if got := readAll(cache.Fetch(digestOf(large), int64(len(large)), 0, loader(large, &calls))); got != string(large) {
+		t.Errorf("Fetch() large blob = %q", got)
+	}
+	if _, err := cache.Open(digestOf(large), 0); err == nil {
+		t.Error("blob larger than maxSize should not be cached")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	cache, _ := Open(dir, 0)
+	var calls int
+	for _, data := range [][]byte{[]byte("aaaa"), []byte("bbbb")} {
+		if got := readAll(cache.Fetch(digestOf(data), 4, 0, loader(data, &calls))); got != string(data) {
+			t.Fatalf("Fetch() = %q", got)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, "sha256", tmpPrefix+"interrupted"), []byte("partial"), 0644)
+	tests := []struct {
+		maxSize     int64
+		wantRemoved int
+		wantCount   int
+	}{
+		{maxSize: -1, wantRemoved: 1, wantCount: 2},
+		{maxSize: 4, wantRemoved: 1, wantCount: 1},
+		{maxSize: 0, wantRemoved: 1, wantCount: 0},
+	}
+	for _, tt := range tests {
+		removed, _, err := cache.Prune(tt.maxSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count, _ := cache.Size(); removed != tt.wantRemoved || count != tt.wantCount {
+			t.Errorf("Prune(%d) removed %d,left %d, want %d,%d", tt.maxSize, removed, count, tt.wantRemoved, tt.wantCount)
+		}
+	}
+}
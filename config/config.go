@@ -1,36 +1,315 @@
 package config
 
 import (
+	"fmt"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
+	"image-sync/secret"
 	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// EnvPrefix 环境变量覆盖配置文件的前缀，例如 IMAGE_MIGRATION_DBDSN、IMAGE_MIGRATION_BANDWIDTH_LIMIT
+const EnvPrefix = "IMAGE_MIGRATION"
+
+type Mode string
+
+const (
+	ModeSync      Mode = "sync"
+	ModeMigration Mode = "migration"
+	ModeList      Mode = "list"
+	ModePipeline  Mode = "pipeline"
+	ModeUpdate    Mode = "update"
+	ModeReconcile Mode = "reconcile"
+	ModeRollback  Mode = "rollback"
+	ModeExport    Mode = "export"
+	ModeImport    Mode = "import"
+	ModeEvict     Mode = "evict"
+)
+
+const (
+	EngineImageSyncer = "image-syncer"
+	EngineNative      = "native"
+)
+
+const (
+	ExportFormatDir = "dir"
+	ExportFormatTar = "tar"
+)
+
+// 目标镜像仓库中已经存在同名 tag 且内容不同时的处理方式
+const (
+	TagConflictOverwrite = "overwrite"
+	TagConflictSkip      = "skip"
+	TagConflictFail      = "fail"
+	TagConflictRename    = "rename"
+
+	DefaultRenameSuffix = "-local"
+)
+
+// evict 模式删除 manifest 后 image_metadata 的处理方式
+const (
+	EvictMetadataDelete = "delete"
+	EvictMetadataMark   = "mark"
+)
+
+// 目标项目剩余空间不足时的处理方式
+const (
+	CapacityRefuse = "refuse"
+	CapacityStop   = "stop"
+	CapacitySkip   = "skip"
+)
+
+const (
+	PipelineUpdateImmediate = "immediate"
+	PipelineUpdateEnd       = "end"
 )
 
 type GlobalConfig struct {
 	SourceRegistryAddr string
 	TargetRegistryAddr string
+	SourceHarborApi    string //源 Harbor 的管理接口地址，配置后创建目标项目时复制源项目的公开属性、存储配额以及保留策略
 	SourceAzId         string
 	TargetAzId         string
 	OutputPath         string
 	StartTime          string
 	EndTime            string
-	DbDsn              string
-	Proc               int
-	Mode               string //sync、migration、update、、dryRun
+	DbDsn              string //数据库连接，支持 env:VAR、file:/path、helper:<helper>:<serverURL> 形式的引用
+	Proc               int    //同时同步的镜像个数，开启 adaptiveProc 时为初始并发个数
+	MaxProc            int    //开启 adaptiveProc 时并发个数的上限
+	AdaptiveProc       bool   //根据吞吐量自动调整并发个数
+	MaxInflightSize    string //同时传输中的镜像总大小上限，例如 200GB，空表示不限制
+	Engine             string //镜像复制方式 image-syncer:调用 image-syncer native:内置的复制，大 layer 分块上传并支持断点续传，默认 image-syncer
+	ChunkSize          string //native 复制以及 import 分块上传的大小，默认 64MB
+	Cache              CacheConfig
+	Mode               Mode     //sync、migration、list、pipeline、update、reconcile、rollback、export、import、evict
+	PipelineSource     Mode     //pipeline 模式选择镜像的方式：sync、migration、list，默认 sync
+	PipelineUpdate     string   //pipeline、import 模式写入元数据的时机 immediate:每个镜像校验成功后立即写入 end:运行结束后统一写入，默认 immediate
+	ExportSource       Mode     //export 模式选择镜像的方式：sync、migration、list，默认 sync
+	ExportFormat       string   //export 模式的输出格式 dir:OCI image-layout 目录 tar:打包为 tar 文件，默认 dir
+	ImportPath         string   //import 模式读取的 OCI image-layout 目录或 tar 文件
+	RunId              string   //本次运行的ID，写入同步结果以及元数据修改记录，不填时自动生成
+	ListFile           string   //list 模式下的镜像列表文件，"-" 表示从标准输入读取
+	TopN               int      //最多同步的镜像个数，0 表示不限制
+	MaxTotalSize       string   //同步镜像的总大小上限，例如 2TB，空表示不限制
+	Order              []string //镜像分发顺序：official、recent、usage、smallest、largest，可组合，空表示按查询顺序
+	StatusAddr         string   //状态接口监听地址，例如 :8080，空表示不开启
+	UpdateBatchSize    int      //update 模式每个事务写入的镜像个数，默认 100
+	ReconcileFix       bool     //reconcile 模式下是否以镜像仓库为准修复 image_metadata，默认只输出报告
+	Evict              EvictConfig
+	Bandwidth          BandwidthConfig
+	Targets            []TargetConfig //每个目标镜像仓库的单独配置
+	Topology           TopologyConfig
+	MetadataSink       string //镜像元数据的写入方式 sql:直接写数据库 http:调用平台接口，默认 sql
+	PlatformApi        PlatformApiConfig
+}
+
+type PlatformApiConfig struct {
+	Endpoint string //平台写入镜像元数据的接口地址
+	Token    string //Bearer token，与 username/password 二选一，与 password 一样支持 env:、file:、helper: 引用
+	Username string
+	Password string
+	Retries  int           //失败重试次数，默认 3
+	Timeout  time.Duration //单次请求超时时间，默认 10s
+}
+
+// EvictConfig evict 模式清理目标 AZ 中长期没有使用的镜像
+type EvictConfig struct {
+	Cutoff     string //截止时间，例如 2023-06-01 00:00:00，此时间之后没有任务使用过的非官方镜像会被清理
+	Apply      bool   //为 true 时删除 manifest 并处理 image_metadata，默认只输出报告（dry-run）
+	Metadata   string //删除 manifest 后 image_metadata 的处理方式 delete:删除记录 mark:把 status 改为 markStatus，默认 delete
+	MarkStatus int    //metadata 为 mark 时写入的 status，默认 2（offline）
+}
+
+// CacheConfig 本地 blob 缓存，native 复制以及 export 从源镜像仓库读取的 blob 会保存在缓存中，
+// 同步到多个 AZ 或者重试失败的镜像时不需要重新下载
+type CacheConfig struct {
+	Dir     string //缓存目录，空表示不开启
+	MaxSize string //缓存大小上限，例如 500GB，超过时淘汰最久未使用的 blob，空表示不限制
+}
+
+type BandwidthConfig struct {
+	Limit         string            //全局带宽上限，例如 200Mbps、20MB/s，空表示不限制
+	Windows       []BandwidthWindow //允许传输的时间窗口，空表示全天允许传输
+	OutsideWindow string            //窗口关闭后正在传输的镜像如何处理 finish:继续传输 throttle:限速到 throttleLimit
+	ThrottleLimit string
+}
+
+type BandwidthWindow struct {
+	Start string //开始时间，例如 22:00
+	End   string //结束时间，例如 06:00，早于开始时间表示跨天
+	Limit string //窗口内的带宽上限，空表示只受全局带宽上限限制
+}
+
+type TargetConfig struct {
+	Addr        string   //目标镜像仓库地址，与 targetRegistryAddr 一致
+	Bandwidth   string   //该目标镜像仓库的带宽上限
+	Platforms   []string //多平台镜像只同步这些平台，例如 linux/amd64、linux/arm64/v8，空表示同步所有平台
+	FilterIndex bool     //为 true 时推送只包含匹配平台的 index，否则只匹配一个平台时直接把该平台的 manifest 推送到 tag
+	// 目标镜像仓库中已经存在同名 tag 且 digest 不同时的处理方式 overwrite:覆盖 skip:跳过该镜像 fail:视为同步失败
+	// rename:把已有的 tag 加上 renameSuffix 保留后再覆盖，默认 overwrite
+	TagConflict  string
+	RenameSuffix string //rename 时已有 tag 的后缀，默认 -local
+	HarborApi    string //目标 Harbor 的管理接口地址，例如 https://10.12.101.13:32402，使用 auth.yaml 中目标镜像仓库的凭据
+	Capacity     CapacityConfig
+	// 为 true 时同步前在目标 Harbor 中创建不存在的项目，配置了 sourceHarborApi 时复制源项目的设置，
+	// 源项目不存在或者无法访问源 Harbor 时使用 projectDefaults
+	CreateProjects  bool
+	ProjectDefaults ProjectDefaultsConfig
+}
+
+// ProjectDefaultsConfig 创建目标项目时的默认设置
+type ProjectDefaultsConfig struct {
+	Public       bool   //是否公开
+	StorageLimit string //存储配额，例如 500GB，空表示使用 Harbor 的默认配额
+	RetainLatest int    //创建保留策略，每个 repository 只保留最近推送的 n 个镜像，0 表示不创建保留策略
+}
+
+// CapacityConfig 同步前以及同步过程中检查目标镜像仓库的剩余空间，配置了 harborApi 时查询镜像所属项目的存储配额，
+// 配置了 budget 时限制此次运行写入的总大小，两者都未配置时不检查
+type CapacityConfig struct {
+	Budget string //此次运行最多写入目标镜像仓库的大小，例如 500GB，空表示不限制
+	// 剩余空间不足时的处理方式 refuse:同步前发现不足时不开始同步，同步过程中不足时停止分发
+	// stop:先开始同步，不足时停止分发 skip:跳过放不下的镜像，继续分发优先级更低的镜像，默认 refuse
+	Policy        string
+	CheckInterval time.Duration //同步过程中重新查询项目配额的间隔，默认 5m
 }
 
 var IMConfig *GlobalConfig
 
-func ParseConfig(projectName, configFile string) {
-	viper.SetConfigFile(configFile)
-	err := viper.ReadInConfig()
+// ParseConfig 读取并校验配置，mode 不为空时覆盖配置文件中的 mode，存在问题时输出所有问题后退出
+func ParseConfig(projectName, configFile string, mode Mode) {
+	var err error
+	IMConfig, err = LoadConfig(projectName, configFile)
 	if err != nil {
 		log.Println("ParseConfigError:", err)
-		panic(err)
+		os.Exit(1)
 	}
-	IMConfig = new(GlobalConfig)
-	err = viper.UnmarshalKey(projectName, IMConfig)
-	if err != nil {
-		log.Println("UnmarshalConfigError:", err)
-		panic(err)
+	if mode != "" {
+		IMConfig.Mode = mode
+	}
+	if problems := IMConfig.Validate(); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Println("InvalidConfig:", problem)
+		}
+		os.Exit(1)
+	}
+}
+
+// LoadConfig 读取配置文件中 projectName 下的配置，并使用 IMAGE_MIGRATION_ 前缀的环境变量覆盖，
+// 环境变量名为字段路径的大写形式，例如 IMAGE_MIGRATION_PLATFORMAPI_TOKEN
+func LoadConfig(projectName, configFile string) (*GlobalConfig, error) {
+	viper.SetConfigFile(configFile)
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	sub := viper.Sub(projectName)
+	if sub == nil {
+		return nil, fmt.Errorf("config key %s not found in %s", projectName, configFile)
+	}
+	bindEnvs(sub, reflect.TypeOf(GlobalConfig{}), "")
+	cfg := new(GlobalConfig)
+	if err := sub.Unmarshal(cfg); err != nil {
+		return nil, err
+	}
+	cfg.setDefaults()
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// resolveSecrets 解析 dbDsn、platformApi 中 env:、file:、helper: 形式的引用，解析出的内容不会出现在日志中
+func (c *GlobalConfig) resolveSecrets() error {
+	fields := map[string]*string{
+		"dbDsn":                &c.DbDsn,
+		"platformApi.token":    &c.PlatformApi.Token,
+		"platformApi.password": &c.PlatformApi.Password,
+	}
+	for name, field := range fields {
+		value, err := secret.Resolve(*field)
+		if err != nil {
+			return errors.Wrapf(err, "resolve %s", name)
+		}
+		*field = value
+	}
+	// 直接写在配置文件中的密码同样需要脱敏
+	secret.Register(c.PlatformApi.Token, c.PlatformApi.Password)
+	if password := dsnPassword(c.DbDsn); password != "" {
+		secret.Register(password)
+	}
+	return nil
+}
+
+// bindEnvs 为配置中的每个字段绑定环境变量，结构体列表（例如 targets）不支持环境变量覆盖
+func bindEnvs(v *viper.Viper, t reflect.Type, prefix string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := prefix + strings.ToLower(field.Name)
+		switch {
+		case field.Type.Kind() == reflect.Struct:
+			bindEnvs(v, field.Type, key+".")
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct:
+		default:
+			v.BindEnv(key, EnvPrefix+"_"+strings.ToUpper(strings.ReplaceAll(key, ".", "_")))
+		}
+	}
+}
+
+func (c *GlobalConfig) setDefaults() {
+	c.Topology.setDefaults()
+	if c.PipelineSource == "" {
+		c.PipelineSource = ModeSync
+	}
+	if c.Engine == "" {
+		c.Engine = EngineImageSyncer
+	}
+	if c.ExportSource == "" {
+		c.ExportSource = ModeSync
+	}
+	if c.ExportFormat == "" {
+		c.ExportFormat = ExportFormatDir
+	}
+	if c.Evict.Metadata == "" {
+		c.Evict.Metadata = EvictMetadataDelete
+	}
+	if c.Evict.MarkStatus == 0 {
+		c.Evict.MarkStatus = ImageStatusOffline
+	}
+	if c.PipelineUpdate == "" {
+		c.PipelineUpdate = PipelineUpdateImmediate
+	}
+	if c.PlatformApi.Retries <= 0 {
+		c.PlatformApi.Retries = 3
+	}
+	if c.PlatformApi.Timeout <= 0 {
+		c.PlatformApi.Timeout = 10 * time.Second
+	}
+}
+
+// Target 返回目标镜像仓库的单独配置，没有配置时返回只包含地址的默认配置
+func (c *GlobalConfig) Target(addr string) TargetConfig {
+	target := TargetConfig{Addr: addr}
+	for _, current := range c.Targets {
+		if current.Addr == addr {
+			target = current
+			break
+		}
+	}
+	if target.TagConflict == "" {
+		target.TagConflict = TagConflictOverwrite
+	}
+	if target.RenameSuffix == "" {
+		target.RenameSuffix = DefaultRenameSuffix
+	}
+	if target.Capacity.Policy == "" {
+		target.Capacity.Policy = CapacityRefuse
+	}
+	if target.Capacity.CheckInterval <= 0 {
+		target.Capacity.CheckInterval = 5 * time.Minute
 	}
+	return target
 }
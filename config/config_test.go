@@ -0,0 +1,75 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+func TestLoadConfigEnvOverride(t *testing.T) {
+	configFile := writeConfigFile(t, `
+image-migration:
+  proc: 2
+  sourceRegistryAddr: source.example.com
+  bandwidth:
+    limit: 10MB/s
+  platformApi:
+    endpoint: https://platform.example.com/api/images
+    token: file-token
+`)
+	t.Setenv("IMAGE_MIGRATION_PROC", "8")
+	t.Setenv("IMAGE_MIGRATION_BANDWIDTH_LIMIT", "200Mbps")
+	t.Setenv("IMAGE_MIGRATION_PLATFORMAPI_TOKEN", "env-token")
+	// 配置文件中没有的字段同样可以通过环境变量设置
+	t.Setenv("IMAGE_MIGRATION_TARGETREGISTRYADDR", "target.example.com")
+
+	c, err := LoadConfig("image-migration", configFile)
+	if err != nil {
+		t.Fatalf("LoadConfig() err = %v", err)
+	}
+	if c.Proc != 8 {
+		t.Errorf("Proc = %d, want 8 from IMAGE_MIGRATION_PROC", c.Proc)
+	}
+	if c.Bandwidth.Limit != "200Mbps" {
+		t.Errorf("Bandwidth.Limit = %q, want 200Mbps from IMAGE_MIGRATION_BANDWIDTH_LIMIT", c.Bandwidth.Limit)
+	}
+	if c.PlatformApi.Token != "env-token" {
+		t.Errorf("PlatformApi.Token = %q, want env-token from IMAGE_MIGRATION_PLATFORMAPI_TOKEN", c.PlatformApi.Token)
+	}
+	if c.TargetRegistryAddr != "target.example.com" {
+		t.Errorf("TargetRegistryAddr = %q, want target.example.com", c.TargetRegistryAddr)
+	}
+	if c.SourceRegistryAddr != "source.example.com" || c.PlatformApi.Endpoint != "https://platform.example.com/api/images" {
+		t.Errorf("fields without env should keep values in file, got %q,%q", c.SourceRegistryAddr, c.PlatformApi.Endpoint)
+	}
+}
+
+func TestLoadConfigError(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "invalid yaml", content: "image-migration: ["},
+		{name: "project not found", content: "other:\n  proc: 2\n"},
+		{name: "invalid field type", content: "image-migration:\n  proc: many\n"},
+		{name: "unresolved secret", content: "image-migration:\n  dbDsn: env:IMAGE_MIGRATION_TEST_UNSET_DSN\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadConfig("image-migration", writeConfigFile(t, tt.content)); err == nil {
+				t.Error("LoadConfig() err = nil, want error")
+			}
+		})
+	}
+	if _, err := LoadConfig("image-migration", filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("LoadConfig() with missing file err = nil, want error")
+	}
+}
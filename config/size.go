@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var byteSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"TB", 1 << 40}, {"T", 1 << 40},
+	{"GB", 1 << 30}, {"G", 1 << 30},
+	{"MB", 1 << 20}, {"M", 1 << 20},
+	{"KB", 1 << 10}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseByteSize 解析 2TB、500GB、1024 这类大小配置，单位按 1024 进制换算，空字符串返回 0
+func ParseByteSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+	size = strings.Replace(size, "IB", "B", 1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(size, unit.suffix) {
+			value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(size, unit.suffix)), 64)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("invalid byte size %q", size)
+			}
+			return int64(value * float64(unit.size)), nil
+		}
+	}
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", size)
+	}
+	return value, nil
+}
+
+var rateUnits = []struct {
+	suffix string
+	rate   float64
+}{
+	{"GBPS", 1e9 / 8}, {"MBPS", 1e6 / 8}, {"KBPS", 1e3 / 8}, {"BPS", 1.0 / 8},
+	{"GB/S", 1 << 30}, {"MB/S", 1 << 20}, {"KB/S", 1 << 10}, {"B/S", 1},
+}
+
+// ParseRate 解析 50Mbps（比特每秒）、10MB/s（字节每秒）这类带宽配置，返回每秒字节数，空字符串或 0 表示不限速
+func ParseRate(rate string) (int64, error) {
+	rate = strings.ToUpper(strings.TrimSpace(rate))
+	if rate == "" {
+		return 0, nil
+	}
+	for _, unit := range rateUnits {
+		if strings.HasSuffix(rate, unit.suffix) {
+			value, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(rate, unit.suffix)), 64)
+			if err != nil || value < 0 {
+				return 0, fmt.Errorf("invalid bandwidth %q", rate)
+			}
+			return int64(value * unit.rate), nil
+		}
+	}
+	value, err := strconv.ParseInt(rate, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q", rate)
+	}
+	return value, nil
+}
@@ -0,0 +1,68 @@
+package config
+
+// image_metadata 中 status 以及 sync_status 的取值
+const (
+	ImageStatusOnline  = 1 // 镜像在 AZ 中可用
+	ImageStatusOffline = 2 // 镜像在边缘 AZ 中，尚未上线
+
+	SyncStatusNotSynced = 1 // 未同步回中控
+	SyncStatusSynced    = 3 // 已同步回中控
+
+	DefaultCentralAz = "az1"
+)
+
+// TopologyConfig 声明 AZ 拓扑以及同步过程中每种状态变化写入的值
+type TopologyConfig struct {
+	CentralAz   string   //中控 AZ，默认 az1
+	Azs         []string //所有 AZ，配置后 sourceAzId、targetAzId 必须在其中
+	Transitions TransitionConfig
+}
+
+type TransitionConfig struct {
+	CentralTarget     MetaState //镜像同步到中控 AZ 后写入目标 AZ 的状态
+	EdgeTarget        MetaState //镜像同步到边缘 AZ 后写入目标 AZ 的状态
+	SourceSynced      MetaState //镜像同步到中控 AZ 后写入源 AZ 的状态，只使用 syncStatus
+	PendingSyncStatus int       //源 AZ 中等待同步回中控的 sync_status，migration 模式按此选择镜像
+}
+
+type MetaState struct {
+	Status     int
+	SyncStatus int
+}
+
+func (t *TopologyConfig) setDefaults() {
+	if t.CentralAz == "" {
+		t.CentralAz = DefaultCentralAz
+	}
+	transitions := &t.Transitions
+	if transitions.CentralTarget.Status == 0 {
+		transitions.CentralTarget.Status = ImageStatusOnline
+	}
+	if transitions.CentralTarget.SyncStatus == 0 {
+		transitions.CentralTarget.SyncStatus = SyncStatusSynced
+	}
+	if transitions.EdgeTarget.Status == 0 {
+		transitions.EdgeTarget.Status = ImageStatusOffline
+	}
+	if transitions.EdgeTarget.SyncStatus == 0 {
+		transitions.EdgeTarget.SyncStatus = SyncStatusSynced
+	}
+	if transitions.SourceSynced.SyncStatus == 0 {
+		transitions.SourceSynced.SyncStatus = SyncStatusSynced
+	}
+	if transitions.PendingSyncStatus == 0 {
+		transitions.PendingSyncStatus = SyncStatusNotSynced
+	}
+}
+
+func (t *TopologyConfig) IsCentral(azId string) bool {
+	return azId == t.CentralAz
+}
+
+// TargetState 返回镜像同步到 azId 后目标 AZ 元数据应写入的状态
+func (t *TopologyConfig) TargetState(azId string) MetaState {
+	if t.IsCentral(azId) {
+		return t.Transitions.CentralTarget
+	}
+	return t.Transitions.EdgeTarget
+}
@@ -0,0 +1,290 @@
+package config
+
+import (
+	"fmt"
+	"image-sync/secret"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// TimeLayout startTime、endTime 的时间格式
+const TimeLayout = "2006-01-02 15:04:05"
+
+// Orders 支持的镜像分发顺序
+var Orders = []string{"official", "recent", "usage", "smallest", "largest"}
+
+var dsnPasswordRegexp = regexp.MustCompile(`^([^:@/]*):([^@]*)@`)
+
+// Validate 校验配置，返回所有问题
+func (c *GlobalConfig) Validate() []error {
+	var problems []error
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	selection := c.Mode
+	switch c.Mode {
+	case ModeSync, ModeMigration, ModeList, ModeUpdate, ModeReconcile, ModeRollback:
+	case ModeEvict:
+		if _, err := time.Parse(TimeLayout, c.Evict.Cutoff); err != nil {
+			add("evict.cutoff %q is not in format %s", c.Evict.Cutoff, TimeLayout)
+		}
+		if c.Evict.Metadata != EvictMetadataDelete && c.Evict.Metadata != EvictMetadataMark {
+			add("evict.metadata %q is not one of delete、mark", c.Evict.Metadata)
+		}
+	case ModePipeline:
+		selection = c.PipelineSource
+		switch c.PipelineSource {
+		case ModeSync, ModeMigration, ModeList:
+		default:
+			add("pipelineSource %q is not one of sync、migration、list", c.PipelineSource)
+		}
+		if c.PipelineUpdate != PipelineUpdateImmediate && c.PipelineUpdate != PipelineUpdateEnd {
+			add("pipelineUpdate %q is not one of immediate、end", c.PipelineUpdate)
+		}
+	case ModeImport:
+		if c.ImportPath == "" {
+			add("importPath can not be empty in import mode")
+		}
+		if c.PipelineUpdate != PipelineUpdateImmediate && c.PipelineUpdate != PipelineUpdateEnd {
+			add("pipelineUpdate %q is not one of immediate、end", c.PipelineUpdate)
+		}
+	case ModeExport:
+		selection = c.ExportSource
+		switch c.ExportSource {
+		case ModeSync, ModeMigration, ModeList:
+		default:
+			add("exportSource %q is not one of sync、migration、list", c.ExportSource)
+		}
+		if c.ExportFormat != ExportFormatDir && c.ExportFormat != ExportFormatTar {
+			add("exportFormat %q is not one of dir、tar", c.ExportFormat)
+		}
+	default:
+		add("unsupported mode %q", c.Mode)
+	}
+	if c.DbDsn == "" {
+		add("dbDsn can not be empty")
+	}
+	if c.OutputPath == "" {
+		add("outputPath can not be empty")
+	} else if info, err := os.Stat(c.OutputPath); err != nil || !info.IsDir() {
+		add("outputPath %q is not an existing directory", c.OutputPath)
+	}
+	if c.TargetAzId == "" {
+		add("targetAzId can not be empty")
+	}
+	// export 模式不访问目标镜像仓库
+	if c.TargetRegistryAddr == "" && c.Mode != ModeExport {
+		add("targetRegistryAddr can not be empty")
+	}
+
+	switch selection {
+	case ModeSync, ModeMigration, ModeList, ModeImport:
+		// import 模式不访问源镜像仓库
+		if c.SourceRegistryAddr == "" && selection != ModeImport {
+			add("sourceRegistryAddr can not be empty")
+		}
+		if c.Proc <= 0 {
+			add("proc must be greater than 0, got %d", c.Proc)
+		}
+		if c.MaxProc != 0 && c.MaxProc < c.Proc {
+			add("maxProc %d must not be less than proc %d", c.MaxProc, c.Proc)
+		}
+		if c.TopN < 0 {
+			add("topN must not be negative, got %d", c.TopN)
+		}
+	}
+	switch selection {
+	case ModeSync:
+		start, startErr := time.Parse(TimeLayout, c.StartTime)
+		if startErr != nil {
+			add("startTime %q is not in format %s", c.StartTime, TimeLayout)
+		}
+		end, endErr := time.Parse(TimeLayout, c.EndTime)
+		if endErr != nil {
+			add("endTime %q is not in format %s", c.EndTime, TimeLayout)
+		}
+		if startErr == nil && endErr == nil && !start.Before(end) {
+			add("startTime %s must be before endTime %s", c.StartTime, c.EndTime)
+		}
+	case ModeMigration:
+		if c.SourceAzId == "" {
+			add("sourceAzId can not be empty in migration mode")
+		}
+	case ModeList:
+		if c.ListFile == "" {
+			add("listFile can not be empty in list mode, use \"-\" to read from stdin")
+		}
+	}
+
+	if len(c.Topology.Azs) > 0 {
+		for _, azId := range []string{c.SourceAzId, c.TargetAzId, c.Topology.CentralAz} {
+			if azId != "" && !contains(c.Topology.Azs, azId) {
+				add("az %q is not declared in topology.azs %v", azId, c.Topology.Azs)
+			}
+		}
+	}
+	for _, order := range c.Order {
+		if !contains(Orders, order) {
+			add("order %q is not one of %s", order, strings.Join(Orders, "、"))
+		}
+	}
+	if _, err := ParseByteSize(c.MaxTotalSize); err != nil {
+		add("maxTotalSize: %v", err)
+	}
+	if _, err := ParseByteSize(c.MaxInflightSize); err != nil {
+		add("maxInflightSize: %v", err)
+	}
+	if c.Engine != EngineImageSyncer && c.Engine != EngineNative {
+		add("engine %q is not one of image-syncer、native", c.Engine)
+	}
+	if _, err := ParseByteSize(c.ChunkSize); err != nil {
+		add("chunkSize: %v", err)
+	}
+	if _, err := ParseByteSize(c.Cache.MaxSize); err != nil {
+		add("cache.maxSize: %v", err)
+	}
+	if c.UpdateBatchSize < 0 {
+		add("updateBatchSize must not be negative, got %d", c.UpdateBatchSize)
+	}
+
+	if _, err := ParseRate(c.Bandwidth.Limit); err != nil {
+		add("bandwidth.limit: %v", err)
+	}
+	if _, err := ParseRate(c.Bandwidth.ThrottleLimit); err != nil {
+		add("bandwidth.throttleLimit: %v", err)
+	}
+	switch c.Bandwidth.OutsideWindow {
+	case "", "finish", "throttle":
+	default:
+		add("bandwidth.outsideWindow %q is not one of finish、throttle", c.Bandwidth.OutsideWindow)
+	}
+	for i, window := range c.Bandwidth.Windows {
+		if _, err := ParseClock(window.Start); err != nil {
+			add("bandwidth.windows[%d].start: %v", i, err)
+		}
+		if _, err := ParseClock(window.End); err != nil {
+			add("bandwidth.windows[%d].end: %v", i, err)
+		}
+		if _, err := ParseRate(window.Limit); err != nil {
+			add("bandwidth.windows[%d].limit: %v", i, err)
+		}
+	}
+	for i, target := range c.Targets {
+		if target.Addr == "" {
+			add("targets[%d].addr can not be empty", i)
+		}
+		if _, err := ParseRate(target.Bandwidth); err != nil {
+			add("targets[%d].bandwidth: %v", i, err)
+		}
+		switch target.TagConflict {
+		case "", TagConflictOverwrite, TagConflictSkip, TagConflictFail, TagConflictRename:
+		default:
+			add("targets[%d].tagConflict %q is not one of overwrite、skip、fail、rename", i, target.TagConflict)
+		}
+		if strings.ContainsAny(target.RenameSuffix, ":/@ ") {
+			add("targets[%d].renameSuffix %q is not a valid tag suffix", i, target.RenameSuffix)
+		}
+		switch target.Capacity.Policy {
+		case "", CapacityRefuse, CapacityStop, CapacitySkip:
+		default:
+			add("targets[%d].capacity.policy %q is not one of refuse、stop、skip", i, target.Capacity.Policy)
+		}
+		if _, err := ParseByteSize(target.Capacity.Budget); err != nil {
+			add("targets[%d].capacity.budget: %v", i, err)
+		}
+		if target.Capacity.CheckInterval < 0 {
+			add("targets[%d].capacity.checkInterval must not be negative, got %s", i, target.Capacity.CheckInterval)
+		}
+		if target.CreateProjects && target.HarborApi == "" {
+			add("targets[%d].harborApi can not be empty when createProjects is true", i)
+		}
+		if _, err := ParseByteSize(target.ProjectDefaults.StorageLimit); err != nil {
+			add("targets[%d].projectDefaults.storageLimit: %v", i, err)
+		}
+		if target.ProjectDefaults.RetainLatest < 0 {
+			add("targets[%d].projectDefaults.retainLatest must not be negative, got %d", i, target.ProjectDefaults.RetainLatest)
+		}
+		for _, platform := range target.Platforms {
+			if parts := strings.Split(platform, "/"); len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+				add("targets[%d].platforms: invalid platform %q, expect os/arch[/variant]", i, platform)
+			}
+		}
+		// image-syncer 使用 --os、--arch 过滤平台，同步的是两者的所有组合
+		if c.Engine == EngineImageSyncer && c.Mode != ModeExport && c.Mode != ModeImport && !isCrossProduct(target.Platforms) {
+			add("targets[%d].platforms %v can not be expressed by --os and --arch of image-syncer, list every os/arch combination or use engine native", i, target.Platforms)
+		}
+	}
+
+	switch c.MetadataSink {
+	case "", "sql":
+	case "http":
+		if c.PlatformApi.Endpoint == "" {
+			add("platformApi.endpoint can not be empty when metadataSink is http")
+		}
+	default:
+		add("metadataSink %q is not one of sql、http", c.MetadataSink)
+	}
+	return problems
+}
+
+// isCrossProduct platforms 中的 os/arch 是否恰好为所有 os 与所有 arch 的组合，忽略 variant
+func isCrossProduct(platforms []string) bool {
+	osSet, archSet, pairs := make(map[string]struct{}), make(map[string]struct{}), make(map[string]struct{})
+	for _, platform := range platforms {
+		parts := strings.Split(platform, "/")
+		if len(parts) < 2 {
+			continue
+		}
+		osSet[parts[0]] = struct{}{}
+		archSet[parts[1]] = struct{}{}
+		pairs[parts[0]+"/"+parts[1]] = struct{}{}
+	}
+	return len(pairs) == len(osSet)*len(archSet)
+}
+
+// ParseClock 解析 22:00 这类时间，返回一天中的第几分钟
+func ParseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expect HH:MM", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Masked 返回隐藏了密码、token 等敏感信息的配置副本，用于输出
+func (c *GlobalConfig) Masked() GlobalConfig {
+	masked := *c
+	masked.DbDsn = MaskDSN(c.DbDsn)
+	if masked.PlatformApi.Token != "" {
+		masked.PlatformApi.Token = secret.Mask
+	}
+	if masked.PlatformApi.Password != "" {
+		masked.PlatformApi.Password = secret.Mask
+	}
+	return masked
+}
+
+// MaskDSN 隐藏数据库连接中的密码，例如 root:xxxx@tcp(...) 输出为 root:******@tcp(...)
+func MaskDSN(dsn string) string {
+	return dsnPasswordRegexp.ReplaceAllString(dsn, "$1:"+secret.Mask+"@")
+}
+
+func dsnPassword(dsn string) string {
+	match := dsnPasswordRegexp.FindStringSubmatch(dsn)
+	if match == nil {
+		return ""
+	}
+	return match[2]
+}
+
+func contains(list []string, item string) bool {
+	for _, value := range list {
+		if value == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func validConfig(t *testing.T) *GlobalConfig {
+	c := &GlobalConfig{
+		SourceRegistryAddr: "source.example.com",
+		TargetRegistryAddr: "target.example.com",
+		TargetAzId:         "az2",
+		OutputPath:         t.TempDir(),
+		StartTime:          "2023-06-01 00:00:00",
+		EndTime:            "2023-06-02 00:00:00",
+		DbDsn:              "user:pass@tcp(127.0.0.1:3306)/db",
+		Proc:               2,
+		Mode:               ModeSync,
+	}
+	c.setDefaults()
+	return c
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *GlobalConfig)
+		want   []string // 每一项都需要出现在某个问题中，空表示配置有效
+	}{
+		{name: "valid", modify: func(c *GlobalConfig) {}},
+		{name: "unsupported mode", modify: func(c *GlobalConfig) { c.Mode = "copy" }, want: []string{`unsupported mode "copy"`}},
+		{
+			name:   "sync time range",
+			modify: func(c *GlobalConfig) { c.StartTime, c.EndTime = c.EndTime, "2023-06-01" },
+			want:   []string{`endTime "2023-06-01" is not in format`},
+		},
+		{
+			name:   "start after end",
+			modify: func(c *GlobalConfig) { c.StartTime, c.EndTime = c.EndTime, c.StartTime },
+			want:   []string{"must be before endTime"},
+		},
+		{
+			name:   "missing required fields",
+			modify: func(c *GlobalConfig) { c.DbDsn, c.TargetAzId, c.SourceRegistryAddr = "", "", "" },
+			want:   []string{"dbDsn can not be empty", "targetAzId can not be empty", "sourceRegistryAddr can not be empty"},
+		},
+		{
+			name:   "output path not exist",
+			modify: func(c *GlobalConfig) { c.OutputPath += "/missing" },
+			want:   []string{"is not an existing directory"},
+		},
+		{name: "proc", modify: func(c *GlobalConfig) { c.Proc, c.MaxProc = 4, 2 }, want: []string{"maxProc 2 must not be less than proc 4"}},
+		{name: "migration", modify: func(c *GlobalConfig) { c.Mode = ModeMigration }, want: []string{"sourceAzId can not be empty"}},
+		{name: "list", modify: func(c *GlobalConfig) { c.Mode = ModeList }, want: []string{"listFile can not be empty"}},
+		{
+			name:   "export does not need target",
+			modify: func(c *GlobalConfig) { c.Mode, c.TargetRegistryAddr = ModeExport, "" },
+		},
+		{
+			name:   "import does not need source",
+			modify: func(c *GlobalConfig) { c.Mode, c.SourceRegistryAddr, c.ImportPath = ModeImport, "", "/data/export" },
+		},
+		{
+			name:   "evict",
+			modify: func(c *GlobalConfig) { c.Mode, c.Evict.Cutoff, c.Evict.Metadata = ModeEvict, "2023-06-01", "drop" },
+			want:   []string{"evict.cutoff", `evict.metadata "drop"`},
+		},
+		{
+			name: "sizes and rates",
+			modify: func(c *GlobalConfig) {
+				c.MaxTotalSize, c.Bandwidth.Limit, c.Bandwidth.OutsideWindow = "2XB", "fast", "stop"
+				c.Bandwidth.Windows = []BandwidthWindow{{Start: "22:00", End: "25:00", Limit: "50Mbps"}}
+			},
+			want: []string{"maxTotalSize", "bandwidth.limit", `bandwidth.outsideWindow "stop"`, "bandwidth.windows[0].end"},
+		},
+		{name: "order", modify: func(c *GlobalConfig) { c.Order = []string{"usage", "oldest"} }, want: []string{`order "oldest"`}},
+		{name: "engine", modify: func(c *GlobalConfig) { c.Engine = "skopeo" }, want: []string{`engine "skopeo"`}},
+		{
+			name: "target",
+			modify: func(c *GlobalConfig) {
+				c.Targets = []TargetConfig{{
+					TagConflict:    "keep",
+					RenameSuffix:   "/old",
+					CreateProjects: true,
+					Platforms:      []string{"linux"},
+				}}
+			},
+			want: []string{"targets[0].addr", `targets[0].tagConflict "keep"`, "targets[0].renameSuffix", "targets[0].harborApi",
+				`invalid platform "linux"`},
+		},
+		{
+			name: "platforms cross product",
+			modify: func(c *GlobalConfig) {
+				c.Targets = []TargetConfig{{Addr: c.TargetRegistryAddr, Platforms: []string{"linux/amd64", "linux/arm64/v8", "windows/amd64", "windows/arm64"}}}
+			},
+		},
+		{
+			name: "platforms not cross product",
+			modify: func(c *GlobalConfig) {
+				c.Targets = []TargetConfig{{Addr: c.TargetRegistryAddr, Platforms: []string{"linux/amd64", "windows/arm64"}}}
+			},
+			want: []string{"can not be expressed by --os and --arch"},
+		},
+		{
+			name: "platforms not cross product with native engine",
+			modify: func(c *GlobalConfig) {
+				c.Engine = EngineNative
+				c.Targets = []TargetConfig{{Addr: c.TargetRegistryAddr, Platforms: []string{"linux/amd64", "windows/arm64"}}}
+			},
+		},
+		{
+			name:   "http metadata sink",
+			modify: func(c *GlobalConfig) { c.MetadataSink = "http" },
+			want:   []string{"platformApi.endpoint can not be empty"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := validConfig(t)
+			tt.modify(c)
+			problems := c.Validate()
+			if len(tt.want) == 0 && len(problems) > 0 {
+				t.Fatalf("Validate() = %v, want no problem", problems)
+			}
+			for _, want := range tt.want {
+				found := false
+				for _, problem := range problems {
+					found = found || strings.Contains(problem.Error(), want)
+				}
+				if !found {
+					t.Errorf("Validate() = %v, want problem containing %q", problems, want)
+				}
+			}
+		})
+	}
+}
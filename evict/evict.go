@@ -0,0 +1,238 @@
+package evict
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-geminidb/model"
+	"image-sync/config"
+	"image-sync/dao"
+	"image-sync/imagesync"
+	"image-sync/registryserver"
+	"image-sync/secret"
+	"image-sync/update"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	ReportFile = "evict-report"
+
+	ActionDryRun  = "dry_run" // 只输出报告，没有删除
+	ActionEvicted = "evicted" // 已删除 manifest 并处理 image_metadata
+	ActionSkipped = "skipped" // manifest 同时被需要保留的 tag 引用，没有删除
+	ActionFailed  = "failed"
+)
+
+// Candidate 截止时间之后没有任务使用过的非官方镜像
+type Candidate struct {
+	Name         string     `json:"name"`
+	Tag          string     `json:"tag"`
+	Size         int64      `json:"size"`
+	LastUsedTime *time.Time `json:"last_used_time,omitempty"` //最近一次被任务使用的时间，没有任务使用过时为空
+	CreateTime   *time.Time `json:"create_time,omitempty"`    //没有任务使用过时为 image_metadata 的创建时间，即同步到该 AZ 的时间
+	Digest       string     `json:"digest,omitempty"`
+	Action       string     `json:"action"`
+	Error        string     `json:"error,omitempty"`
+}
+
+type imageUsage struct {
+	Name         string    `xorm:"'image_name'"`
+	Tag          string    `xorm:"'image_tag'"`
+	LastUsedTime time.Time `xorm:"'last_used_time'"`
+}
+
+// Evict 找出目标 AZ 的 image_metadata 中截止时间之后没有任务使用过的非官方镜像并输出报告，
+// apply 为 true 时删除目标镜像仓库中的 manifest，并按照 evict.metadata 删除或者标记 image_metadata
+func Evict(authPath string, apply bool) error {
+	azId := config.IMConfig.TargetAzId
+	cutoff, err := time.ParseInLocation(config.TimeLayout, config.IMConfig.Evict.Cutoff, time.Local)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	candidates, err := findCandidates(azId, cutoff)
+	if err != nil {
+		return err
+	}
+	glog.Infof("found %d images in az %s not used since %s", len(candidates), azId, config.IMConfig.Evict.Cutoff)
+	if apply {
+		server := registryserver.Init(config.IMConfig.TargetRegistryAddr, authPath)
+		evictImages(server, candidates, azId)
+	} else {
+		for i := range candidates {
+			candidates[i].Action = ActionDryRun
+		}
+	}
+	recordCandidates(candidates)
+	return nil
+}
+
+// findCandidates 目标 AZ 中截止时间之后没有任务使用过、并且不是官方镜像的 image_metadata，按照大小从大到小排序，
+// 没有任务使用过的镜像在截止时间之前同步到该 AZ 时才清理，等待同步回中控的镜像不清理
+func findCandidates(azId string, cutoff time.Time) ([]Candidate, error) {
+	var metaList []model.ImageMetadata
+	err := dao.MySQL().Where("az_id = ?", azId).
+		And("sync_status <> ?", config.IMConfig.Topology.Transitions.PendingSyncStatus).
+		Find(&metaList)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	// 每个镜像最近一次被任务使用的时间
+	var usages []imageUsage
+	err = dao.MySQL().Table("pro_job").
+		Select("data_image.image_name, data_image.image_tag, MAX(pro_job.create_time) AS last_used_time").
+		Join("INNER", "data_image", "data_image.image_id = pro_job.image_id").
+		GroupBy("data_image.image_name, data_image.image_tag").
+		Find(&usages)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	lastUsed := make(map[string]time.Time, len(usages))
+	for _, usage := range usages {
+		lastUsed[usage.Name+":"+usage.Tag] = usage.LastUsedTime
+	}
+
+	officialImageIds, err := imagesync.GetOfficialImageIds()
+	if err != nil {
+		return nil, err
+	}
+	var officialImages []imagesync.DataImage
+	err = dao.MySQL().Table("data_image").
+		Select("image_id,image_name,image_tag").
+		In("image_id", officialImageIds).
+		Find(&officialImages)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	official := make(map[string]struct{}, len(officialImages))
+	for _, image := range officialImages {
+		official[image.Name+":"+image.Tag] = struct{}{}
+	}
+
+	var candidates []Candidate
+	for _, meta := range metaList {
+		key := meta.Name + ":" + meta.Tag
+		if _, ok := official[key]; ok {
+			continue
+		}
+		candidate := Candidate{Name: meta.Name, Tag: meta.Tag, Size: meta.Size}
+		if usedTime, ok := lastUsed[key]; ok {
+			if usedTime.After(cutoff) {
+				continue
+			}
+			candidate.LastUsedTime = &usedTime
+		} else {
+			// 没有使用过的镜像按同步时间判断，刚同步的镜像还没有机会被使用
+			if meta.CreateTime.After(cutoff) {
+				continue
+			}
+			createTime := meta.CreateTime
+			candidate.CreateTime = &createTime
+		}
+		candidates = append(candidates, candidate)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].Size > candidates[j].Size
+	})
+	return candidates, nil
+}
+
+// evictImages 按 repository 删除 manifest，删除 manifest 会同时删除指向它的所有 tag，
+// 因此 repository 中需要保留的 tag 指向同一个 manifest 时跳过该镜像
+func evictImages(server *registryserver.Server, candidates []Candidate, azId string) {
+	repositories := make(map[string][]int)
+	for i, candidate := range candidates {
+		repositories[candidate.Name] = append(repositories[candidate.Name], i)
+	}
+	for repository, indexes := range repositories {
+		evicting := make(map[string]struct{}, len(indexes))
+		for _, i := range indexes {
+			evicting[candidates[i].Tag] = struct{}{}
+		}
+		keptDigests, err := server.KeptDigests(repository, evicting)
+		if err != nil {
+			for _, i := range indexes {
+				candidates[i].Action = ActionFailed
+				candidates[i].Error = secret.Redact(err.Error())
+			}
+			continue
+		}
+		for _, i := range indexes {
+			evictImage(server, &candidates[i], keptDigests, azId)
+		}
+	}
+}
+
+// evictImage 删除镜像的 manifest，manifest 已经不存在时同样处理 image_metadata
+func evictImage(server *registryserver.Server, candidate *Candidate, keptDigests map[string]string, azId string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	digest, err := server.GetManifestDigest(ctx, candidate.Name, candidate.Tag)
+	switch {
+	case errors.Cause(err) == registryserver.ErrNotFound:
+	case err != nil:
+		candidate.Action, candidate.Error = ActionFailed, secret.Redact(err.Error())
+		return
+	default:
+		candidate.Digest = digest
+		if tag, ok := keptDigests[digest]; ok {
+			candidate.Action = ActionSkipped
+			candidate.Error = "manifest is also referenced by tag " + tag
+			return
+		}
+		// 多个待清理的 tag 指向同一个 manifest 时，前面的 tag 已经删除了该 manifest
+		err = server.DeleteManifest(ctx, candidate.Name, digest)
+		if err != nil && errors.Cause(err) != registryserver.ErrNotFound {
+			candidate.Action, candidate.Error = ActionFailed, secret.Redact(err.Error())
+			return
+		}
+	}
+	if err = evictMetadata(candidate, azId); err != nil {
+		candidate.Action, candidate.Error = ActionFailed, secret.Redact(err.Error())
+		return
+	}
+	candidate.Action = ActionEvicted
+}
+
+// evictMetadata 通过配置的元数据写入方式删除或者标记 image_metadata
+func evictMetadata(candidate *Candidate, azId string) error {
+	if config.IMConfig.Evict.Metadata == config.EvictMetadataMark {
+		status := config.IMConfig.Evict.MarkStatus
+		return update.GetSink().Update(update.ImageRegistration{AzId: azId, Name: candidate.Name, Tag: candidate.Tag, Status: &status})
+	}
+	return update.GetSink().Delete(azId, candidate.Name, candidate.Tag)
+}
+
+// recordCandidates 输出清理的镜像，并写入 OutputPath 下的 evict-report 文件
+func recordCandidates(candidates []Candidate) {
+	counts := make(map[string]int)
+	sizes := make(map[string]int64)
+	file, err := os.Create(path.Join(config.IMConfig.OutputPath, ReportFile))
+	if err != nil {
+		glog.Warnf("create evict report failed,err:%v", err)
+	} else {
+		defer file.Close()
+	}
+	for _, candidate := range candidates {
+		counts[candidate.Action]++
+		sizes[candidate.Action] += candidate.Size
+		lastUsedTime := ""
+		if candidate.LastUsedTime != nil {
+			lastUsedTime = candidate.LastUsedTime.Format(time.RFC3339)
+		}
+		glog.Info("evict image", glog.String("action", candidate.Action), glog.String("image", candidate.Name+":"+candidate.Tag),
+			glog.String("size", strconv.FormatInt(candidate.Size, 10)), glog.String("lastUsedTime", lastUsedTime),
+			glog.String("error", candidate.Error))
+		if file != nil {
+			data, _ := json.Marshal(candidate)
+			file.Write(append(data, '\n'))
+		}
+	}
+	glog.Infof("evict finished,%s:%d(%v GB),%s:%d(%v GB),%s:%d,%s:%d", ActionDryRun, counts[ActionDryRun], sizes[ActionDryRun]>>30,
+		ActionEvicted, counts[ActionEvicted], sizes[ActionEvicted]>>30, ActionSkipped, counts[ActionSkipped], ActionFailed, counts[ActionFailed])
+}
@@ -0,0 +1,241 @@
+package imagesync
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/config"
+	"image-sync/registryserver"
+	"image-sync/secret"
+	"sort"
+	"sync"
+	"time"
+)
+
+// capacityChecker 根据目标 Harbor 项目的存储配额以及配置的 budget 检查目标镜像仓库是否还能放下待分发的镜像，
+// 上次查询配额之后分发的镜像还没有反映到 Harbor 的已使用大小中，记录在 pending 中
+type capacityChecker struct {
+	lock       sync.Mutex
+	harbor     *registryserver.HarborClient //未配置 harborApi 时为空，只检查 budget
+	policy     string
+	interval   time.Duration
+	budget     int64 //-1 表示不限制
+	budgetUsed int64
+	projects   map[string]struct{}
+	free       map[string]int64 //上次查询时每个项目的剩余空间，不在其中的项目没有存储配额
+	pending    map[string]int64 //上次查询之后分发到每个项目的大小
+	inflight   map[string]int64 //每个项目正在传输的大小
+}
+
+// newCapacityChecker 目标镜像仓库既没有配置 harborApi 也没有配置 capacity.budget 时返回空
+func newCapacityChecker(target config.TargetConfig, authPath string) (*capacityChecker, error) {
+	if target.HarborApi == "" && target.Capacity.Budget == "" {
+		return nil, nil
+	}
+	budget, err := config.ParseByteSize(target.Capacity.Budget)
+	if err != nil {
+		return nil, err
+	}
+	if target.Capacity.Budget == "" {
+		budget = -1
+	}
+	c := &capacityChecker{
+		policy:   target.Capacity.Policy,
+		interval: target.Capacity.CheckInterval,
+		budget:   budget,
+		projects: make(map[string]struct{}),
+		free:     make(map[string]int64),
+		pending:  make(map[string]int64),
+		inflight: make(map[string]int64),
+	}
+	if target.HarborApi != "" {
+		c.harbor = registryserver.NewHarborClient(target.HarborApi, target.Addr, authPath)
+	}
+	return c, nil
+}
+
+// refresh 查询项目的存储配额，项目不存在或者查询失败时保留之前的结果，
+// 已经分发但还没有传输完成的镜像可能只有部分计入已使用大小，仍然全部计入 pending
+func (c *capacityChecker) refresh(projects []string) {
+	if c.harbor == nil {
+		return
+	}
+	for _, project := range projects {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		summary, err := c.harbor.ProjectSummary(ctx, project)
+		cancel()
+		if errors.Cause(err) == registryserver.ErrNotFound {
+			glog.Warnf("project %s not found in target harbor,skip capacity check", project)
+			continue
+		}
+		if err != nil {
+			glog.Warnf("get summary of project %s failed,err:%v", project, secret.RedactError(err))
+			continue
+		}
+		hard, used := summary.StorageLimit()
+		c.lock.Lock()
+		c.projects[project] = struct{}{}
+		if hard < 0 {
+			delete(c.free, project)
+		} else {
+			c.free[project] = hard - used
+		}
+		c.pending[project] = c.inflight[project]
+		c.lock.Unlock()
+	}
+}
+
+// Watch 每隔 checkInterval 重新查询已知项目的存储配额
+func (c *capacityChecker) Watch() {
+	for {
+		time.Sleep(c.interval)
+		c.lock.Lock()
+		projects := make([]string, 0, len(c.projects))
+		for project := range c.projects {
+			projects = append(projects, project)
+		}
+		c.lock.Unlock()
+		c.refresh(projects)
+	}
+}
+
+// check 在已经分发的大小之外再写入 projectSize 到项目、共写入 budgetSize 时是否超过配额，调用方需持有 lock
+func (c *capacityChecker) check(project string, projectSize, budgetSize int64) error {
+	if c.budget >= 0 && c.budgetUsed+budgetSize > c.budget {
+		return errors.Errorf("capacity budget exceeded,budget:%d,used:%d,need:%d", c.budget, c.budgetUsed, budgetSize)
+	}
+	if free, ok := c.free[project]; ok && c.pending[project]+projectSize > free {
+		return errors.Errorf("project %s storage quota exceeded,free:%d,pending:%d,need:%d",
+			project, free, c.pending[project], projectSize)
+	}
+	return nil
+}
+
+// unknownSize 镜像大小未知时无法估算，配置了 budget 或者项目有存储配额时视为放不下，调用方需持有 lock
+func (c *capacityChecker) unknownSize(project string) error {
+	if _, ok := c.free[project]; ok || c.budget >= 0 {
+		return errors.New("image size is unknown")
+	}
+	return nil
+}
+
+// Reserve 检查并占用镜像需要写入的大小，不足时重新查询一次项目配额后再检查，known 为 false 表示镜像大小未知
+func (c *capacityChecker) Reserve(project string, size int64, known bool) error {
+	if !known {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return c.unknownSize(project)
+	}
+	c.lock.Lock()
+	err := c.check(project, size, size)
+	c.lock.Unlock()
+	if err != nil {
+		c.refresh([]string{project})
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err = c.check(project, size, size); err != nil {
+		return err
+	}
+	c.budgetUsed += size
+	c.pending[project] += size
+	c.inflight[project] += size
+	return nil
+}
+
+// Release 镜像同步结束，失败时不再占用 budget 以及项目配额
+func (c *capacityChecker) Release(project string, size int64, succeed bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.inflight[project] -= size
+	if !succeed {
+		c.budgetUsed -= size
+		c.pending[project] -= size
+	}
+}
+
+// preflightCapacity 按分发顺序估算每个镜像需要写入的大小（镜像之间共用的 blob 只计算一次），
+// 找出放不下的镜像，policy 为 refuse 并且存在放不下的镜像时返回 false，不开始同步
+func (s *SyncImageManager) preflightCapacity() bool {
+	images := s.queue.List()
+	seenProjects := make(map[string]struct{})
+	var projects []string
+	for _, imageMeta := range images {
+		project, _ := splitImageNameToProjAndRepo(imageMeta.Name)
+		if _, ok := seenProjects[project]; !ok {
+			seenProjects[project] = struct{}{}
+			projects = append(projects, project)
+		}
+	}
+	sort.Strings(projects)
+	s.capacity.refresh(projects)
+
+	seen := make(map[string]struct{})
+	projectSizes := make(map[string]int64)
+	var totalSize, shortageSize int64
+	var shortage int
+	s.capacity.lock.Lock()
+	for _, imageMeta := range images {
+		project, _ := splitImageNameToProjAndRepo(imageMeta.Name)
+		size, digests, known := s.uniqueSize(imageMeta, seen)
+		err := s.capacity.unknownSize(project)
+		if known {
+			err = s.capacity.check(project, projectSizes[project]+size, totalSize+size)
+		}
+		if err != nil {
+			glog.Warn("target registry has no capacity for image", logError(err), logMeta(imageMeta))
+			shortage++
+			shortageSize += size
+			continue
+		}
+		for _, digest := range digests {
+			seen[digest] = struct{}{}
+		}
+		projectSizes[project] += size
+		totalSize += size
+	}
+	s.capacity.lock.Unlock()
+	glog.Infof("capacity preflight finished,estimated size:%v GB,%d images(%v GB) do not fit,policy:%s",
+		totalSize>>30, shortage, shortageSize>>30, s.capacity.policy)
+	if shortage > 0 && s.capacity.policy == config.CapacityRefuse {
+		glog.Errorf("target registry has no capacity for %d images,refuse to start sync", shortage)
+		return false
+	}
+	return true
+}
+
+// reserveCapacity 分发镜像前占用目标镜像仓库的空间，空间不足时按照 policy 跳过该镜像或者停止分发，
+// 没有分发的镜像记录为同步失败，返回是否继续分发后面的镜像
+func (s *SyncImageManager) reserveCapacity(imageMeta DataImage) (reserved bool, proceed bool) {
+	project, _ := splitImageNameToProjAndRepo(imageMeta.Name)
+	s.lock.Lock()
+	size, _, known := s.uniqueSize(imageMeta, s.dispatchedBlobs)
+	s.lock.Unlock()
+	err := s.capacity.Reserve(project, size, known)
+	if err == nil {
+		return true, true
+	}
+	if s.capacity.policy == config.CapacitySkip {
+		glog.Warn("target registry has no capacity for image,skip", logError(err), logMeta(imageMeta))
+		s.skipImage(imageMeta)
+		return false, true
+	}
+	glog.Warn("target registry has no capacity for image,stop dispatch", logError(err), logMeta(imageMeta))
+	s.skipImage(imageMeta)
+	for {
+		imageMeta, ok := s.queue.Pop()
+		if !ok {
+			return false, false
+		}
+		s.skipImage(imageMeta)
+	}
+}
+
+// skipImage 没有分发的镜像记录为同步失败，下次运行时重新选择
+func (s *SyncImageManager) skipImage(imageMeta DataImage) {
+	imageMeta.Status = SyncFailed
+	imageMeta.CreateTime = time.Now()
+	imageMeta.RunId = config.IMConfig.RunId
+	s.recordImageSyncResult(imageMeta)
+	s.decrNeedSyncCount()
+}
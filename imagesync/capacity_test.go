@@ -0,0 +1,186 @@
+package imagesync
+
+import (
+	"bufio"
+	"fmt"
+	"image-sync/config"
+	"image-sync/registryserver/standin"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newHarborStandin 启动 Harbor 接口替身，projects 为每个项目的 hard、used，hard 为 -1 表示不限制
+func newHarborStandin(t *testing.T, projects map[string][2]int64) *httptest.Server {
+	server := httptest.NewServer(standin.NewServer())
+	t.Cleanup(server.Close)
+	for name, quota := range projects {
+		putProject(t, server, name, quota[0], quota[1])
+	}
+	return server
+}
+
+func putProject(t *testing.T, server *httptest.Server, name string, hard, used int64) {
+	body := fmt.Sprintf(`{"hard":%d,"used":%d}`, hard, used)
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/standin/projects/"+name, strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("put project %s status code %d", name, resp.StatusCode)
+	}
+}
+
+func newTestCapacityChecker(t *testing.T, harborApi, budget, policy string) *capacityChecker {
+	target := config.TargetConfig{
+		Addr:      "target.example.com",
+		HarborApi: harborApi,
+		Capacity:  config.CapacityConfig{Budget: budget, Policy: policy},
+	}
+	c, err := newCapacityChecker(target, filepath.Join(t.TempDir(), "auth.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCapacityReserveRelease(t *testing.T) {
+	server := newHarborStandin(t, map[string][2]int64{"quota": {1000, 600}, "unlimited": {-1, 600}})
+	c := newTestCapacityChecker(t, server.URL, "", config.CapacityRefuse)
+	// 同步前 preflightCapacity 已经查询过所有项目的配额
+	c.refresh([]string{"quota", "unlimited", "missing"})
+	steps := []struct {
+		name    string
+		do      func() error
+		wantErr bool
+	}{
+		{name: "reserve within free", do: func() error { return c.Reserve("quota", 300, true) }},
+		{name: "reserve exceeds free with pending", do: func() error { return c.Reserve("quota", 200, true) }, wantErr: true},
+		{name: "failed image releases quota", do: func() error {
+			c.Release("quota", 300, false)
+			return c.Reserve("quota", 200, true)
+		}},
+		{name: "succeed image counts after harbor refresh", do: func() error {
+			c.Release("quota", 200, true)
+			putProject(t, server, "quota", 1000, 800)
+			return c.Reserve("quota", 300, true)
+		}, wantErr: true},
+		{name: "reserve within refreshed free", do: func() error { return c.Reserve("quota", 200, true) }},
+		{name: "unknown size with quota", do: func() error { return c.Reserve("quota", 0, false) }, wantErr: true},
+		{name: "unlimited project", do: func() error { return c.Reserve("unlimited", 1<<40, true) }},
+		{name: "unknown size without quota", do: func() error { return c.Reserve("unlimited", 0, false) }},
+		{name: "project not in harbor", do: func() error { return c.Reserve("missing", 1<<40, true) }},
+	}
+	for _, step := range steps {
+		if err := step.do(); (err != nil) != step.wantErr {
+			t.Fatalf("%s: err = %v, wantErr %v", step.name, err, step.wantErr)
+		}
+	}
+}
+
+func TestCapacityBudget(t *testing.T) {
+	// 没有配置 harborApi 时只检查 budget
+	c := newTestCapacityChecker(t, "", "500B", config.CapacityRefuse)
+	if err := c.Reserve("p", 300, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reserve("q", 300, true); err == nil {
+		t.Error("Reserve() over budget should fail")
+	}
+	if err := c.Reserve("q", 0, false); err == nil {
+		t.Error("Reserve() unknown size with budget should fail")
+	}
+	c.Release("p", 300, true)
+	if err := c.Reserve("q", 300, true); err == nil {
+		t.Error("written size should still count in budget")
+	}
+	if c := newTestCapacityChecker(t, "", "", ""); c != nil {
+		t.Error("newCapacityChecker() without harborApi and budget should return nil")
+	}
+}
+
+func newCapacityManager(t *testing.T, c *capacityChecker, images []DataImage) *SyncImageManager {
+	queue, _ := newSyncQueue(nil)
+	for _, image := range images {
+		queue.Push(image)
+	}
+	return &SyncImageManager{
+		capacity:             c,
+		queue:                queue,
+		currentNeedSyncCount: len(images) + 1,
+		exitChan:             make(chan struct{}, 1),
+	}
+}
+
+func readFailedImages(t *testing.T, outputPath string) []string {
+	file, err := os.Open(filepath.Join(outputPath, "sync-failed"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var names []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		for _, name := range []string{"p/a", "p/b", "p/c"} {
+			if strings.Contains(scanner.Text(), `"`+name+`"`) {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func TestCapacityPolicies(t *testing.T) {
+	// p 剩余 400B，按顺序 p/a 放得下，p/b 放不下，p/c 在 p/a 之后仍然放得下
+	images := []DataImage{
+		{Name: "p/a", Tag: "v1", Size: "300"},
+		{Name: "p/b", Tag: "v1", Size: "200"},
+		{Name: "p/c", Tag: "v1", Size: "100"},
+	}
+	tests := []struct {
+		policy        string
+		wantPreflight bool
+		wantProceed   bool
+		wantFailed    []string
+		wantQueued    int
+	}{
+		{policy: config.CapacityRefuse, wantPreflight: false, wantProceed: false, wantFailed: []string{"p/b", "p/c"}},
+		{policy: config.CapacityStop, wantPreflight: true, wantProceed: false, wantFailed: []string{"p/b", "p/c"}},
+		{policy: config.CapacitySkip, wantPreflight: true, wantProceed: true, wantFailed: []string{"p/b"}, wantQueued: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			config.IMConfig = &config.GlobalConfig{OutputPath: t.TempDir()}
+			server := newHarborStandin(t, map[string][2]int64{"p": {1000, 600}})
+			s := newCapacityManager(t, newTestCapacityChecker(t, server.URL, "", tt.policy), images)
+			if got := s.preflightCapacity(); got != tt.wantPreflight {
+				t.Errorf("preflightCapacity() = %v, want %v", got, tt.wantPreflight)
+			}
+
+			// 同步过程中按顺序分发
+			first, _ := s.queue.Pop()
+			if reserved, proceed := s.reserveCapacity(first); !reserved || !proceed {
+				t.Fatalf("reserveCapacity(%s) = %v,%v, want true,true", first.Name, reserved, proceed)
+			}
+			second, _ := s.queue.Pop()
+			reserved, proceed := s.reserveCapacity(second)
+			if reserved || proceed != tt.wantProceed {
+				t.Errorf("reserveCapacity(%s) = %v,%v, want false,%v", second.Name, reserved, proceed, tt.wantProceed)
+			}
+			if got := s.queue.Len(); got != tt.wantQueued {
+				t.Errorf("queue length = %d, want %d", got, tt.wantQueued)
+			}
+			if got := readFailedImages(t, config.IMConfig.OutputPath); strings.Join(got, ",") != strings.Join(tt.wantFailed, ",") {
+				t.Errorf("sync-failed = %v, want %v", got, tt.wantFailed)
+			}
+		})
+	}
+}
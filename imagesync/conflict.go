@@ -0,0 +1,166 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/config"
+	"image-sync/ocilayout"
+	"image-sync/registryserver"
+	"image-sync/secret"
+	"os"
+	"path"
+	"time"
+)
+
+// ConflictFile 记录目标镜像仓库中已经存在同名 tag 且内容不同的镜像，每行一个 JSON
+const ConflictFile = "tag-conflicts"
+
+// TagConflict 目标镜像仓库中同名 tag 的 digest 与源镜像不同
+type TagConflict struct {
+	Name         string    `json:"image_name"`
+	Tag          string    `json:"image_tag"`
+	SourceDigest string    `json:"source_digest"`
+	TargetDigest string    `json:"target_digest"`
+	Policy       string    `json:"policy"`
+	RenamedTag   string    `json:"renamed_tag,omitempty"` //rename 时保留原有内容的 tag
+	Error        string    `json:"error,omitempty"`
+	RunId        string    `json:"run_id"`
+	CreateTime   time.Time `json:"create_time"`
+}
+
+// checkTagConflict 复制前比较源镜像与目标镜像仓库中同名 tag 的 digest，按照目标镜像仓库的 tagConflict 处理不同的内容，
+// sourceDigests 为源镜像的 digest 以及多平台镜像中每个平台的 digest（只同步一个平台时目标 tag 指向该平台）。
+// 返回是否继续复制，fail 或者无法处理冲突时返回错误
+func (s *SyncImageManager) checkTagConflict(ctx context.Context, imageMeta DataImage, sourceDigests []string) (bool, error) {
+	target := config.IMConfig.Target(s.targetRegistryAddr)
+	targetDigest, err := s.targetRegistryServer.GetManifestDigest(ctx, imageMeta.Name, imageMeta.Tag)
+	if errors.Cause(err) == registryserver.ErrNotFound {
+		return true, nil
+	}
+	if err != nil {
+		if target.TagConflict == config.TagConflictOverwrite {
+			glog.Warnf("get target manifest digest of %s:%s failed,overwrite,err:%v", imageMeta.Name, imageMeta.Tag, secret.RedactError(err))
+			return true, nil
+		}
+		return false, err
+	}
+	for _, digest := range append(sourceDigests, s.pushedDigests(imageMeta)...) {
+		if digest == targetDigest {
+			return true, nil
+		}
+	}
+
+	conflict := TagConflict{
+		Name:         imageMeta.Name,
+		Tag:          imageMeta.Tag,
+		TargetDigest: targetDigest,
+		Policy:       target.TagConflict,
+		RunId:        config.IMConfig.RunId,
+		CreateTime:   time.Now(),
+	}
+	if len(sourceDigests) > 0 {
+		conflict.SourceDigest = sourceDigests[0]
+	}
+	proceed := true
+	switch target.TagConflict {
+	case config.TagConflictSkip:
+		proceed = false
+	case config.TagConflictFail:
+		proceed = false
+		err = errors.Errorf("tag %s:%s already exists in target registry with digest %s,source digest %s",
+			imageMeta.Name, imageMeta.Tag, targetDigest, conflict.SourceDigest)
+	case config.TagConflictRename:
+		conflict.RenamedTag = imageMeta.Tag + target.RenameSuffix
+		if err = s.renameTag(ctx, imageMeta.Name, conflict.RenamedTag, targetDigest); err != nil {
+			proceed = false
+		}
+	}
+	if err != nil {
+		conflict.Error = err.Error()
+	}
+	glog.Warn("tag conflict", logMeta(imageMeta), glog.String("sourceDigest", conflict.SourceDigest),
+		glog.String("targetDigest", targetDigest), glog.String("policy", target.TagConflict), glog.String("renamedTag", conflict.RenamedTag))
+	s.recordTagConflict(conflict)
+	return proceed, err
+}
+
+// renameTag 把目标镜像仓库中 digest 对应的 manifest 推送到 renamedTag，renamedTag 已经指向其他内容时返回错误
+func (s *SyncImageManager) renameTag(ctx context.Context, imageName, renamedTag, digest string) error {
+	existing, err := s.targetRegistryServer.GetManifestDigest(ctx, imageName, renamedTag)
+	if err == nil && existing != digest {
+		return errors.Errorf("renamed tag %s:%s already exists with digest %s", imageName, renamedTag, existing)
+	}
+	if err != nil && errors.Cause(err) != registryserver.ErrNotFound {
+		return err
+	}
+	body, mediaType, _, err := s.targetRegistryServer.GetManifest(ctx, imageName, digest)
+	if err != nil {
+		return err
+	}
+	_, err = s.targetRegistryServer.PutManifest(ctx, imageName, renamedTag, mediaType, body)
+	return err
+}
+
+// pushedDigests 之前的运行推送到目标镜像仓库的 digest，推送过滤平台后的 index 时 digest 与源镜像不同
+func (s *SyncImageManager) pushedDigests(imageMeta DataImage) []string {
+	s.pushedOnce.Do(func() {
+		s.pushed = make(map[string][]string)
+		for _, image := range GetSyncSucceedImageList(path.Join(config.IMConfig.OutputPath, "sync-succeed")) {
+			if image.Digest != "" {
+				s.pushed[image.Name+":"+image.Tag] = append(s.pushed[image.Name+":"+image.Tag], image.Digest)
+			}
+		}
+	})
+	return s.pushed[imageMeta.Name+":"+imageMeta.Tag]
+}
+
+// sourceDigests 源镜像仓库中镜像的 digest，多平台镜像同时返回每个平台的 digest
+func (s *SyncImageManager) sourceDigests(ctx context.Context, imageMeta DataImage) ([]string, error) {
+	body, _, digest, err := s.sourceRegistryServer.GetManifest(ctx, imageMeta.Name, sourceReference(imageMeta))
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{digest}, childDigests(body)...), nil
+}
+
+// layoutDigests 导出目录中镜像的 digest，多平台镜像同时返回每个平台的 digest
+func layoutDigests(layout *ocilayout.Layout, image ExportedImage) []string {
+	body, err := layout.ReadBlob(image.Digest)
+	if err != nil {
+		return []string{image.Digest}
+	}
+	return append([]string{image.Digest}, childDigests(body)...)
+}
+
+func childDigests(body []byte) []string {
+	manifest := new(registryserver.Manifest)
+	if err := json.Unmarshal(body, manifest); err != nil {
+		return nil
+	}
+	digests := make([]string, 0, len(manifest.Manifests))
+	for _, child := range manifest.Manifests {
+		digests = append(digests, child.Digest)
+	}
+	return digests
+}
+
+func (s *SyncImageManager) recordTagConflict(conflict TagConflict) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data, err := json.Marshal(&conflict)
+	if err != nil {
+		glog.Warnf("marshal tag conflict failed,err:%v", err)
+		return
+	}
+	file, err := os.OpenFile(path.Join(config.IMConfig.OutputPath, ConflictFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		glog.Warnf("open tag conflict file failed,err:%v", err)
+		return
+	}
+	defer file.Close()
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		glog.Warnf("write tag conflict failed,err:%v", err)
+	}
+}
@@ -10,9 +10,13 @@ import (
 	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
 	"gitlab.yellow.virtaitech.com/gemini-platform/public-geminidb/model"
 	"gopkg.in/yaml.v3"
+	"image-sync/bandwidth"
+	"image-sync/blobcache"
 	"image-sync/config"
 	"image-sync/dao"
 	"image-sync/registryserver"
+	"image-sync/secret"
+	"image-sync/transfer"
 	"io"
 	"os"
 	"os/exec"
@@ -26,6 +30,8 @@ import (
 const (
 	BasePath          = "./"
 	SyncSucceedResult = "inished, 0 tasks failed"
+	UploadsDir        = "uploads"
+	PriorityFile      = "sync-priority" //写入 name:tag 或镜像ID，每行一个，对应镜像会被提到队首
 
 	OfficialRepo = 1
 	Published    = 1
@@ -34,6 +40,7 @@ const (
 var (
 	SyncSize           int64 //此次同步镜像大小,单位B
 	syncFailedCount    int
+	syncSkippedCount   int
 	totalNeedSyncCount int
 )
 
@@ -42,55 +49,175 @@ type SyncImageManager struct {
 	targetRegistryAddr   string
 	syncerPath           string
 	authPath             string
-	pullGoroutineChan    chan struct{}
+	syncerAuthPath       string //解析密码引用后的临时 auth 文件，只在 Sync 期间存在
+	scheduler            *syncScheduler
+	bandwidth            *bandwidth.Controller
+	proxyURL             string
 	exitChan             chan struct{}
 	lock                 sync.Mutex
 	syncStartTime        time.Time
 	currentNeedSyncCount int
+	sourceRegistryServer *registryserver.Server
 	targetRegistryServer *registryserver.Server
+	copier               *transfer.Copier //native 复制以及 import 使用，目标镜像仓库不可访问时为空
+	plan                 *transfer.Plan   //native 复制前检查 manifest 得到的 blob 信息
+	cache                *blobcache.Cache //本地 blob 缓存，未配置时为空
+	capacity             *capacityChecker //目标镜像仓库的容量检查，未配置 harborApi 以及 capacity.budget 时为空
+	dispatchedBlobs      map[string]struct{}
+	pushed               map[string][]string //sync-succeed 中记录的每个镜像推送到目标镜像仓库的 digest
+	pushedOnce           sync.Once
+	queue                *syncQueue
+	succeedHook          func(image DataImage)
+	succeedImages        []DataImage
 }
 
 func NewSyncImageManager(
 	syncerPath string,
 	authPath string) *SyncImageManager {
 
-	return &SyncImageManager{
+	maxInflightBytes, err := config.ParseByteSize(config.IMConfig.MaxInflightSize)
+	if err != nil {
+		glog.Fatal("parse maxInflightSize failed", logError(err))
+	}
+	bandwidthController, err := bandwidth.NewController(config.IMConfig.Bandwidth, config.IMConfig.Targets)
+	if err != nil {
+		glog.Fatal("init bandwidth controller failed", logError(err))
+	}
+	// 离线导出时无法访问目标镜像仓库，导入时无法访问源镜像仓库
+	sourceRegistryAddr, targetRegistryAddr := config.IMConfig.SourceRegistryAddr, config.IMConfig.TargetRegistryAddr
+	switch config.IMConfig.Mode {
+	case config.ModeExport:
+		targetRegistryAddr = ""
+	case config.ModeImport:
+		sourceRegistryAddr = ""
+	}
+	s := &SyncImageManager{
+		bandwidth:            bandwidthController,
+		scheduler:            newSyncScheduler(config.IMConfig.Proc, config.IMConfig.MaxProc, maxInflightBytes),
 		sourceRegistryAddr:   config.IMConfig.SourceRegistryAddr,
 		targetRegistryAddr:   config.IMConfig.TargetRegistryAddr,
 		syncerPath:           syncerPath,
 		authPath:             authPath,
-		pullGoroutineChan:    make(chan struct{}, config.IMConfig.Proc),
 		exitChan:             make(chan struct{}, 1),
-		targetRegistryServer: registryserver.Init(config.IMConfig.TargetRegistryAddr, authPath),
+		sourceRegistryServer: initRegistryServer(sourceRegistryAddr, authPath),
+		targetRegistryServer: initRegistryServer(targetRegistryAddr, authPath),
+	}
+	if config.IMConfig.Cache.Dir != "" {
+		maxCacheSize, err := config.ParseByteSize(config.IMConfig.Cache.MaxSize)
+		if err != nil {
+			glog.Fatal("parse cache maxSize failed", logError(err))
+		}
+		s.cache, err = blobcache.Open(config.IMConfig.Cache.Dir, maxCacheSize)
+		if err != nil {
+			glog.Fatal("open blob cache failed", logError(err))
+		}
+		s.cache.SetLimit(bandwidthController.CacheFillReader)
+	}
+	if s.targetRegistryServer != nil {
+		s.capacity, err = newCapacityChecker(config.IMConfig.Target(targetRegistryAddr), authPath)
+		if err != nil {
+			glog.Fatal("init capacity checker failed", logError(err))
+		}
+		s.copier, err = s.newCopier()
+		if err != nil {
+			glog.Fatal("init copier failed", logError(err))
+		}
 	}
+	return s
+}
+
+// newCopier 上传会话保存在 OutputPath/uploads 中，重启后可以继续上传
+func (s *SyncImageManager) newCopier() (*transfer.Copier, error) {
+	chunkSize, err := config.ParseByteSize(config.IMConfig.ChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	sessions, err := transfer.NewSessionStore(path.Join(config.IMConfig.OutputPath, UploadsDir))
+	if err != nil {
+		return nil, err
+	}
+	copier := transfer.NewCopier(s.sourceRegistryServer, s.targetRegistryServer, s.targetRegistryAddr, sessions, chunkSize,
+		func(reader io.Reader) io.Reader {
+			return s.bandwidth.Reader(s.targetRegistryAddr, reader)
+		})
+	if s.cache != nil {
+		copier.SetCache(s.cache)
+	}
+	target := config.IMConfig.Target(s.targetRegistryAddr)
+	copier.SetPlatforms(target.Platforms, target.FilterIndex)
+	return copier, nil
+}
+
+func initRegistryServer(registryAddr, authPath string) *registryserver.Server {
+	if registryAddr == "" {
+		return nil
+	}
+	return registryserver.Init(registryAddr, authPath)
+}
+
+// SetSucceedHook 设置镜像同步并校验成功后的回调，pipeline 模式用于立即写入目标 AZ 的元数据
+func (s *SyncImageManager) SetSucceedHook(hook func(image DataImage)) {
+	s.succeedHook = hook
+}
+
+// SucceedImages 返回本次运行中同步并校验成功的镜像
+func (s *SyncImageManager) SucceedImages() []DataImage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]DataImage(nil), s.succeedImages...)
 }
 
 func (s *SyncImageManager) GetNeedSyncImageMetaList() (needSyncImageMetaList []DataImage, err error) {
 	var imageList []DataImage
 	cm := config.IMConfig
-	switch cm.Mode {
-	case "sync":
+	mode := cm.Mode
+	switch mode {
+	case config.ModePipeline:
+		mode = cm.PipelineSource
+	case config.ModeExport:
+		mode = cm.ExportSource
+	}
+	switch mode {
+	case config.ModeSync:
 		imageList, err = s.getNeedSyncImage(cm.StartTime, cm.EndTime, cm.TargetAzId)
 		if err != nil {
 			return imageList, err
 		}
-	case "migration":
+	case config.ModeMigration:
 		imageList, err = s.getNeedMigrationImage(cm.SourceAzId)
 		if err != nil {
 			return imageList, err
 		}
+	case config.ModeList:
+		imageList, err = s.getNeedListImage(cm.ListFile)
+		if err != nil {
+			return imageList, err
+		}
+	}
+
+	if err = markOfficialImage(imageList); err != nil {
+		return imageList, err
 	}
 
-	//过滤已经同步成功的镜像
+	//过滤已经同步成功以及因为 tag 冲突跳过的镜像
 	syncSucceedImageMap := GetSyncSucceedImageMap(path.Join(config.IMConfig.OutputPath, "sync-succeed"))
+	syncSkippedImageMap := GetSyncSucceedImageMap(path.Join(config.IMConfig.OutputPath, SyncSkippedFile))
 	var unSyncImageList []DataImage
 	for i := 0; i < len(imageList); i++ {
-		if _, ok := syncSucceedImageMap[imageList[i].ID]; !ok {
-			unSyncImageList = append(unSyncImageList, imageList[i])
-		} else {
+		if _, ok := syncSucceedImageMap[imageList[i].ID]; ok {
 			glog.Infof("image %s already sync succeed", imageList[i].ID)
+		} else if _, ok = syncSkippedImageMap[imageList[i].ID]; ok {
+			glog.Infof("image %s already skipped by tag conflict", imageList[i].ID)
+		} else {
+			unSyncImageList = append(unSyncImageList, imageList[i])
 		}
 	}
+	maxTotalSize, err := config.ParseByteSize(cm.MaxTotalSize)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	unSyncImageList = limitImageList(unSyncImageList, cm.TopN, maxTotalSize)
+	s.resolveSourceDigests(unSyncImageList)
 	s.syncStartTime = time.Now()
 	glog.Infof("start sync image,total image:%d", len(unSyncImageList))
 	totalNeedSyncCount = len(unSyncImageList)
@@ -98,24 +225,129 @@ func (s *SyncImageManager) GetNeedSyncImageMetaList() (needSyncImageMetaList []D
 	return unSyncImageList, nil
 }
 
+// resolveSourceDigests 把每个镜像的 tag 解析为源镜像仓库中的 digest，之后的复制以及校验都使用该 digest，
+// 运行期间 tag 被重新推送时同步的仍然是选择时的镜像，解析失败的镜像仍然按 tag 同步
+func (s *SyncImageManager) resolveSourceDigests(imageList []DataImage) {
+	if s.sourceRegistryServer == nil {
+		return
+	}
+	proc := config.IMConfig.Proc
+	if proc <= 0 {
+		proc = 1
+	}
+	indexChan := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < proc; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexChan {
+				imageMeta := &imageList[index]
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+				digest, err := s.sourceRegistryServer.GetManifestDigest(ctx, imageMeta.Name, imageMeta.Tag)
+				cancel()
+				if err != nil {
+					glog.Warn("resolve source digest failed,sync by tag", logError(err), logMeta(*imageMeta))
+					continue
+				}
+				imageMeta.SourceDigest = digest
+			}
+		}()
+	}
+	for i := range imageList {
+		indexChan <- i
+	}
+	close(indexChan)
+	wg.Wait()
+}
+
 func (s *SyncImageManager) Sync(needSyncImageMetaList []DataImage) {
 	if needSyncImageMetaList == nil || len(needSyncImageMetaList) == 0 {
 		glog.Info("sync finished")
 		return
 	}
+	queue, err := newSyncQueue(config.IMConfig.Order)
+	if err != nil {
+		glog.Errorf("create sync queue failed,err:%v", secret.RedactError(err))
+		return
+	}
+	for _, imageMeta := range needSyncImageMetaList {
+		queue.Push(imageMeta)
+	}
+	s.queue = queue
+	native := config.IMConfig.Engine == config.EngineNative
+	if native {
+		s.inspectBlobs(needSyncImageMetaList)
+	} else {
+		// image-syncer 不支持密码引用，使用解析后的临时文件，密码不会出现在命令行中。
+		// 进程被信号终止时删除该文件，崩溃留下的文件在下次同步开始时删除
+		registryserver.RemoveResolvedAuthFiles(config.IMConfig.OutputPath)
+		s.syncerAuthPath, err = registryserver.WriteResolvedAuthFile(config.IMConfig.OutputPath, s.authPath, s.sourceRegistryAddr, s.targetRegistryAddr)
+		if err != nil {
+			glog.Errorf("resolve auth file failed,err:%v", secret.RedactError(err))
+			return
+		}
+		stopCleanup := removeOnSignal(s.syncerAuthPath)
+		defer stopCleanup()
+		defer os.Remove(s.syncerAuthPath)
+	}
+	// 先创建目标项目，容量检查需要查询项目的配额
+	s.ensureProjects(needSyncImageMetaList)
+	if s.capacity != nil {
+		if !s.preflightCapacity() {
+			return
+		}
+		go s.capacity.Watch()
+	}
+	go s.watchPriorityFile(path.Join(config.IMConfig.OutputPath, PriorityFile))
+	if config.IMConfig.StatusAddr != "" {
+		go s.serveStatus(config.IMConfig.StatusAddr)
+	}
+
+	// image-syncer 通过本地代理访问镜像仓库，代理负责限速以及统计自适应并发需要的传输字节数，
+	// native 复制直接限制并统计读取的字节数
+	if !native && (s.bandwidth.Enabled() || config.IMConfig.AdaptiveProc) {
+		s.proxyURL, err = s.bandwidth.StartProxy()
+		if err != nil {
+			glog.Errorf("start bandwidth proxy failed,err:%v", err)
+			return
+		}
+	}
+	if config.IMConfig.AdaptiveProc {
+		go s.scheduler.Adapt(time.Minute, s.bandwidth.Transferred)
+	}
+	if s.bandwidth.Enabled() {
+		s.scheduler.SetPaused(!s.bandwidth.Apply(time.Now()))
+		go s.watchTransferWindow()
+	}
+
 	go func() {
-		for i := 0; i < totalNeedSyncCount; i++ {
-			s.pullGoroutineChan <- struct{}{}
+		for {
+			// 先等待空闲的并发位置再出队，保证在此期间被提升优先级的镜像能够插队
+			s.scheduler.WaitSlot()
+			imageMeta, ok := s.queue.Pop()
+			if !ok {
+				return
+			}
+			if s.capacity != nil {
+				if reserved, proceed := s.reserveCapacity(imageMeta); !proceed {
+					return
+				} else if !reserved {
+					continue
+				}
+			}
+			size, digests := s.transferSize(imageMeta)
+			s.scheduler.Acquire(size)
 			go func(imageMeta DataImage) {
-				s.sync(imageMeta)
-			}(needSyncImageMetaList[i])
+				s.sync(imageMeta, size, digests)
+			}(imageMeta)
 		}
 	}()
 
 	for {
 		select {
 		case <-s.exitChan:
-			glog.Info("sync finished")
+			glog.Infof("sync finished,total:%d,failed:%d,skipped:%d", totalNeedSyncCount, syncFailedCount, syncSkippedCount)
 			return
 		default:
 			time.Sleep(time.Second * 5)
@@ -123,12 +355,25 @@ func (s *SyncImageManager) Sync(needSyncImageMetaList []DataImage) {
 	}
 }
 
-func (s *SyncImageManager) sync(imageMeta DataImage) {
+// sync 同步单个镜像，size 为分发时占用的传输中大小，digests 为分发时标记为已分发的 blob
+func (s *SyncImageManager) sync(imageMeta DataImage, size int64, digests []string) {
+	// skipped 为 true 时镜像因为 tag 冲突被跳过，没有写入目标镜像仓库，但不算同步失败
+	var succeed, skipped bool
 	defer func() {
-		<-s.pullGoroutineChan
-		removeImageYaml(imageMeta.Name, imageMeta.Tag, BasePath)
-		s.decrNeedSyncCount()
-		glog.Infof("current need to sync image count:%d,total image count:%d", s.currentNeedSyncCount, totalNeedSyncCount)
+		wrote := succeed && !skipped
+		if !wrote {
+			s.unmarkDispatched(digests)
+		}
+		s.scheduler.Release(size, succeed)
+		if s.capacity != nil {
+			project, _ := splitImageNameToProjAndRepo(imageMeta.Name)
+			s.capacity.Release(project, size, wrote)
+		}
+		if config.IMConfig.Engine != config.EngineNative {
+			removeImageYaml(imageMeta.Name, imageMeta.Tag, BasePath)
+		}
+		remaining := s.decrNeedSyncCount()
+		glog.Infof("current need to sync image count:%d,total image count:%d", remaining, totalNeedSyncCount)
 		costTimeSec := time.Now().Sub(s.syncStartTime).Seconds()
 		glog.Infof("synced image size:%v GB,synced time:%v,sync speed:%.2f MB/s\n", SyncSize>>30,
 			formatDuration(time.Since(s.syncStartTime)),
@@ -136,9 +381,24 @@ func (s *SyncImageManager) sync(imageMeta DataImage) {
 	}()
 
 	glog.Info("start sync image", logMeta(imageMeta))
+	if proceed, err := s.resolveTagConflict(imageMeta); err != nil {
+		glog.Warn("check tag conflict failed", logError(secret.RedactError(err)), logMeta(imageMeta))
+		succeed = s.verifyAndRecord(imageMeta, false, "")
+		return
+	} else if !proceed {
+		glog.Warn("target registry already has different content,skip", logMeta(imageMeta))
+		s.recordSkipped(imageMeta)
+		// 跳过的镜像不影响并发调整
+		succeed, skipped = true, true
+		return
+	}
+	if config.IMConfig.Engine == config.EngineNative {
+		succeed = s.copyImage(imageMeta)
+		return
+	}
 	// 生成镜像同步规则文件
 	// 参考:https://github.com/AliyunContainerService/image-syncer/blob/master/examples/images.yaml
-	err := s.genImageYaml(imageMeta.Name, imageMeta.Tag, BasePath)
+	err := s.genImageYaml(imageMeta, BasePath)
 	if err != nil {
 		glog.Warn("gen image yaml failed", logError(err), logMeta(imageMeta))
 		return
@@ -148,13 +408,19 @@ func (s *SyncImageManager) sync(imageMeta DataImage) {
 	if bashPath, err := exec.LookPath("bash"); err == nil && bashPath != "" {
 		cmd = exec.Command("bash")
 	}
-	cmd.Stdin = strings.NewReader("\n" + fmt.Sprintf("%s --images %s --auth %s --retries 3", s.syncerPath,
-		imageYamlPath(imageMeta.Name, imageMeta.Tag, BasePath), s.authPath))
+	cmd.Stdin = strings.NewReader("\n" + fmt.Sprintf("%s --images %s --auth %s --retries 3%s", s.syncerPath,
+		imageYamlPath(imageMeta.Name, imageMeta.Tag, BasePath), s.syncerAuthPath, s.platformArgs()))
+	if s.proxyURL != "" {
+		cmd.Env = append(os.Environ(),
+			"HTTPS_PROXY="+s.proxyURL, "https_proxy="+s.proxyURL,
+			"HTTP_PROXY="+s.proxyURL, "http_proxy="+s.proxyURL,
+			"NO_PROXY=", "no_proxy=")
+	}
 	stdout, _ := cmd.StdoutPipe()
 	cmd.Stderr = cmd.Stdout
 	var syncOutput string
 	if err = cmd.Start(); err != nil {
-		s.checkSyncResult(imageMeta, syncOutput)
+		succeed = s.checkSyncResult(imageMeta, syncOutput)
 		return
 	}
 	var imageSyncEOFCount int
@@ -167,13 +433,14 @@ func (s *SyncImageManager) sync(imageMeta DataImage) {
 			}
 			break
 		}
+		line = secret.Redact(line)
 		fmt.Println(line)
 		// when sync progress occurs this error,this process will hang
 		if strings.Contains(line, "unexpected EOF") {
 			imageSyncEOFCount++
 			if imageSyncEOFCount == 5 {
 				glog.Errorf("sync image failed,err:unexpected EOF,image source data maybe corruption")
-				s.checkSyncResult(imageMeta, syncOutput)
+				succeed = s.checkSyncResult(imageMeta, syncOutput)
 				return
 			}
 		}
@@ -181,10 +448,114 @@ func (s *SyncImageManager) sync(imageMeta DataImage) {
 	}
 	if err = cmd.Wait(); err != nil {
 		glog.Errorf("cmd exec failed:%v", err.Error())
-		s.checkSyncResult(imageMeta, syncOutput)
+		succeed = s.checkSyncResult(imageMeta, syncOutput)
 		return
 	}
-	s.checkSyncResult(imageMeta, syncOutput)
+	succeed = s.checkSyncResult(imageMeta, syncOutput)
+}
+
+// resolveTagConflict 查询源镜像的 digest，目标镜像仓库中同名 tag 的内容不同时按照 tagConflict 处理，返回是否继续同步
+func (s *SyncImageManager) resolveTagConflict(imageMeta DataImage) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	sourceDigests, err := s.sourceDigests(ctx, imageMeta)
+	if err != nil {
+		return false, err
+	}
+	return s.checkTagConflict(ctx, imageMeta, sourceDigests)
+}
+
+// platformArgs 目标镜像仓库配置了 platforms 时 image-syncer 的 --os、--arch 参数，image-syncer 不支持 variant，
+// 同步的是所有 os 与 arch 的组合，无法这样表示的 platforms 在校验配置时已经拒绝
+func (s *SyncImageManager) platformArgs() string {
+	var osList, archList []string
+	seen := make(map[string]bool)
+	for _, platform := range config.IMConfig.Target(s.targetRegistryAddr).Platforms {
+		parts := strings.Split(platform, "/")
+		if !seen["os:"+parts[0]] {
+			seen["os:"+parts[0]] = true
+			osList = append(osList, parts[0])
+		}
+		if !seen["arch:"+parts[1]] {
+			seen["arch:"+parts[1]] = true
+			archList = append(archList, parts[1])
+		}
+	}
+	if len(osList) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" --os %s --arch %s", strings.Join(osList, ","), strings.Join(archList, ","))
+}
+
+// inspectBlobs native 复制前检查所有镜像的 manifest，统计镜像之间共用的 blob，共用的 blob 只会上传一次
+func (s *SyncImageManager) inspectBlobs(imageList []DataImage) {
+	refs := make([]transfer.ImageRef, 0, len(imageList))
+	for _, imageMeta := range imageList {
+		refs = append(refs, transfer.ImageRef{Name: imageMeta.Name, Reference: sourceReference(imageMeta)})
+	}
+	plan, err := s.copier.Inspect(context.Background(), refs)
+	if err != nil {
+		glog.Warnf("inspect image manifests failed,err:%v", secret.RedactError(err))
+		return
+	}
+	s.plan = plan
+	glog.Infof("inspect image manifests finished,blobs:%d,total size:%v GB,unique size:%v GB",
+		len(plan.Blobs), plan.TotalSize>>30, plan.UniqueSize>>30)
+}
+
+// transferSize 镜像需要传输的大小，检查过 manifest 时只计算之前分发的镜像中没有的 blob 并标记为已分发，
+// 与之前的镜像共用大部分 layer 的镜像几乎不占用传输中大小
+func (s *SyncImageManager) transferSize(imageMeta DataImage) (int64, []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.dispatchedBlobs == nil {
+		s.dispatchedBlobs = make(map[string]struct{})
+	}
+	size, digests, _ := s.uniqueSize(imageMeta, s.dispatchedBlobs)
+	for _, digest := range digests {
+		s.dispatchedBlobs[digest] = struct{}{}
+	}
+	return size, digests
+}
+
+// unmarkDispatched 镜像同步失败时 blob 可能没有写入目标镜像仓库，取消已分发的标记，之后分发的镜像重新计算这些 blob 的大小
+func (s *SyncImageManager) unmarkDispatched(digests []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, digest := range digests {
+		delete(s.dispatchedBlobs, digest)
+	}
+}
+
+// uniqueSize 镜像中不在 seen 里的 blob 的总大小以及这些 blob 的 digest，没有检查过 manifest 时使用镜像大小，
+// 镜像大小无法解析时 ok 为 false
+func (s *SyncImageManager) uniqueSize(imageMeta DataImage, seen map[string]struct{}) (size int64, unique []string, ok bool) {
+	if s.plan == nil {
+		size, ok = parseImageSize(imageMeta)
+		return size, nil, ok
+	}
+	digests, ok := s.plan.ImageBlobs[transfer.ImageRef{Name: imageMeta.Name, Reference: sourceReference(imageMeta)}.String()]
+	if !ok {
+		size, ok = parseImageSize(imageMeta)
+		return size, nil, ok
+	}
+	for _, digest := range digests {
+		if _, ok := seen[digest]; ok {
+			continue
+		}
+		unique = append(unique, digest)
+		size += s.plan.Blobs[digest]
+	}
+	return size, unique, true
+}
+
+// copyImage 使用内置的复制把镜像复制到目标镜像仓库，大 layer 分块上传，失败后从已确认的位置继续
+func (s *SyncImageManager) copyImage(imageMeta DataImage) bool {
+	digest, err := s.copier.CopyImage(context.Background(), imageMeta.Name, sourceReference(imageMeta), imageMeta.Tag)
+	if err != nil {
+		glog.Warn("copy image failed", logError(secret.RedactError(err)), logMeta(imageMeta))
+	}
+	return s.verifyAndRecord(imageMeta, err == nil, digest)
 }
 
 // get images used between startTime and endTime and official image,and targetAz registry don't have this image
@@ -193,28 +564,28 @@ func (s *SyncImageManager) getNeedSyncImage(
 	endTime string,
 	targetAzId string) (needSyncImageMetaList []DataImage, err error) {
 
-	// 按照起始、结束时间过滤任务使用过的镜像
-	var imageIds []int64
-	err = dao.MySQL().Table("pro_job").Distinct("image_id").Select("image_id").
+	// 按照起始、结束时间统计任务使用过的镜像及其使用次数
+	var usages []imageUsage
+	err = dao.MySQL().Table("pro_job").
+		Select("image_id, COUNT(*) AS usage_count, MAX(create_time) AS last_used_time").
 		Where("create_time > ?", startTime).
 		And("create_time < ?", endTime).
-		Find(&imageIds)
+		GroupBy("image_id").
+		Find(&usages)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	imageIds := make([]int64, 0, len(usages))
+	usageMap := make(map[string]imageUsage, len(usages))
+	for _, usage := range usages {
+		imageIds = append(imageIds, usage.ImageId)
+		usageMap[strconv.FormatInt(usage.ImageId, 10)] = usage
+	}
 
 	// 查询所有官方镜像
-	var officialImageIds []int64
-	err = dao.MySQL().Table("data_image").
-		Select("data_image.image_id").
-		Join("RIGHT", "data_image_repository",
-			"data_image_repository.image_repository_id = data_image.image_repository_id ").
-		And("data_image_repository.publish_status = ?", Published).
-		And("data_image_repository.is_official= ?", OfficialRepo).
-		And("data_image.libra_status = ?", constant.PavoStatusNormal).
-		Find(&officialImageIds)
+	officialImageIds, err := GetOfficialImageIds()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return nil, err
 	}
 	// 按照ID镜像去重
 	imageIds = append(imageIds, officialImageIds...)
@@ -238,16 +609,54 @@ func (s *SyncImageManager) getNeedSyncImage(
 			And("tag = ?", image.Tag).
 			And("az_id = ?", targetAzId).Get(new(model.ImageMetadata))
 		if err != nil {
-			glog.Errorf("get image metadata failed,err:%v", err)
+			glog.Errorf("get image metadata failed,err:%v", secret.RedactError(err))
 			continue
 		}
 		if !has {
+			usage := usageMap[image.ID]
+			image.UsageCount = usage.UsageCount
+			image.LastUsedTime = usage.LastUsedTime
 			result = append(result, image)
 		}
 	}
+	// 按照使用次数、最近使用时间排序，价值越高的镜像越先同步
+	sortImageByUsage(result)
 	return result, nil
 }
 
+// GetOfficialImageIds 查询已发布的官方镜像ID
+func GetOfficialImageIds() ([]int64, error) {
+	var officialImageIds []int64
+	err := dao.MySQL().Table("data_image").
+		Select("data_image.image_id").
+		Join("RIGHT", "data_image_repository",
+			"data_image_repository.image_repository_id = data_image.image_repository_id ").
+		And("data_image_repository.publish_status = ?", Published).
+		And("data_image_repository.is_official= ?", OfficialRepo).
+		And("data_image.libra_status = ?", constant.PavoStatusNormal).
+		Find(&officialImageIds)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return officialImageIds, nil
+}
+
+// markOfficialImage 标记官方镜像，用于按照官方镜像优先分发
+func markOfficialImage(imageList []DataImage) error {
+	officialImageIds, err := GetOfficialImageIds()
+	if err != nil {
+		return err
+	}
+	officialImageMap := make(map[string]struct{}, len(officialImageIds))
+	for _, id := range officialImageIds {
+		officialImageMap[strconv.FormatInt(id, 10)] = struct{}{}
+	}
+	for i := range imageList {
+		_, imageList[i].IsOfficial = officialImageMap[imageList[i].ID]
+	}
+	return nil
+}
+
 func (s *SyncImageManager) getNeedMigrationImage(offlineAzId string) (needSyncImageMetaList []DataImage, err error) {
 	if offlineAzId == "" {
 		return needSyncImageMetaList, errors.New("offline az id can not be empty")
@@ -255,7 +664,7 @@ func (s *SyncImageManager) getNeedMigrationImage(offlineAzId string) (needSyncIm
 	var imageMetas []ImageMetadata
 	err = dao.MySQL().Table("image_metadata").
 		Where("az_id = ?", offlineAzId).
-		And("sync_status = 1"). // 1:未同步回中控
+		And("sync_status = ?", config.IMConfig.Topology.Transitions.PendingSyncStatus).
 		Find(&imageMetas)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -277,58 +686,182 @@ func (s *SyncImageManager) getNeedMigrationImage(offlineAzId string) (needSyncIm
 	}
 	return imageList, nil
 }
-func (s *SyncImageManager) checkSyncResult(imageMeta DataImage, syncOutput string) {
-	if strings.Contains(syncOutput, SyncSucceedResult) {
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+func (s *SyncImageManager) checkSyncResult(imageMeta DataImage, syncOutput string) (succeed bool) {
+	// 过滤平台后 image-syncer 推送的 digest 与源镜像不同
+	var digest string
+	if len(config.IMConfig.Target(s.targetRegistryAddr).Platforms) == 0 {
+		digest = imageMeta.SourceDigest
+	}
+	return s.verifyAndRecord(imageMeta, strings.Contains(syncOutput, SyncSucceedResult), digest)
+}
+
+// verifyAndRecord copied 为 true 时查看目标镜像仓库确认镜像同步成功，记录同步结果，成功时调用 succeedHook，
+// digest 为推送到目标镜像仓库的 manifest digest，不为空时目标 tag 必须指向该 digest
+func (s *SyncImageManager) verifyAndRecord(imageMeta DataImage, copied bool, digest string) (succeed bool) {
+	if copied {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
 		defer cancel()
-		projectName, repoName := splitImageNameToProjAndRepo(imageMeta.Name)
-		// 查看目标镜像仓库，确定镜像是否迁移成功
-		imageSize, err := s.targetRegistryServer.GetImageDetail(ctx, projectName, repoName, imageMeta.Tag)
+		expected, err := s.expectedPlatforms(ctx, imageMeta)
 		if err != nil {
-			glog.Warnf("get image detail failed:%+v", err, logMeta(imageMeta))
-			imageMeta.Status = SyncFailed
+			glog.Warn("get expected platforms failed", logError(secret.RedactError(err)), logMeta(imageMeta))
 		}
-		if imageSize <= 0 {
+		imageMeta.ExpectedPlatforms = expected
+		// 查看目标镜像仓库，确定镜像是否迁移成功，并记录 digest、平台等信息
+		info, err := s.targetRegistryServer.GetImageInfo(ctx, imageMeta.Name, imageMeta.Tag)
+		if err != nil {
+			glog.Warn("get image info failed", logError(secret.RedactError(err)), logMeta(imageMeta))
+			imageMeta.Status = SyncFailed
+		} else if info.Size <= 0 {
+			imageMeta.Status = SyncFailed
+		} else if digest != "" && info.Digest != digest {
+			glog.Warn("target tag points to unexpected digest", glog.String("digest", info.Digest),
+				glog.String("expect", digest), logMeta(imageMeta))
+			imageMeta.Digest = info.Digest
+			imageMeta.Status = SyncFailed
+		} else if err = checkPlatforms(expected, info.Platforms); err != nil {
+			glog.Warn("image platforms mismatch", logError(err), logMeta(imageMeta))
+			imageMeta.Platforms = info.Platforms
 			imageMeta.Status = SyncFailed
 		} else {
 			s.lock.Lock()
-			SyncSize += imageSize
+			SyncSize += info.Size
 			s.lock.Unlock()
-			imageMeta.Size = strconv.FormatInt(imageSize, 10)
+			imageMeta.Size = strconv.FormatInt(info.Size, 10)
+			imageMeta.Digest = info.Digest
+			imageMeta.MediaType = info.MediaType
+			imageMeta.Platforms = info.Platforms
+			imageMeta.Labels = info.Labels
+			if !info.Created.IsZero() {
+				imageMeta.Created = &info.Created
+			}
 			imageMeta.Status = SyncSucceed
 		}
 	} else {
 		imageMeta.Status = SyncFailed
 	}
+	imageMeta.CreateTime = time.Now()
+	imageMeta.RunId = config.IMConfig.RunId
 	s.recordImageSyncResult(imageMeta)
-	return
+	if imageMeta.Status != SyncSucceed {
+		return false
+	}
+	s.lock.Lock()
+	s.succeedImages = append(s.succeedImages, imageMeta)
+	s.lock.Unlock()
+	if s.succeedHook != nil {
+		s.succeedHook(imageMeta)
+	}
+	return true
 }
 
-func (s *SyncImageManager) decrNeedSyncCount() {
+// expectedPlatforms 目标镜像仓库配置了 platforms 并且源镜像是多平台镜像时，返回应该同步的平台，
+// 否则返回空，不检查平台
+func (s *SyncImageManager) expectedPlatforms(ctx context.Context, imageMeta DataImage) ([]string, error) {
+	platforms := config.IMConfig.Target(s.targetRegistryAddr).Platforms
+	if len(platforms) == 0 || s.sourceRegistryServer == nil {
+		return nil, nil
+	}
+	body, mediaType, _, err := s.sourceRegistryServer.GetManifest(ctx, imageMeta.Name, sourceReference(imageMeta))
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(registryserver.Manifest)
+	if err = json.Unmarshal(body, manifest); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if mediaType == "" {
+		mediaType = manifest.MediaType
+	}
+	if !registryserver.IsIndexMediaType(mediaType) {
+		return nil, nil
+	}
+	var expected []string
+	for _, child := range registryserver.FilterManifests(manifest.Manifests, platforms) {
+		expected = append(expected, child.Platform.String())
+	}
+	return expected, nil
+}
+
+// checkPlatforms 目标镜像仓库中的平台必须与 expected 一致，expected 为空时不检查
+func checkPlatforms(expected, actual []string) error {
+	if len(expected) == 0 {
+		return nil
+	}
+	var missing, unexpected []string
+	for _, platform := range expected {
+		if !registryserver.MatchPlatform(platform, actual) {
+			missing = append(missing, platform)
+		}
+	}
+	for _, platform := range actual {
+		if !registryserver.MatchPlatform(platform, expected) {
+			unexpected = append(unexpected, platform)
+		}
+	}
+	if len(missing) > 0 || len(unexpected) > 0 {
+		return errors.Errorf("expect platforms %v,missing %v,unexpected %v", expected, missing, unexpected)
+	}
+	return nil
+}
+
+// watchTransferWindow 定期检查传输时间窗口，窗口关闭时暂停分发新的镜像
+func (s *SyncImageManager) watchTransferWindow() {
+	open := true
+	for {
+		current := s.bandwidth.Apply(time.Now())
+		if current != open {
+			if current {
+				glog.Info("transfer window opened,resume dispatch")
+			} else {
+				glog.Info("transfer window closed,pause dispatch")
+			}
+			open = current
+		}
+		s.scheduler.SetPaused(!open)
+		time.Sleep(time.Second * 30)
+	}
+}
+
+// decrNeedSyncCount 减少待同步的镜像个数并返回剩余个数，只有减到 0 的调用方通知退出，exitChan 最多写入一次
+func (s *SyncImageManager) decrNeedSyncCount() int {
 	s.lock.Lock()
 	s.currentNeedSyncCount--
+	remaining := s.currentNeedSyncCount
 	s.lock.Unlock()
-	if s.currentNeedSyncCount == 0 {
+	if remaining == 0 {
 		s.exitChan <- struct{}{}
 	}
+	return remaining
 }
 
-func (s *SyncImageManager) genImageYaml(imageName, imageTag, bathPath string) error {
+// genImageYaml 解析过源镜像 digest 时按照 name@digest 同步到目标镜像仓库的 name:tag
+func (s *SyncImageManager) genImageYaml(imageMeta DataImage, bathPath string) error {
 	imageConf := make(map[string]string)
-	imageConf[path.Join(s.sourceRegistryAddr, imageName+":"+imageTag)] = path.Join(s.targetRegistryAddr, imageName)
+	if imageMeta.SourceDigest != "" {
+		imageConf[path.Join(s.sourceRegistryAddr, imageMeta.Name+"@"+imageMeta.SourceDigest)] = path.Join(s.targetRegistryAddr, imageMeta.Name+":"+imageMeta.Tag)
+	} else {
+		imageConf[path.Join(s.sourceRegistryAddr, imageMeta.Name+":"+imageMeta.Tag)] = path.Join(s.targetRegistryAddr, imageMeta.Name)
+	}
 	data, err := yaml.Marshal(imageConf)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	err = os.WriteFile(imageYamlPath(imageName, imageTag, bathPath), data, 0777)
+	err = os.WriteFile(imageYamlPath(imageMeta.Name, imageMeta.Tag, bathPath), data, 0777)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	return nil
 }
 
-func (s *SyncImageManager) recordImageSyncResult(imageMeta DataImage) {
+// recordSkipped 记录 tagConflict 为 skip 时跳过的镜像
+func (s *SyncImageManager) recordSkipped(imageMeta DataImage) {
+	imageMeta.Status = SyncSkipped
 	imageMeta.CreateTime = time.Now()
+	imageMeta.RunId = config.IMConfig.RunId
+	s.recordImageSyncResult(imageMeta)
+}
+
+func (s *SyncImageManager) recordImageSyncResult(imageMeta DataImage) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	data, err := json.Marshal(&imageMeta)
@@ -344,6 +877,14 @@ func (s *SyncImageManager) recordImageSyncResult(imageMeta DataImage) {
 			glog.Warnw("open file failed", logError(err), logMeta(imageMeta))
 			return
 		}
+	} else if imageMeta.Status == SyncSkipped {
+		syncSkippedCount++
+		glog.Warn("image sync skipped", logMeta(imageMeta))
+		file, err = os.OpenFile(path.Join(config.IMConfig.OutputPath, SyncSkippedFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			glog.Warnw("open file failed", logError(err), logMeta(imageMeta))
+			return
+		}
 	} else {
 		syncFailedCount++
 		glog.Errorw("image sync failed", logMeta(imageMeta))
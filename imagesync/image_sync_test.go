@@ -0,0 +1,79 @@
+package imagesync
+
+import (
+	"image-sync/config"
+	"image-sync/transfer"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTransferSizeUnmarkDispatched(t *testing.T) {
+	s := &SyncImageManager{plan: &transfer.Plan{
+		Blobs:      map[string]int64{"sha256:shared": 100, "sha256:a": 10, "sha256:b": 20},
+		ImageBlobs: map[string][]string{"p/a:v1": {"sha256:shared", "sha256:a"}, "p/b:v1": {"sha256:shared", "sha256:b"}},
+	}}
+	size, digests := s.transferSize(DataImage{Name: "p/a", Tag: "v1"})
+	if size != 110 || len(digests) != 2 {
+		t.Fatalf("transferSize(p/a) = %d,%v, want 110 with 2 blobs", size, digests)
+	}
+	if size, _ := s.transferSize(DataImage{Name: "p/b", Tag: "v1"}); size != 20 {
+		t.Errorf("transferSize(p/b) after p/a = %d, want 20", size)
+	}
+	// p/a 同步失败后共用的 blob 不再视为已分发
+	s.unmarkDispatched(digests)
+	if size, _ := s.transferSize(DataImage{Name: "p/a", Tag: "v1"}); size != 110 {
+		t.Errorf("transferSize(p/a) after unmark = %d, want 110", size)
+	}
+}
+
+func TestDecrNeedSyncCountNotifiesOnce(t *testing.T) {
+	const count = 100
+	s := &SyncImageManager{currentNeedSyncCount: count, exitChan: make(chan struct{}, 1)}
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.decrNeedSyncCount()
+		}()
+	}
+	// 多次写入 exitChan 时第二次写入会一直阻塞
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("decrNeedSyncCount() blocked")
+	}
+	if len(s.exitChan) != 1 {
+		t.Errorf("exitChan has %d notifications, want 1", len(s.exitChan))
+	}
+}
+
+func TestRecordSkipped(t *testing.T) {
+	config.IMConfig = &config.GlobalConfig{OutputPath: t.TempDir(), RunId: "r1"}
+	before := syncSkippedCount
+	s := &SyncImageManager{}
+	s.recordSkipped(DataImage{ID: "p/a:v1", Name: "p/a", Tag: "v1"})
+	if syncSkippedCount != before+1 {
+		t.Errorf("syncSkippedCount = %d, want %d", syncSkippedCount, before+1)
+	}
+	skipped := GetSyncSucceedImageList(filepath.Join(config.IMConfig.OutputPath, SyncSkippedFile))
+	if len(skipped) != 1 || skipped[0].Status != SyncSkipped || skipped[0].RunId != "r1" {
+		t.Fatalf("%s = %+v, want p/a:v1 skipped by r1", SyncSkippedFile, skipped)
+	}
+	if _, ok := GetSyncSucceedImageMap(filepath.Join(config.IMConfig.OutputPath, SyncSkippedFile))["p/a:v1"]; !ok {
+		t.Error("skipped image should be excluded from selection")
+	}
+	for _, name := range []string{"sync-succeed", "sync-failed"} {
+		if _, err := os.Stat(filepath.Join(config.IMConfig.OutputPath, name)); !os.IsNotExist(err) {
+			t.Errorf("skipped image should not be written to %s, stat err = %v", name, err)
+		}
+	}
+}
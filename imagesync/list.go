@@ -0,0 +1,191 @@
+package imagesync
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/dao"
+	"image-sync/secret"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StdinListFile 表示从标准输入读取镜像列表
+const StdinListFile = "-"
+
+type listEntry struct {
+	ImageName string `json:"image_name"`
+	ImageTag  string `json:"image_tag"`
+	Name      string `json:"name"`
+	Tag       string `json:"tag"`
+	Image     string `json:"image"`
+}
+
+// getNeedListImage 读取明确指定的镜像列表，支持 name:tag、完整镜像地址、CSV 以及 JSONL 格式
+func (s *SyncImageManager) getNeedListImage(listFile string) (needSyncImageMetaList []DataImage, err error) {
+	var reader io.Reader
+	if listFile == "" || listFile == StdinListFile {
+		reader = os.Stdin
+	} else {
+		file, err := os.Open(listFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		defer file.Close()
+		reader = file
+	}
+	metas, err := parseImageList(reader, s.sourceRegistryAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	imageList := make([]DataImage, 0, len(metas))
+	for _, meta := range metas {
+		image, err := s.resolveListImage(meta)
+		if err != nil {
+			glog.Warnf("resolve image %s:%s failed,err:%v", meta.Name, meta.Tag, secret.RedactError(err))
+			continue
+		}
+		imageList = append(imageList, image)
+	}
+	return imageList, nil
+}
+
+// resolveListImage 优先使用 data_image 中的镜像信息，不存在时退化为源镜像仓库中的信息
+func (s *SyncImageManager) resolveListImage(meta ImageMetadata) (DataImage, error) {
+	dataImage := new(DataImage)
+	has, err := dao.MySQL().Table("data_image").Select("image_id,image_name,image_tag,image_size").
+		Where("image_name = ?", meta.Name).And("image_tag = ?", meta.Tag).Get(dataImage)
+	if err != nil {
+		return *dataImage, errors.WithStack(err)
+	}
+	if has {
+		return *dataImage, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	projectName, repoName := splitImageNameToProjAndRepo(meta.Name)
+	imageSize, err := s.sourceRegistryServer.GetImageDetail(ctx, projectName, repoName, meta.Tag)
+	if err != nil {
+		return *dataImage, err
+	}
+	glog.Infof("image %s:%s not exist in data_image,use source registry info", meta.Name, meta.Tag)
+	return DataImage{
+		ID:   meta.Name + ":" + meta.Tag,
+		Name: meta.Name,
+		Tag:  meta.Tag,
+		Size: strconv.FormatInt(imageSize, 10),
+	}, nil
+}
+
+func parseImageList(reader io.Reader, registryAddr string) ([]ImageMetadata, error) {
+	var result []ImageMetadata
+	seen := make(map[string]struct{})
+	scanner := bufio.NewScanner(reader)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		meta, ok, err := parseImageListLine(line, registryAddr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse image list line %d", lineNum)
+		}
+		if !ok {
+			continue
+		}
+		if _, has := seen[meta.Name+":"+meta.Tag]; has {
+			continue
+		}
+		seen[meta.Name+":"+meta.Tag] = struct{}{}
+		result = append(result, meta)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+// parseImageListLine 解析单行内容，ok 为 false 表示该行是 CSV 表头等需要跳过的内容
+func parseImageListLine(line string, registryAddr string) (meta ImageMetadata, ok bool, err error) {
+	// JSONL
+	if strings.HasPrefix(line, "{") {
+		var entry listEntry
+		if err = json.Unmarshal([]byte(line), &entry); err != nil {
+			return meta, false, errors.WithStack(err)
+		}
+		switch {
+		case entry.Image != "":
+			if meta, err = parseImageReference(entry.Image, registryAddr); err != nil {
+				return meta, false, err
+			}
+		case entry.ImageName != "":
+			meta = ImageMetadata{Name: entry.ImageName, Tag: entry.ImageTag}
+		default:
+			meta = ImageMetadata{Name: entry.Name, Tag: entry.Tag}
+		}
+		if meta.Name == "" {
+			return meta, false, errors.New("image name can not be empty")
+		}
+		if meta.Tag == "" {
+			meta.Tag = "latest"
+		}
+		return meta, true, nil
+	}
+
+	// CSV: name,tag 或 reference
+	if strings.Contains(line, ",") {
+		records, err := csv.NewReader(strings.NewReader(line)).Read()
+		if err != nil {
+			return meta, false, errors.WithStack(err)
+		}
+		for i := range records {
+			records[i] = strings.TrimSpace(records[i])
+		}
+		switch strings.ToLower(records[0]) {
+		case "name", "image_name", "image":
+			return meta, false, nil
+		}
+		if len(records) >= 2 && records[1] != "" {
+			if meta, err = parseImageReference(records[0], registryAddr); err != nil {
+				return meta, false, err
+			}
+			meta.Tag = records[1]
+			return meta, true, nil
+		}
+		line = records[0]
+	}
+	meta, err = parseImageReference(line, registryAddr)
+	return meta, err == nil, err
+}
+
+// parseImageReference 解析 name:tag 或 registry/name:tag 形式的镜像地址，
+// 目标镜像仓库需要 tag，不支持 name@sha256:... 形式的 digest 引用
+func parseImageReference(reference string, registryAddr string) (ImageMetadata, error) {
+	if strings.Contains(reference, "@") {
+		return ImageMetadata{}, errors.Errorf("digest reference %s is not supported,use name:tag", reference)
+	}
+	name := reference
+	if parts := strings.SplitN(reference, "/", 2); len(parts) == 2 &&
+		(strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		if parts[0] != registryAddr {
+			glog.Warnf("image %s is not from source registry %s", reference, registryAddr)
+		}
+		name = parts[1]
+	}
+	tag := "latest"
+	if index := strings.LastIndex(name, ":"); index > strings.LastIndex(name, "/") {
+		tag = name[index+1:]
+		name = name[:index]
+	}
+	return ImageMetadata{Name: name, Tag: tag}, nil
+}
@@ -0,0 +1,66 @@
+package imagesync
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		reference string
+		want      ImageMetadata
+		wantErr   bool
+	}{
+		{reference: "proj/repo:v1", want: ImageMetadata{Name: "proj/repo", Tag: "v1"}},
+		{reference: "proj/repo", want: ImageMetadata{Name: "proj/repo", Tag: "latest"}},
+		{reference: "10.0.0.1:5000/proj/repo:v1", want: ImageMetadata{Name: "proj/repo", Tag: "v1"}},
+		{reference: "10.0.0.1:5000/proj/repo", want: ImageMetadata{Name: "proj/repo", Tag: "latest"}},
+		{reference: "localhost/proj/repo:v2", want: ImageMetadata{Name: "proj/repo", Tag: "v2"}},
+		{reference: "proj/sub/repo:1.0", want: ImageMetadata{Name: "proj/sub/repo", Tag: "1.0"}},
+		{reference: "proj/repo@sha256:0123456789abcdef", wantErr: true},
+		{reference: "proj/repo:v1@sha256:0123456789abcdef", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseImageReference(tt.reference, "10.0.0.1:5000")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseImageReference(%q) err = %v, wantErr %v", tt.reference, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("parseImageReference(%q) = %+v, want %+v", tt.reference, got, tt.want)
+		}
+	}
+}
+
+func TestParseImageList(t *testing.T) {
+	input := `# comment
+name,tag
+proj/a,v1
+proj/b:v2
+{"image":"10.0.0.1:5000/proj/c:v3"}
+{"image_name":"proj/d"}
+proj/a:v1
+`
+	got, err := parseImageList(strings.NewReader(input), "10.0.0.1:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ImageMetadata{
+		{Name: "proj/a", Tag: "v1"},
+		{Name: "proj/b", Tag: "v2"},
+		{Name: "proj/c", Tag: "v3"},
+		{Name: "proj/d", Tag: "latest"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parseImageList() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("parseImageList()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if _, err = parseImageList(strings.NewReader("proj/a@sha256:abc\n"), ""); err == nil {
+		t.Error("parseImageList() with digest reference should fail")
+	}
+}
@@ -0,0 +1,423 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/config"
+	"image-sync/ocilayout"
+	"image-sync/registryserver"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentsFile 导出目录中记录镜像、blob 以及校验和的清单
+const ContentsFile = "contents.json"
+
+// ExportContents 导出内容清单，导入时按照清单推送镜像并校验 blob
+type ExportContents struct {
+	RunId          string          `json:"run_id"`
+	SourceRegistry string          `json:"source_registry"`
+	CreateTime     time.Time       `json:"create_time"`
+	Images         []ExportedImage `json:"images"`
+	Blobs          []ExportedBlob  `json:"blobs"`
+}
+
+// ExportedImage 导出的镜像以及它引用的所有 blob（包括多平台镜像中每个平台的 manifest）
+type ExportedImage struct {
+	DataImage
+	Blobs []string `json:"blobs"`
+}
+
+// ExportedBlob blob 的 sha256 校验和、大小以及在目录中的路径
+type ExportedBlob struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	Path   string `json:"path"`
+}
+
+// exportDir 导出目录，相同的运行ID重复执行时继续使用已导出的 blob
+func exportDir() string {
+	return path.Join(config.IMConfig.OutputPath, "export-"+config.IMConfig.RunId)
+}
+
+// Export 把镜像从源镜像仓库导出为 OCI image-layout 目录，多个镜像共用的 blob 只保存一次，
+// exportFormat 为 tar 时打包为 tar 文件，返回导出的目录或 tar 文件
+func (s *SyncImageManager) Export(imageList []DataImage) (string, error) {
+	dir := exportDir()
+	layout, err := ocilayout.Create(dir)
+	if err != nil {
+		return "", err
+	}
+	contents := ExportContents{
+		RunId:          config.IMConfig.RunId,
+		SourceRegistry: s.sourceRegistryAddr,
+		CreateTime:     time.Now(),
+	}
+	s.forEachImage(imageList, func(imageMeta DataImage) {
+		glog.Info("start export image", logMeta(imageMeta))
+		exported, err := s.exportImage(layout, imageMeta)
+		if err != nil {
+			glog.Warn("export image failed", logError(err), logMeta(imageMeta))
+			imageMeta.Status = SyncFailed
+			imageMeta.CreateTime = time.Now()
+			imageMeta.RunId = config.IMConfig.RunId
+			s.recordImageSyncResult(imageMeta)
+			return
+		}
+		glog.Info("export image succeed", logMeta(imageMeta), glog.String("digest", exported.Digest))
+		s.lock.Lock()
+		contents.Images = append(contents.Images, exported)
+		s.lock.Unlock()
+	})
+
+	sort.Slice(contents.Images, func(i, j int) bool {
+		return contents.Images[i].Name+":"+contents.Images[i].Tag < contents.Images[j].Name+":"+contents.Images[j].Tag
+	})
+	blobSet := make(map[string]struct{})
+	for _, image := range contents.Images {
+		for _, digest := range image.Blobs {
+			if _, ok := blobSet[digest]; ok {
+				continue
+			}
+			blobSet[digest] = struct{}{}
+			blobPath, _ := layout.BlobPath(digest)
+			info, err := os.Stat(blobPath)
+			if err != nil {
+				return "", errors.WithStack(err)
+			}
+			relPath, _ := filepath.Rel(dir, blobPath)
+			contents.Blobs = append(contents.Blobs, ExportedBlob{Digest: digest, Size: info.Size(), Path: filepath.ToSlash(relPath)})
+		}
+	}
+	if err = layout.WriteJSON(ContentsFile, contents); err != nil {
+		return "", err
+	}
+	glog.Infof("export finished,images:%d,unique blobs:%d,dir:%s", len(contents.Images), len(contents.Blobs), dir)
+	if config.IMConfig.ExportFormat != config.ExportFormatTar {
+		return dir, nil
+	}
+	if err = ocilayout.Pack(dir, dir+".tar"); err != nil {
+		return "", err
+	}
+	return dir + ".tar", errors.WithStack(os.RemoveAll(dir))
+}
+
+func (s *SyncImageManager) exportImage(layout *ocilayout.Layout, imageMeta DataImage) (ExportedImage, error) {
+	ctx := context.Background()
+	exported := ExportedImage{DataImage: imageMeta}
+	body, mediaType, _, err := s.sourceRegistryServer.GetManifest(ctx, imageMeta.Name, sourceReference(imageMeta))
+	if err != nil {
+		return exported, err
+	}
+	manifest := new(registryserver.Manifest)
+	if err = json.Unmarshal(body, manifest); err != nil {
+		return exported, errors.WithStack(err)
+	}
+	if mediaType == "" {
+		mediaType = manifest.MediaType
+	}
+	var size int64
+	exportManifest := func(manifest *registryserver.Manifest) error {
+		blobs := manifest.Layers
+		if manifest.Config != nil {
+			blobs = append([]registryserver.Descriptor{*manifest.Config}, blobs...)
+		}
+		for _, blob := range blobs {
+			digest := blob.Digest
+			written, err := layout.WriteBlob(digest, func() (io.ReadCloser, error) {
+				load := func(offset int64) (io.ReadCloser, error) {
+					return s.sourceRegistryServer.GetBlobFrom(ctx, imageMeta.Name, digest, offset)
+				}
+				if s.cache == nil {
+					return load(0)
+				}
+				return s.cache.Fetch(digest, blob.Size, 0, load)
+			})
+			if err != nil {
+				return errors.Wrapf(err, "export blob %s", digest)
+			}
+			if written {
+				s.lock.Lock()
+				SyncSize += blob.Size
+				s.lock.Unlock()
+			}
+			exported.Blobs = append(exported.Blobs, digest)
+		}
+		for _, layer := range manifest.Layers {
+			size += layer.Size
+		}
+		return nil
+	}
+	if registryserver.IsIndexMediaType(mediaType) {
+		for _, child := range manifest.Manifests {
+			childBody, _, _, err := s.sourceRegistryServer.GetManifest(ctx, imageMeta.Name, child.Digest)
+			if err != nil {
+				return exported, err
+			}
+			childManifest := new(registryserver.Manifest)
+			if err = json.Unmarshal(childBody, childManifest); err != nil {
+				return exported, errors.WithStack(err)
+			}
+			if err = exportManifest(childManifest); err != nil {
+				return exported, err
+			}
+			childDigest, err := layout.WriteBlobBytes(childBody)
+			if err != nil {
+				return exported, err
+			}
+			exported.Blobs = append(exported.Blobs, childDigest)
+		}
+	} else if err = exportManifest(manifest); err != nil {
+		return exported, err
+	}
+	digest, err := layout.WriteBlobBytes(body)
+	if err != nil {
+		return exported, err
+	}
+	exported.Blobs = append(exported.Blobs, digest)
+	err = layout.AddManifest(registryserver.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest,
+		Size:      int64(len(body)),
+		Annotations: map[string]string{
+			ocilayout.AnnotationRefName:   imageMeta.Tag,
+			ocilayout.AnnotationImageName: imageMeta.Name + ":" + imageMeta.Tag,
+		},
+	})
+	if err != nil {
+		return exported, err
+	}
+	exported.Digest = digest
+	exported.MediaType = mediaType
+	exported.Size = strconv.FormatInt(size, 10)
+	return exported, nil
+}
+
+// Import 把 export 模式导出的目录或 tar 文件中的镜像推送到目标镜像仓库，
+// 推送后与 sync 模式一样校验并记录同步结果
+func (s *SyncImageManager) Import(importPath string) error {
+	dir, err := importDir(importPath)
+	if err != nil {
+		return err
+	}
+	layout, err := ocilayout.Open(dir)
+	if err != nil {
+		return err
+	}
+	var contents ExportContents
+	if err = layout.ReadJSON(ContentsFile, &contents); err != nil {
+		return err
+	}
+	blobSizes := make(map[string]int64, len(contents.Blobs))
+	for _, blob := range contents.Blobs {
+		blobSizes[blob.Digest] = blob.Size
+	}
+
+	syncSucceedImageMap := GetSyncSucceedImageMap(path.Join(config.IMConfig.OutputPath, "sync-succeed"))
+	syncSkippedImageMap := GetSyncSucceedImageMap(path.Join(config.IMConfig.OutputPath, SyncSkippedFile))
+	var imageList []DataImage
+	exportedImages := make(map[string]ExportedImage, len(contents.Images))
+	for _, image := range contents.Images {
+		if _, ok := syncSucceedImageMap[image.ID]; ok && image.ID != "" {
+			glog.Infof("image %s already sync succeed", image.ID)
+			continue
+		}
+		if _, ok := syncSkippedImageMap[image.ID]; ok && image.ID != "" {
+			glog.Infof("image %s already skipped by tag conflict", image.ID)
+			continue
+		}
+		if image.SourceDigest == "" {
+			// 导出的 manifest 就是源镜像的 manifest
+			image.SourceDigest = image.Digest
+		}
+		exportedImages[image.Name+":"+image.Tag] = image
+		imageList = append(imageList, image.DataImage)
+	}
+	glog.Infof("start import image from %s,export run id:%s,total image:%d", dir, contents.RunId, len(imageList))
+	s.syncStartTime = time.Now()
+	if s.bandwidth.Enabled() {
+		s.bandwidth.Apply(time.Now())
+	}
+
+	s.ensureProjects(imageList)
+	verifier := &blobVerifier{layout: layout, sizes: blobSizes, verified: make(map[string]error)}
+	s.forEachImage(imageList, func(imageMeta DataImage) {
+		glog.Info("start import image", logMeta(imageMeta))
+		image := exportedImages[imageMeta.Name+":"+imageMeta.Tag]
+		proceed, err := s.checkTagConflict(context.Background(), imageMeta, layoutDigests(layout, image))
+		if err == nil && !proceed {
+			glog.Warn("target registry already has different content,skip", logMeta(imageMeta))
+			s.recordSkipped(imageMeta)
+			return
+		}
+		digest := image.Digest
+		if err == nil {
+			digest, err = s.importImage(layout, verifier, image)
+		}
+		if err != nil {
+			glog.Warn("import image failed", logError(err), logMeta(imageMeta))
+		}
+		s.verifyAndRecord(imageMeta, err == nil, digest)
+	})
+	glog.Infof("import finished,synced image size:%v GB,failed:%d,skipped:%d", SyncSize>>30, syncFailedCount, syncSkippedCount)
+	return nil
+}
+
+// importDir tar 文件解压到 OutputPath 下，已经解压过时直接使用
+func importDir(importPath string) (string, error) {
+	info, err := os.Stat(importPath)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	if info.IsDir() {
+		return importPath, nil
+	}
+	dir := path.Join(config.IMConfig.OutputPath, "import-"+strings.TrimSuffix(filepath.Base(importPath), ".tar"))
+	if _, err = os.Stat(path.Join(dir, ContentsFile)); err == nil {
+		return dir, nil
+	}
+	glog.Infof("unpack %s to %s", importPath, dir)
+	return dir, ocilayout.Unpack(importPath, dir)
+}
+
+// importImage 推送导出目录中的镜像，返回推送到 tag 的 manifest digest。多平台镜像与 sync 模式一样只推送目标镜像仓库
+// platforms 中的平台，只匹配部分平台时按照 filterIndex 推送过滤后的 index 或者唯一匹配平台的 manifest
+func (s *SyncImageManager) importImage(layout *ocilayout.Layout, verifier *blobVerifier, image ExportedImage) (string, error) {
+	ctx := context.Background()
+	readManifest := func(digest string) ([]byte, *registryserver.Manifest, error) {
+		if err := verifier.verify(digest); err != nil {
+			return nil, nil, err
+		}
+		body, err := layout.ReadBlob(digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		manifest := new(registryserver.Manifest)
+		if err = json.Unmarshal(body, manifest); err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		return body, manifest, nil
+	}
+	// importManifest 推送单平台 manifest 引用的 blob 以及 manifest 本身
+	importManifest := func(digest, reference, mediaType string) (string, error) {
+		body, manifest, err := readManifest(digest)
+		if err != nil {
+			return "", err
+		}
+		blobs := manifest.Layers
+		if manifest.Config != nil {
+			blobs = append([]registryserver.Descriptor{*manifest.Config}, blobs...)
+		}
+		for _, blob := range blobs {
+			if err = verifier.verify(blob.Digest); err != nil {
+				return "", err
+			}
+			if err = s.importBlob(ctx, layout, image.Name, blob); err != nil {
+				return "", errors.Wrapf(err, "import blob %s", blob.Digest)
+			}
+		}
+		return s.targetRegistryServer.PutManifest(ctx, image.Name, reference, mediaType, body)
+	}
+	if !registryserver.IsIndexMediaType(image.MediaType) {
+		return importManifest(image.Digest, image.Tag, image.MediaType)
+	}
+
+	body, manifest, err := readManifest(image.Digest)
+	if err != nil {
+		return "", err
+	}
+	target := config.IMConfig.Target(s.targetRegistryAddr)
+	children := registryserver.FilterManifests(manifest.Manifests, target.Platforms)
+	if len(children) == 0 {
+		return "", errors.Errorf("image %s:%s has no platform in %v", image.Name, image.Tag, target.Platforms)
+	}
+	if len(children) < len(manifest.Manifests) {
+		if len(children) == 1 && !target.FilterIndex {
+			return importManifest(children[0].Digest, image.Tag, children[0].MediaType)
+		}
+		if body, err = registryserver.RewriteIndex(body, children); err != nil {
+			return "", err
+		}
+	}
+	for _, child := range children {
+		if _, err = importManifest(child.Digest, child.Digest, child.MediaType); err != nil {
+			return "", err
+		}
+	}
+	return s.targetRegistryServer.PutManifest(ctx, image.Name, image.Tag, image.MediaType, body)
+}
+
+// importBlob 分块上传 blob，中断后重新执行 import 时从镜像仓库已确认的位置继续
+func (s *SyncImageManager) importBlob(ctx context.Context, layout *ocilayout.Layout, imageName string, blob registryserver.Descriptor) error {
+	return s.copier.UploadBlob(ctx, imageName, blob, func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		file, err := layout.OpenBlob(blob.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return nil, errors.WithStack(err)
+		}
+		return file, nil
+	})
+}
+
+// forEachImage 按照 proc 并发处理镜像
+func (s *SyncImageManager) forEachImage(imageList []DataImage, handle func(imageMeta DataImage)) {
+	proc := config.IMConfig.Proc
+	if proc <= 0 {
+		proc = 1
+	}
+	imageChan := make(chan DataImage)
+	var wg sync.WaitGroup
+	for i := 0; i < proc; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for imageMeta := range imageChan {
+				handle(imageMeta)
+			}
+		}()
+	}
+	for _, imageMeta := range imageList {
+		imageChan <- imageMeta
+	}
+	close(imageChan)
+	wg.Wait()
+}
+
+// blobVerifier 导入前按照清单中的大小与 sha256 校验 blob，多个镜像共用的 blob 只校验一次
+type blobVerifier struct {
+	layout   *ocilayout.Layout
+	sizes    map[string]int64
+	lock     sync.Mutex
+	verified map[string]error
+}
+
+func (v *blobVerifier) verify(digest string) error {
+	v.lock.Lock()
+	err, ok := v.verified[digest]
+	v.lock.Unlock()
+	if ok {
+		return err
+	}
+	size, ok := v.sizes[digest]
+	if !ok {
+		err = errors.Errorf("blob %s is not in %s", digest, ContentsFile)
+	} else {
+		err = v.layout.VerifyBlob(digest, size)
+	}
+	v.lock.Lock()
+	v.verified[digest] = err
+	v.lock.Unlock()
+	return err
+}
@@ -0,0 +1,145 @@
+package imagesync
+
+import (
+	"encoding/json"
+	"image-sync/config"
+	"image-sync/ocilayout"
+	"image-sync/registryserver"
+	"image-sync/transfer"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newManifestRegistry 所有 blob 都已存在的目标镜像仓库，记录推送的 manifest，key 为 reference
+func newManifestRegistry(t *testing.T) (*registryserver.Server, string, map[string][]byte) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	var lock sync.Mutex
+	pushed := make(map[string][]byte)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+		case strings.Contains(r.URL.Path, "/blobs/") && r.Method == http.MethodHead:
+		case strings.Contains(r.URL.Path, "/manifests/") && r.Method == http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			lock.Lock()
+			pushed[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]] = body
+			lock.Unlock()
+			w.WriteHeader(http.StatusCreated)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	addr := strings.TrimPrefix(server.URL, "https://")
+	return registryserver.Init(addr, filepath.Join(t.TempDir(), "auth.yaml")), addr, pushed
+}
+
+// writeTestIndex 在导出目录中写入包含 linux/amd64、linux/arm64 两个平台的 index
+func writeTestIndex(t *testing.T) (*ocilayout.Layout, *blobVerifier, ExportedImage, map[string]string) {
+	layout, err := ocilayout.Create(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := &blobVerifier{layout: layout, sizes: make(map[string]int64), verified: make(map[string]error)}
+	writeBlob := func(data []byte) registryserver.Descriptor {
+		digest, err := layout.WriteBlobBytes(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		verifier.sizes[digest] = int64(len(data))
+		return registryserver.Descriptor{Digest: digest, Size: int64(len(data))}
+	}
+	index := registryserver.Manifest{SchemaVersion: 2, MediaType: registryserver.MediaTypeOCIIndex}
+	children := make(map[string]string)
+	for _, arch := range []string{"amd64", "arm64"} {
+		configBlob := writeBlob([]byte(`{"architecture":"` + arch + `"}`))
+		layer := writeBlob([]byte("layer " + arch))
+		body, _ := json.Marshal(registryserver.Manifest{SchemaVersion: 2, MediaType: registryserver.MediaTypeOCIManifest,
+			Config: &configBlob, Layers: []registryserver.Descriptor{layer}})
+		child := writeBlob(body)
+		child.MediaType = registryserver.MediaTypeOCIManifest
+		child.Platform = &registryserver.Platform{OS: "linux", Architecture: arch}
+		index.Manifests = append(index.Manifests, child)
+		children[arch] = child.Digest
+	}
+	body, _ := json.Marshal(index)
+	image := ExportedImage{DataImage: DataImage{Name: "p/a", Tag: "v1", MediaType: registryserver.MediaTypeOCIIndex}}
+	image.Digest = writeBlob(body).Digest
+	return layout, verifier, image, children
+}
+
+func TestImportImagePlatforms(t *testing.T) {
+	tests := []struct {
+		name        string
+		platforms   []string
+		filterIndex bool
+		wantErr     bool
+		wantTag     string //tag 指向的平台，index 表示过滤后或者原样的 index
+		wantArchs   []string
+	}{
+		{name: "all platforms", wantTag: "index", wantArchs: []string{"amd64", "arm64"}},
+		{name: "single platform", platforms: []string{"linux/amd64"}, wantTag: "amd64", wantArchs: []string{"amd64"}},
+		{name: "filter index", platforms: []string{"linux/arm64"}, filterIndex: true, wantTag: "index", wantArchs: []string{"arm64"}},
+		{name: "no platform matched", platforms: []string{"linux/s390x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, addr, pushed := newManifestRegistry(t)
+			config.IMConfig = &config.GlobalConfig{Targets: []config.TargetConfig{
+				{Addr: addr, Platforms: tt.platforms, FilterIndex: tt.filterIndex},
+			}}
+			s := &SyncImageManager{targetRegistryAddr: addr, targetRegistryServer: target,
+				copier: transfer.NewCopier(nil, target, addr, nil, 0, nil)}
+			layout, verifier, image, children := writeTestIndex(t)
+
+			digest, err := s.importImage(layout, verifier, image)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("importImage() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(pushed) != 0 {
+					t.Errorf("pushed %d manifests, want none", len(pushed))
+				}
+				return
+			}
+			body, ok := pushed[image.Tag]
+			if !ok {
+				t.Fatal("tag is not pushed")
+			}
+			if digest != registryserver.Digest(body) {
+				t.Errorf("importImage() digest = %s, want digest of pushed tag %s", digest, registryserver.Digest(body))
+			}
+			if tt.wantTag != "index" {
+				if digest != children[tt.wantTag] {
+					t.Errorf("tag points to %s, want %s manifest %s", digest, tt.wantTag, children[tt.wantTag])
+				}
+				return
+			}
+			manifest := new(registryserver.Manifest)
+			if err = json.Unmarshal(body, manifest); err != nil {
+				t.Fatal(err)
+			}
+			var archs []string
+			for _, child := range manifest.Manifests {
+				archs = append(archs, child.Platform.Architecture)
+				if _, ok := pushed[child.Digest]; !ok {
+					t.Errorf("child manifest %s is not pushed", child.Digest)
+				}
+			}
+			if strings.Join(archs, ",") != strings.Join(tt.wantArchs, ",") {
+				t.Errorf("index platforms = %v, want %v", archs, tt.wantArchs)
+			}
+			if len(pushed) != len(tt.wantArchs)+1 {
+				t.Errorf("pushed %d manifests, want %d", len(pushed), len(tt.wantArchs)+1)
+			}
+			if len(tt.platforms) == 0 && digest != image.Digest {
+				t.Errorf("unfiltered index digest = %s, want %s", digest, image.Digest)
+			}
+		})
+	}
+}
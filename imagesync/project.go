@@ -0,0 +1,175 @@
+package imagesync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/config"
+	"image-sync/registryserver"
+	"image-sync/secret"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// projectTemplate 创建目标项目使用的设置，retention 为空时不创建保留策略
+type projectTemplate struct {
+	req       registryserver.ProjectReq
+	retention *registryserver.RetentionPolicy
+	from      string //source:复制源项目 defaults:使用 projectDefaults
+}
+
+// ensureProjects 目标镜像仓库配置了 createProjects 时，在分发前创建镜像所属的目标项目（镜像名的第一段），
+// 创建项目或者保留策略失败时输出错误日志，推送该项目的镜像会失败并记录在 sync-failed 中
+func (s *SyncImageManager) ensureProjects(imageList []DataImage) {
+	target := config.IMConfig.Target(s.targetRegistryAddr)
+	if !target.CreateProjects {
+		return
+	}
+	targetHarbor := registryserver.NewHarborClient(target.HarborApi, s.targetRegistryAddr, s.authPath)
+	// import 模式无法访问源镜像仓库
+	var sourceHarbor *registryserver.HarborClient
+	if config.IMConfig.SourceHarborApi != "" && s.sourceRegistryServer != nil {
+		sourceHarbor = registryserver.NewHarborClient(config.IMConfig.SourceHarborApi, s.sourceRegistryAddr, s.authPath)
+	}
+
+	seen := make(map[string]struct{})
+	var projects []string
+	for _, imageMeta := range imageList {
+		project, _ := splitImageNameToProjAndRepo(imageMeta.Name)
+		if _, ok := seen[project]; !ok {
+			seen[project] = struct{}{}
+			projects = append(projects, project)
+		}
+	}
+	sort.Strings(projects)
+	for _, project := range projects {
+		if err := ensureProject(targetHarbor, sourceHarbor, project, target.ProjectDefaults); err != nil {
+			glog.Errorf("ensure project %s in target harbor failed,err:%v", project, secret.RedactError(err))
+		}
+	}
+}
+
+func ensureProject(targetHarbor, sourceHarbor *registryserver.HarborClient, project string, defaults config.ProjectDefaultsConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	_, err := targetHarbor.GetProject(ctx, project)
+	if err == nil {
+		return nil
+	}
+	if errors.Cause(err) != registryserver.ErrNotFound {
+		return err
+	}
+
+	template, err := sourceProjectTemplate(ctx, sourceHarbor, project)
+	if err != nil {
+		glog.Warnf("get settings of source project %s failed,use projectDefaults,err:%v", project, secret.RedactError(err))
+	}
+	if template == nil {
+		if template, err = defaultProjectTemplate(project, defaults); err != nil {
+			return err
+		}
+	}
+	err = targetHarbor.CreateProject(ctx, template.req)
+	if errors.Cause(err) == registryserver.ErrAlreadyExists {
+		// 其他进程同时创建了该项目，保留它的设置
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var storageLimit int64 = -1
+	if template.req.StorageLimit != nil {
+		storageLimit = *template.req.StorageLimit
+	}
+	glog.Info("create project in target harbor", glog.String("project", project), glog.String("from", template.from),
+		glog.String("public", template.req.Metadata[registryserver.ProjectMetadataPublic]),
+		glog.String("storageLimit", strconv.FormatInt(storageLimit, 10)),
+		glog.String("retention", strconv.FormatBool(template.retention != nil)))
+	if template.retention == nil {
+		return nil
+	}
+
+	// 保留策略的作用范围是项目ID，创建项目后才能知道
+	created, err := targetHarbor.GetProject(ctx, project)
+	if err != nil {
+		return err
+	}
+	template.retention.Scope = registryserver.RetentionScope{Level: "project", Ref: created.ProjectId}
+	if _, err = targetHarbor.CreateRetention(ctx, *template.retention); err == nil {
+		return nil
+	}
+	// 项目存在之后不会再创建保留策略，删除刚创建的空项目，该项目的镜像推送失败，下次运行时重新创建
+	if deleteErr := targetHarbor.DeleteProject(ctx, project); deleteErr != nil {
+		return errors.Wrapf(err, "project %s created without retention,delete it failed:%v", project, deleteErr)
+	}
+	return errors.Wrapf(err, "project %s deleted,create retention failed", project)
+}
+
+// sourceProjectTemplate 复制源项目的公开属性、存储配额以及保留策略，没有配置源 Harbor 或者源项目不存在时返回空
+func sourceProjectTemplate(ctx context.Context, sourceHarbor *registryserver.HarborClient, project string) (*projectTemplate, error) {
+	if sourceHarbor == nil {
+		return nil, nil
+	}
+	source, err := sourceHarbor.GetProject(ctx, project)
+	if errors.Cause(err) == registryserver.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	template := &projectTemplate{
+		req: registryserver.ProjectReq{
+			ProjectName: project,
+			Metadata:    map[string]string{registryserver.ProjectMetadataPublic: strconv.FormatBool(source.Public())},
+		},
+		from: "source",
+	}
+	summary, err := sourceHarbor.ProjectSummary(ctx, project)
+	if err != nil {
+		return nil, err
+	}
+	// 源项目不限制存储时同样显式设置 -1，不使用目标 Harbor 的默认配额
+	hard, _ := summary.StorageLimit()
+	if hard < 0 {
+		hard = -1
+	}
+	template.req.StorageLimit = &hard
+	if id := source.RetentionId(); id > 0 {
+		if template.retention, err = sourceHarbor.GetRetention(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return template, nil
+}
+
+// defaultProjectTemplate 按照 projectDefaults 创建项目，retainLatest 大于 0 时保留每个 repository 最近推送的 n 个镜像
+func defaultProjectTemplate(project string, defaults config.ProjectDefaultsConfig) (*projectTemplate, error) {
+	template := &projectTemplate{
+		req: registryserver.ProjectReq{
+			ProjectName: project,
+			Metadata:    map[string]string{registryserver.ProjectMetadataPublic: strconv.FormatBool(defaults.Public)},
+		},
+		from: "defaults",
+	}
+	if defaults.StorageLimit != "" {
+		storageLimit, err := config.ParseByteSize(defaults.StorageLimit)
+		if err != nil {
+			return nil, err
+		}
+		template.req.StorageLimit = &storageLimit
+	}
+	if defaults.RetainLatest > 0 {
+		template.retention = &registryserver.RetentionPolicy{
+			Algorithm: "or",
+			Rules: json.RawMessage(fmt.Sprintf(`[{"action":"retain","template":"latestPushedK","params":{"latestPushedK":%d},`+
+				`"tag_selectors":[{"kind":"doublestar","decoration":"matches","pattern":"**"}],`+
+				`"scope_selectors":{"repository":[{"kind":"doublestar","decoration":"repoMatches","pattern":"**"}]}}]`,
+				defaults.RetainLatest)),
+			Trigger: json.RawMessage(`{"kind":"Schedule","settings":{"cron":""}}`),
+		}
+	}
+	return template, nil
+}
@@ -0,0 +1,118 @@
+package imagesync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"image-sync/config"
+	"image-sync/registryserver"
+	"image-sync/registryserver/standin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// recordHarbor 记录创建项目的请求，failRetention 为 true 时创建保留策略返回 500，其他请求交给替身处理
+type recordHarbor struct {
+	*standin.Server
+	failRetention bool
+	created       []registryserver.ProjectReq
+}
+
+func (h *recordHarbor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && r.URL.Path == "/api/v2.0/retentions" && h.failRetention {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Path == "/api/v2.0/projects" {
+		body, _ := io.ReadAll(r.Body)
+		var req registryserver.ProjectReq
+		json.Unmarshal(body, &req)
+		h.created = append(h.created, req)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	h.Server.ServeHTTP(w, r)
+}
+
+func newTestHarborClient(t *testing.T, handler http.Handler) (*httptest.Server, *registryserver.HarborClient) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server, registryserver.NewHarborClient(server.URL, "harbor.example.com", filepath.Join(t.TempDir(), "auth.yaml"))
+}
+
+func TestEnsureProject(t *testing.T) {
+	source, sourceHarbor := newTestHarborClient(t, standin.NewServer())
+	putProject(t, source, "unlimited", -1, 100)
+	putProject(t, source, "limited", 1000, 100)
+	ctx := context.Background()
+	sourceProject, _ := sourceHarbor.GetProject(ctx, "limited")
+	_, err := sourceHarbor.CreateRetention(ctx, registryserver.RetentionPolicy{
+		Algorithm: "or",
+		Rules:     json.RawMessage(`[{"action":"retain"}]`),
+		Trigger:   json.RawMessage(`{"kind":"Schedule"}`),
+		Scope:     registryserver.RetentionScope{Level: "project", Ref: sourceProject.ProjectId},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		project       string
+		defaults      config.ProjectDefaultsConfig
+		existing      bool
+		failRetention bool
+		wantErr       bool
+		wantCreated   bool
+		wantHard      int64
+		wantRetention bool
+	}{
+		{name: "source unlimited", project: "unlimited", defaults: config.ProjectDefaultsConfig{StorageLimit: "10B"},
+			wantCreated: true, wantHard: -1},
+		{name: "source quota and retention", project: "limited", wantCreated: true, wantHard: 1000, wantRetention: true},
+		{name: "defaults", project: "other", defaults: config.ProjectDefaultsConfig{StorageLimit: "10B", RetainLatest: 3},
+			wantCreated: true, wantHard: 10, wantRetention: true},
+		{name: "existing project unchanged", project: "other", existing: true,
+			defaults: config.ProjectDefaultsConfig{StorageLimit: "10B", RetainLatest: 3}, wantCreated: true, wantHard: 500},
+		{name: "retention failed", project: "limited", failRetention: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &recordHarbor{Server: standin.NewServer(), failRetention: tt.failRetention}
+			target, targetHarbor := newTestHarborClient(t, handler)
+			if tt.existing {
+				putProject(t, target, tt.project, 500, 0)
+			}
+			err := ensureProject(targetHarbor, sourceHarbor, tt.project, tt.defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ensureProject() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(handler.created) > 0 && handler.created[0].StorageLimit == nil {
+				t.Error("storage_limit should always be sent when creating project")
+			}
+			project, err := targetHarbor.GetProject(ctx, tt.project)
+			if !tt.wantCreated {
+				if errors.Cause(err) != registryserver.ErrNotFound {
+					t.Errorf("project should not exist in target, err = %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			summary, err := targetHarbor.ProjectSummary(ctx, tt.project)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hard, _ := summary.StorageLimit(); hard != tt.wantHard {
+				t.Errorf("storage limit = %d, want %d", hard, tt.wantHard)
+			}
+			if got := project.RetentionId() > 0; got != tt.wantRetention {
+				t.Errorf("has retention = %v, want %v", got, tt.wantRetention)
+			}
+		})
+	}
+}
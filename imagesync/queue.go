@@ -0,0 +1,146 @@
+package imagesync
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+type imageLessFunc func(a, b DataImage) bool
+
+// imageOrders 可插拔的镜像分发顺序，key 为配置文件中 order 的取值
+var imageOrders = map[string]imageLessFunc{
+	// 官方镜像优先
+	"official": func(a, b DataImage) bool { return a.IsOfficial && !b.IsOfficial },
+	// 最近使用过的镜像优先
+	"recent": func(a, b DataImage) bool { return a.LastUsedTime.After(b.LastUsedTime) },
+	// 使用次数多的镜像优先
+	"usage": func(a, b DataImage) bool { return a.UsageCount > b.UsageCount },
+	// 小镜像优先，尽快完成更多镜像
+	"smallest": func(a, b DataImage) bool { return sortSize(a) < sortSize(b) },
+	// 大镜像优先，让耗时长的传输尽早开始
+	"largest": func(a, b DataImage) bool { return sortSize(a) > sortSize(b) },
+}
+
+type queueItem struct {
+	image    DataImage
+	priority int // 被手动提升的优先级，越大越先分发
+	seq      int // 入队顺序，排序条件相同时保持原有顺序
+	index    int
+}
+
+// syncQueue 待同步镜像的优先级队列，支持在同步过程中提升指定镜像的优先级
+type syncQueue struct {
+	lock     sync.Mutex
+	items    []*queueItem
+	orders   []imageLessFunc
+	seq      int
+	priority int
+}
+
+func newSyncQueue(orders []string) (*syncQueue, error) {
+	q := &syncQueue{}
+	for _, order := range orders {
+		less, ok := imageOrders[order]
+		if !ok {
+			return nil, fmt.Errorf("unsupported order:%s", order)
+		}
+		q.orders = append(q.orders, less)
+	}
+	return q, nil
+}
+
+func (q *syncQueue) Push(image DataImage) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.seq++
+	heap.Push((*queueHeap)(q), &queueItem{image: image, seq: q.seq})
+}
+
+// Pop 取出优先级最高的镜像，队列为空时 ok 为 false
+func (q *syncQueue) Pop() (image DataImage, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.items) == 0 {
+		return image, false
+	}
+	item := heap.Pop((*queueHeap)(q)).(*queueItem)
+	return item.image, true
+}
+
+// Bump 将镜像（镜像ID 或 name:tag）提到队首，后提升的镜像排在更前面，镜像不在队列中时返回 false
+func (q *syncQueue) Bump(image string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, item := range q.items {
+		if item.image.ID == image || item.image.Name+":"+item.image.Tag == image {
+			q.priority++
+			item.priority = q.priority
+			heap.Fix((*queueHeap)(q), item.index)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *syncQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
+
+// List 按分发顺序返回队列中的镜像
+func (q *syncQueue) List() []DataImage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	sorted := &queueHeap{items: make([]*queueItem, len(q.items)), orders: q.orders}
+	copy(sorted.items, q.items)
+	sort.Slice(sorted.items, sorted.Less)
+	result := make([]DataImage, 0, len(sorted.items))
+	for _, item := range sorted.items {
+		result = append(result, item.image)
+	}
+	return result
+}
+
+// queueHeap 实现 heap.Interface，调用方需持有 syncQueue.lock
+type queueHeap syncQueue
+
+func (h *queueHeap) Len() int { return len(h.items) }
+
+func (h *queueHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if a.priority != b.priority {
+		return a.priority > b.priority
+	}
+	for _, less := range h.orders {
+		if less(a.image, b.image) {
+			return true
+		}
+		if less(b.image, a.image) {
+			return false
+		}
+	}
+	return a.seq < b.seq
+}
+
+func (h *queueHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+func (h *queueHeap) Push(x interface{}) {
+	item := x.(*queueItem)
+	item.index = len(h.items)
+	h.items = append(h.items, item)
+}
+
+func (h *queueHeap) Pop() interface{} {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items[n-1] = nil
+	h.items = h.items[:n-1]
+	return item
+}
@@ -0,0 +1,109 @@
+package imagesync
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func popAll(q *syncQueue) []string {
+	var result []string
+	for {
+		image, ok := q.Pop()
+		if !ok {
+			return result
+		}
+		result = append(result, image.Name)
+	}
+}
+
+func TestSyncQueueOrder(t *testing.T) {
+	now := time.Now()
+	images := []DataImage{
+		{Name: "a", Size: "300", UsageCount: 1, LastUsedTime: now.Add(-time.Hour)},
+		{Name: "b", Size: "100", UsageCount: 5, LastUsedTime: now.Add(-2 * time.Hour), IsOfficial: true},
+		{Name: "c", Size: "200", UsageCount: 5, LastUsedTime: now},
+		{Name: "d", Size: "", UsageCount: 0, LastUsedTime: now.Add(-3 * time.Hour)},
+	}
+	tests := []struct {
+		orders []string
+		want   []string
+	}{
+		{orders: nil, want: []string{"a", "b", "c", "d"}},
+		{orders: []string{"official"}, want: []string{"b", "a", "c", "d"}},
+		{orders: []string{"usage", "recent"}, want: []string{"c", "b", "a", "d"}},
+		{orders: []string{"smallest"}, want: []string{"d", "b", "c", "a"}},
+		{orders: []string{"largest"}, want: []string{"a", "c", "b", "d"}},
+	}
+	for _, tt := range tests {
+		q, err := newSyncQueue(tt.orders)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, image := range images {
+			q.Push(image)
+		}
+		var listed []string
+		for _, image := range q.List() {
+			listed = append(listed, image.Name)
+		}
+		if !reflect.DeepEqual(listed, tt.want) {
+			t.Errorf("orders %v: List() = %v, want %v", tt.orders, listed, tt.want)
+		}
+		if got := popAll(q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("orders %v: Pop() = %v, want %v", tt.orders, got, tt.want)
+		}
+	}
+
+	if _, err := newSyncQueue([]string{"unknown"}); err == nil {
+		t.Error("newSyncQueue() with unknown order should fail")
+	}
+}
+
+func TestSyncQueueBump(t *testing.T) {
+	q, _ := newSyncQueue([]string{"usage"})
+	q.Push(DataImage{ID: "1", Name: "a", Tag: "v1", UsageCount: 3})
+	q.Push(DataImage{ID: "2", Name: "b", Tag: "v1", UsageCount: 2})
+	q.Push(DataImage{ID: "3", Name: "c", Tag: "v1", UsageCount: 1})
+	if !q.Bump("c:v1") || !q.Bump("2") {
+		t.Fatal("Bump() existing image should succeed")
+	}
+	if q.Bump("x:v1") {
+		t.Error("Bump() missing image should fail")
+	}
+	// 后提升的镜像排在更前面
+	if got, want := popAll(q), []string{"b", "c", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Pop() = %v, want %v", got, want)
+	}
+}
+
+func TestTakePriorityFile(t *testing.T) {
+	priorityFile := path.Join(t.TempDir(), PriorityFile)
+	if images, err := takePriorityFile(priorityFile); err != nil || images != nil {
+		t.Fatalf("takePriorityFile() without file = %v,%v", images, err)
+	}
+	if err := os.WriteFile(priorityFile, []byte("p/a:v1\n\n 2 \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	images, err := takePriorityFile(priorityFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"p/a:v1", "2"}; !reflect.DeepEqual(images, want) {
+		t.Errorf("takePriorityFile() = %v, want %v", images, want)
+	}
+	if _, err = os.Stat(priorityFile); !os.IsNotExist(err) {
+		t.Errorf("priority file should be moved away, stat err = %v", err)
+	}
+
+	// 上次读取中断留下的文件以及新写入的控制文件都会被读取
+	os.WriteFile(priorityFile+".taken", []byte("p/b:v1\n"), 0644)
+	os.WriteFile(priorityFile, []byte("p/c:v1\n"), 0644)
+	first, _ := takePriorityFile(priorityFile)
+	second, _ := takePriorityFile(priorityFile)
+	if !reflect.DeepEqual(first, []string{"p/b:v1"}) || !reflect.DeepEqual(second, []string{"p/c:v1"}) {
+		t.Errorf("takePriorityFile() = %v then %v, want [p/b:v1] then [p/c:v1]", first, second)
+	}
+}
@@ -0,0 +1,116 @@
+package imagesync
+
+import (
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"sync"
+	"time"
+)
+
+// syncScheduler 同时限制并发同步的镜像个数以及正在传输的镜像总大小，
+// 开启自适应后根据观测到的吞吐量调整并发个数：吞吐量增长时增加并发，出现失败或超时时减半
+type syncScheduler struct {
+	lock             sync.Mutex
+	cond             *sync.Cond
+	limit            int
+	minProc          int
+	maxProc          int
+	maxInflightBytes int64
+	running          int
+	inflightBytes    int64
+	paused           bool
+
+	// 自适应调整所需的统计信息
+	windowFailed   int
+	lastThroughput float64
+}
+
+func newSyncScheduler(proc, maxProc int, maxInflightBytes int64) *syncScheduler {
+	if proc <= 0 {
+		proc = 1
+	}
+	if maxProc < proc {
+		maxProc = proc
+	}
+	s := &syncScheduler{
+		limit:            proc,
+		minProc:          1,
+		maxProc:          maxProc,
+		maxInflightBytes: maxInflightBytes,
+	}
+	s.cond = sync.NewCond(&s.lock)
+	return s
+}
+
+// WaitSlot 阻塞直到有空闲的并发位置
+func (s *syncScheduler) WaitSlot() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.paused || s.running >= s.limit {
+		s.cond.Wait()
+	}
+}
+
+// SetPaused 暂停或恢复分发，已经开始同步的镜像不受影响
+func (s *syncScheduler) SetPaused(paused bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.paused = paused
+	s.cond.Broadcast()
+}
+
+// Acquire 阻塞直到并发个数以及传输中的总大小都允许该镜像开始同步，
+// 超过 maxInflightBytes 的单个镜像在没有其他镜像传输时仍然可以开始
+func (s *syncScheduler) Acquire(size int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.running >= s.limit ||
+		(s.maxInflightBytes > 0 && s.running > 0 && s.inflightBytes+size > s.maxInflightBytes) {
+		s.cond.Wait()
+	}
+	s.running++
+	s.inflightBytes += size
+}
+
+func (s *syncScheduler) Release(size int64, succeed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.running--
+	s.inflightBytes -= size
+	if !succeed {
+		s.windowFailed++
+	}
+	s.cond.Broadcast()
+}
+
+// Adapt 每隔 interval 根据这段时间内实际传输的字节数调整并发个数，transferred 返回累计传输的字节数。
+// 按传输中的字节采样，耗时几个小时的大镜像在传输过程中同样计入吞吐量
+func (s *syncScheduler) Adapt(interval time.Duration, transferred func() int64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := transferred()
+	for range ticker.C {
+		current := transferred()
+		s.adjust(interval, current-last)
+		last = current
+	}
+}
+
+func (s *syncScheduler) adjust(interval time.Duration, windowBytes int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	throughput := float64(windowBytes) / interval.Seconds()
+	switch {
+	case s.windowFailed > 0:
+		s.limit = s.limit / 2
+		if s.limit < s.minProc {
+			s.limit = s.minProc
+		}
+		glog.Infof("sync failed %d times,decrease concurrency to %d", s.windowFailed, s.limit)
+	case throughput > s.lastThroughput*1.05 && s.running >= s.limit && s.limit < s.maxProc:
+		s.limit++
+		glog.Infof("sync throughput %.2f MB/s grows,increase concurrency to %d", throughput/(1<<20), s.limit)
+	}
+	s.lastThroughput = throughput
+	s.windowFailed = 0
+	s.cond.Broadcast()
+}
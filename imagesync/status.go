@@ -0,0 +1,112 @@
+package imagesync
+
+import (
+	"encoding/json"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/secret"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type syncStatus struct {
+	Total     int      `json:"total"`
+	Remaining int      `json:"remaining"`
+	Failed    int      `json:"failed"`
+	Skipped   int      `json:"skipped"`
+	SyncedGB  int64    `json:"synced_gb"`
+	Elapsed   string   `json:"elapsed"`
+	Queue     []string `json:"queue"`
+}
+
+// serveStatus 提供同步状态查询以及镜像插队接口
+//
+//	GET  /status                 查看同步进度以及待分发队列
+//	POST /bump?image=proj/repo:tag 将镜像提到队首
+func (s *SyncImageManager) serveStatus(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		status := syncStatus{
+			Total:     totalNeedSyncCount,
+			Remaining: s.currentNeedSyncCount,
+			Failed:    syncFailedCount,
+			Skipped:   syncSkippedCount,
+			SyncedGB:  SyncSize >> 30,
+			Elapsed:   formatDuration(time.Since(s.syncStartTime)),
+		}
+		s.lock.Unlock()
+		for _, image := range s.queue.List() {
+			status.Queue = append(status.Queue, image.Name+":"+image.Tag)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	})
+	mux.HandleFunc("/bump", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		image := r.URL.Query().Get("image")
+		if !s.bump(image) {
+			http.Error(w, "image not in queue", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	glog.Infof("status server listen on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		glog.Errorf("status server exit,err:%v", secret.RedactError(err))
+	}
+}
+
+// watchPriorityFile 定期读取插队控制文件
+func (s *SyncImageManager) watchPriorityFile(priorityFile string) {
+	for {
+		images, err := takePriorityFile(priorityFile)
+		if err != nil {
+			glog.Warnf("read priority file failed,err:%v", err)
+		}
+		for _, image := range images {
+			s.bump(image)
+		}
+		time.Sleep(time.Second * 5)
+	}
+}
+
+// takePriorityFile 先把控制文件重命名再读取并删除，重命名之后追加的内容会写入新的控制文件，不会丢失；
+// 上次读取时中断留下的文件同样会被读取
+func takePriorityFile(priorityFile string) ([]string, error) {
+	takenFile := priorityFile + ".taken"
+	if _, err := os.Stat(takenFile); os.IsNotExist(err) {
+		if err = os.Rename(priorityFile, takenFile); os.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	data, err := os.ReadFile(takenFile)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Remove(takenFile); err != nil {
+		return nil, err
+	}
+	var images []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			images = append(images, line)
+		}
+	}
+	return images, nil
+}
+
+func (s *SyncImageManager) bump(image string) bool {
+	if !s.queue.Bump(image) {
+		glog.Warnf("bump image %s failed,image not in queue", image)
+		return false
+	}
+	glog.Infof("bump image %s to the head of queue", image)
+	return true
+}
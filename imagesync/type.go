@@ -7,8 +7,29 @@ type DataImage struct {
 	Name       string `json:"image_name"  xorm:"'image_name'"`
 	Tag        string `json:"image_tag"  xorm:"'image_tag'"`
 	Size       string `json:"image_size"  xorm:"'image_size'"`
-	Status     int    //1:同步成功 2:同步失败
+	Status     int    //1:同步成功 2:同步失败 3:目标 tag 冲突跳过
 	CreateTime time.Time
+	RunId      string `json:"run_id,omitempty" xorm:"-"` //同步该镜像的运行ID
+	// 选择镜像时 tag 对应的源镜像 digest，复制以及校验都使用该 digest，运行期间 tag 被重新推送也不影响
+	SourceDigest string `json:"source_digest,omitempty" xorm:"-"`
+
+	// 同步成功后从目标镜像仓库查询到的镜像信息
+	Digest            string            `json:"digest,omitempty" xorm:"-"`
+	MediaType         string            `json:"media_type,omitempty" xorm:"-"`
+	Platforms         []string          `json:"platforms,omitempty" xorm:"-"`
+	Created           *time.Time        `json:"created,omitempty" xorm:"-"`
+	Labels            map[string]string `json:"labels,omitempty" xorm:"-"`
+	ExpectedPlatforms []string          `json:"expected_platforms,omitempty" xorm:"-"` //目标镜像仓库配置了 platforms 时多平台镜像应该同步的平台
+
+	UsageCount   int64     `json:"usage_count,omitempty" xorm:"-"` //时间窗口内任务使用该镜像的次数
+	LastUsedTime time.Time `json:"-" xorm:"-"`                     //时间窗口内任务最近一次使用该镜像的时间
+	IsOfficial   bool      `json:"-" xorm:"-"`                     //是否为官方镜像
+}
+
+type imageUsage struct {
+	ImageId      int64     `xorm:"'image_id'"`
+	UsageCount   int64     `xorm:"'usage_count'"`
+	LastUsedTime time.Time `xorm:"'last_used_time'"`
 }
 
 type ImageMetadata struct {
@@ -19,4 +40,8 @@ type ImageMetadata struct {
 const (
 	SyncSucceed = 1
 	SyncFailed  = 2
+	SyncSkipped = 3
 )
+
+// SyncSkippedFile 记录 tagConflict 为 skip 时跳过的镜像，与 sync-succeed 一样之后的运行不再选择这些镜像
+const SyncSkippedFile = "sync-skipped"
@@ -2,12 +2,19 @@ package imagesync
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/pkg/errors"
 	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/secret"
 	"os"
+	"os/signal"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -15,8 +22,37 @@ func logMeta(meta DataImage) glog.Field {
 	return glog.String("imageName", meta.Name+":"+meta.Tag)
 }
 
+// logError 输出脱敏后的错误
 func logError(err error) glog.Field {
-	return glog.String("err", err.Error())
+	return glog.String("err", secret.Redact(err.Error()))
+}
+
+// removeOnSignal 收到 SIGINT、SIGTERM 时删除文件后退出，返回的函数用于停止监听
+func removeOnSignal(file string) func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			os.Remove(file)
+			glog.Errorf("received signal %v,exit", sig)
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// sourceReference 复制源镜像时使用的引用，选择镜像时已经解析出 digest 时使用 digest，否则使用 tag
+func sourceReference(imageMeta DataImage) string {
+	if imageMeta.SourceDigest != "" {
+		return imageMeta.SourceDigest
+	}
+	return imageMeta.Tag
 }
 
 func imageYamlPath(imageName, imageTag, basePath string) string {
@@ -70,6 +106,39 @@ func GetSyncSucceedImageMap(outputPath string) map[string]struct{} {
 	return result
 }
 
+// RemoveSyncSucceedImage 从同步成功记录中移除 runId 同步并且 remove 返回 true 的镜像，返回被移除的镜像
+func RemoveSyncSucceedImage(outputPath string, runId string, remove func(DataImage) bool) ([]DataImage, error) {
+	data, err := os.ReadFile(outputPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var removed []DataImage
+	var kept []byte
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var image DataImage
+		if err := json.Unmarshal(line, &image); err == nil && image.RunId == runId && remove(image) {
+			removed = append(removed, image)
+			continue
+		}
+		kept = append(kept, line...)
+		kept = append(kept, '\n')
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	tmpPath := outputPath + ".tmp"
+	if err = os.WriteFile(tmpPath, kept, 0644); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return removed, errors.WithStack(os.Rename(tmpPath, outputPath))
+}
+
 func splitImageNameToProjAndRepo(name string) (projectName string, repoName string) {
 	// projectName/repositoryName
 	projectName = strings.Split(name, "/")[0]
@@ -96,3 +165,55 @@ func formatDuration(d time.Duration) string {
 
 	return fmt.Sprintf("%02d:%02d:%02d", hours, minutes, seconds)
 }
+
+func sortImageByUsage(imageList []DataImage) {
+	sort.SliceStable(imageList, func(i, j int) bool {
+		if imageList[i].UsageCount != imageList[j].UsageCount {
+			return imageList[i].UsageCount > imageList[j].UsageCount
+		}
+		return imageList[i].LastUsedTime.After(imageList[j].LastUsedTime)
+	})
+}
+
+// limitImageList 按顺序挑选镜像，最多 topN 个且总大小不超过 maxTotalSize，为 0 表示不限制
+func limitImageList(imageList []DataImage, topN int, maxTotalSize int64) []DataImage {
+	if topN <= 0 && maxTotalSize <= 0 {
+		return imageList
+	}
+	var totalSize int64
+	result := make([]DataImage, 0, len(imageList))
+	for _, image := range imageList {
+		if topN > 0 && len(result) >= topN {
+			break
+		}
+		size, ok := parseImageSize(image)
+		if maxTotalSize > 0 && !ok {
+			// 无法确定大小的镜像不能保证不超过上限
+			glog.Warnf("image %s:%s skipped,unknown size %q", image.Name, image.Tag, image.Size)
+			continue
+		}
+		if maxTotalSize > 0 && totalSize+size > maxTotalSize {
+			glog.Infof("image %s:%s skipped,exceed max total size", image.Name, image.Tag)
+			continue
+		}
+		totalSize += size
+		result = append(result, image)
+	}
+	glog.Infof("select %d images of %d,total size:%v GB", len(result), len(imageList), totalSize>>30)
+	return result
+}
+
+// parseImageSize 解析 image_size，为空、无法解析或者为负数时 ok 为 false，调用方需要按大小未知处理
+func parseImageSize(image DataImage) (size int64, ok bool) {
+	size, err := strconv.ParseInt(image.Size, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// sortSize 排序使用的镜像大小，大小未知时为 0
+func sortSize(image DataImage) int64 {
+	size, _ := parseImageSize(image)
+	return size
+}
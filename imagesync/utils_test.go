@@ -0,0 +1,90 @@
+package imagesync
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+func TestLimitImageList(t *testing.T) {
+	images := []DataImage{
+		{Name: "p/a", Tag: "v1", Size: "100"},
+		{Name: "p/b", Tag: "v1", Size: ""},
+		{Name: "p/c", Tag: "v1", Size: "abc"},
+		{Name: "p/d", Tag: "v1", Size: "300"},
+		{Name: "p/e", Tag: "v1", Size: "50"},
+	}
+	names := func(list []DataImage) []string {
+		var result []string
+		for _, image := range list {
+			result = append(result, image.Name)
+		}
+		return result
+	}
+	tests := []struct {
+		name         string
+		topN         int
+		maxTotalSize int64
+		want         []string
+	}{
+		{name: "no limit", want: []string{"p/a", "p/b", "p/c", "p/d", "p/e"}},
+		{name: "topN only keeps unknown size", topN: 2, want: []string{"p/a", "p/b"}},
+		{name: "max total size skips unknown and too large", maxTotalSize: 200, want: []string{"p/a", "p/e"}},
+		{name: "both", topN: 1, maxTotalSize: 1000, want: []string{"p/a"}},
+	}
+	for _, tt := range tests {
+		got := names(limitImageList(images, tt.topN, tt.maxTotalSize))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: limitImageList() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseImageSize(t *testing.T) {
+	tests := []struct {
+		size   string
+		want   int64
+		wantOk bool
+	}{
+		{size: "1024", want: 1024, wantOk: true},
+		{size: "0", want: 0, wantOk: true},
+		{size: "", wantOk: false},
+		{size: "1GB", wantOk: false},
+		{size: "-1", wantOk: false},
+	}
+	for _, tt := range tests {
+		got, ok := parseImageSize(DataImage{Size: tt.size})
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("parseImageSize(%q) = %d,%v, want %d,%v", tt.size, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestRemoveSyncSucceedImage(t *testing.T) {
+	succeedPath := path.Join(t.TempDir(), "sync-succeed")
+	lines := `{"image_name":"p/a","image_tag":"v1","run_id":"r1"}
+{"image_name":"p/b","image_tag":"v1","run_id":"r1"}
+{"image_name":"p/c","image_tag":"v1","run_id":"r2"}
+`
+	if err := os.WriteFile(succeedPath, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// 只移除 remove 返回 true 的镜像，例如删除 manifest 成功的镜像
+	removed, err := RemoveSyncSucceedImage(succeedPath, "r1", func(image DataImage) bool {
+		return image.Name == "p/a"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0].Name != "p/a" {
+		t.Errorf("RemoveSyncSucceedImage() = %+v, want only p/a", removed)
+	}
+	var left []string
+	for _, image := range GetSyncSucceedImageList(succeedPath) {
+		left = append(left, image.Name)
+	}
+	if want := []string{"p/b", "p/c"}; !reflect.DeepEqual(left, want) {
+		t.Errorf("sync-succeed after remove = %v, want %v", left, want)
+	}
+}
@@ -1,31 +1,61 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/pkg/errors"
 	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/blobcache"
 	"image-sync/config"
 	"image-sync/dao"
+	"image-sync/evict"
 	"image-sync/imagesync"
+	"image-sync/reconcile"
+	"image-sync/secret"
 	"image-sync/update"
 	"os"
 	"path"
 	"time"
 )
 
+const projectName = "image-migration"
+
 var (
-	syncerPath = flag.String("syncerPath", "./image-syncer", "The path of the image-syncer")
-	auth       = flag.String("auth", "./auth.yaml", "The path of the auth configFile")
-	configFile = flag.String("config", "./config.yaml", "The path of the auth configFile")
+	syncerPath      = flag.String("syncerPath", "./image-syncer", "The path of the image-syncer")
+	auth            = flag.String("auth", "./auth.yaml", "The path of the auth configFile")
+	configFile      = flag.String("config", "./config.yaml", "The path of the auth configFile")
+	runId           = flag.String("run", "", "The run id to rollback")
+	deleteManifests = flag.Bool("deleteManifests", false, "Delete the manifests pushed by the run when rollback")
+	apply           = flag.Bool("apply", false, "Delete the manifests and image metadata when evict, default only report")
+	keepSize        = flag.String("keep", "", "The size of the blob cache to keep when prune, default cache.maxSize, 0 to remove all")
+
+	// 命令行中指定的命令，例如 rollback，会覆盖配置文件中的 mode
+	command string
 )
 
 func init() {
 	flag.Parse()
-	config.ParseConfig("image-migration", *configFile)
-	glog.Infow("parse config succeed", "config", config.IMConfig)
-
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+		// 解析命令之后的参数，例如 rollback --run <id>
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	// config check、cache prune 不连接数据库
+	if command == "config" || command == "cache" {
+		return
+	}
+	config.ParseConfig(projectName, *configFile, config.Mode(command))
+	if config.IMConfig.RunId == "" {
+		config.IMConfig.RunId = newRunId()
+	}
+	command = string(config.IMConfig.Mode)
+	masked, _ := json.Marshal(config.IMConfig.Masked())
+	glog.Info("parse config succeed", glog.String("config", string(masked)))
 	err := dao.InitMySQL(config.IMConfig.DbDsn)
-	glog.InfoFatalw(err, "init MySQL")
+	glog.InfoFatalw(secret.RedactError(err), "init MySQL")
 
 	if !isExist(path.Join(config.IMConfig.OutputPath, "sync-succeed")) {
 		os.Create(path.Join(config.IMConfig.OutputPath, "sync-succeed"))
@@ -38,28 +68,152 @@ func init() {
 }
 
 func main() {
-	switch config.IMConfig.Mode {
-	case "sync", "migration":
+	switch command {
+	case "sync", "migration", "list", "pipeline", "import":
 		startTime := time.Now()
 		fmt.Println("start time:", startTime)
+		fmt.Println("run id:", config.IMConfig.RunId)
 
 		sm := imagesync.NewSyncImageManager(*syncerPath, *auth)
-		imageList, err := sm.GetNeedSyncImageMetaList()
-		if err != nil {
-			glog.Errorf("pre sync failed,err:%+v", err)
-			return
+		// pipeline、import 模式在镜像校验成功后写入目标 AZ 的元数据
+		updateMeta := command == "pipeline" || command == "import"
+		if updateMeta && config.IMConfig.PipelineUpdate == config.PipelineUpdateImmediate {
+			// 每个镜像校验成功后立即在单独的事务中写入目标 AZ 的元数据
+			sm.SetSucceedHook(func(image imagesync.DataImage) {
+				update.UpdateImages([]imagesync.DataImage{image})
+			})
+		}
+		if command == "import" {
+			if err := sm.Import(config.IMConfig.ImportPath); err != nil {
+				glog.Errorf("import failed,err:%+v", secret.RedactError(err))
+				return
+			}
+		} else {
+			imageList, err := sm.GetNeedSyncImageMetaList()
+			if err != nil {
+				glog.Errorf("pre sync failed,err:%+v", secret.RedactError(err))
+				return
+			}
+			sm.Sync(imageList)
+		}
+		if updateMeta && config.IMConfig.PipelineUpdate == config.PipelineUpdateEnd {
+			update.UpdateImages(sm.SucceedImages())
 		}
-		sm.Sync(imageList)
 		endTime := time.Now()
 		fmt.Println("end time:", endTime)
 		fmt.Printf("cost time:%v,sync totalSize:%v GB\n", endTime.Sub(startTime), imagesync.SyncSize>>30)
 		costTimeSec := endTime.Sub(startTime).Seconds()
 		fmt.Printf("sync speed:%.2f MB/s\n", float64(imagesync.SyncSize>>20)/costTimeSec)
+	case "export":
+		fmt.Println("run id:", config.IMConfig.RunId)
+		sm := imagesync.NewSyncImageManager(*syncerPath, *auth)
+		imageList, err := sm.GetNeedSyncImageMetaList()
+		if err != nil {
+			glog.Errorf("pre export failed,err:%+v", secret.RedactError(err))
+			return
+		}
+		exportPath, err := sm.Export(imageList)
+		if err != nil {
+			glog.Errorf("export failed,err:%+v", secret.RedactError(err))
+			return
+		}
+		fmt.Println("export path:", exportPath)
 	case "update":
+		fmt.Println("run id:", config.IMConfig.RunId)
 		update.UpdateImageMeta()
+	case "reconcile":
+		reconcile.Reconcile(*auth)
+	case "evict":
+		if err := evict.Evict(*auth, config.IMConfig.Evict.Apply || *apply); err != nil {
+			glog.Errorf("evict failed,err:%+v", secret.RedactError(err))
+		}
+	case "rollback":
+		if err := update.Rollback(*runId, *deleteManifests, *auth); err != nil {
+			glog.Errorf("rollback run %s failed,err:%+v", *runId, secret.RedactError(err))
+			return
+		}
+		glog.Infof("rollback run %s succeed", *runId)
+	case "config":
+		if flag.Arg(0) != "check" {
+			glog.Errorf("unsupported config command,:%s", flag.Arg(0))
+			os.Exit(1)
+		}
+		if !checkConfig() {
+			os.Exit(1)
+		}
+	case "cache":
+		if flag.Arg(0) != "prune" {
+			glog.Errorf("unsupported cache command,:%s", flag.Arg(0))
+			os.Exit(1)
+		}
+		if err := pruneCache(); err != nil {
+			glog.Errorf("prune blob cache failed,err:%+v", secret.RedactError(err))
+			os.Exit(1)
+		}
 	default:
-		glog.Errorf("unsupported mode,:%s", config.IMConfig.Mode)
+		glog.Errorf("unsupported mode,:%s", command)
+	}
+}
+
+// pruneCache 删除缓存中下载中断留下的临时文件，并淘汰最久未使用的 blob 直到不超过 --keep 或者 cache.maxSize
+func pruneCache() error {
+	cfg, err := config.LoadConfig(projectName, *configFile)
+	if err != nil {
+		return err
+	}
+	if cfg.Cache.Dir == "" {
+		return errors.New("cache.dir is not configured")
+	}
+	keep := cfg.Cache.MaxSize
+	if *keepSize != "" {
+		keep = *keepSize
+	}
+	maxSize := int64(-1)
+	if keep != "" {
+		if maxSize, err = config.ParseByteSize(keep); err != nil {
+			return err
+		}
+	}
+	cache, err := blobcache.Open(cfg.Cache.Dir, 0)
+	if err != nil {
+		return err
 	}
+	removed, freed, err := cache.Prune(maxSize)
+	if err != nil {
+		return err
+	}
+	count, size := cache.Size()
+	fmt.Printf("removed %d files,freed %d MB,remaining %d blobs,%d MB\n", removed, freed>>20, count, size>>20)
+	return nil
+}
+
+// checkConfig 输出配置中的所有问题以及隐藏敏感信息后的最终配置，配置有效时返回 true
+func checkConfig() bool {
+	cfg, err := config.LoadConfig(projectName, *configFile)
+	if err != nil {
+		fmt.Println("load config failed:", err)
+		return false
+	}
+	problems := cfg.Validate()
+	data, _ := json.MarshalIndent(cfg.Masked(), "", "  ")
+	fmt.Println("effective config:")
+	fmt.Println(string(data))
+	if len(problems) == 0 {
+		fmt.Println("config is valid")
+		return true
+	}
+	fmt.Printf("found %d problems:\n", len(problems))
+	for _, problem := range problems {
+		fmt.Println("  -", problem)
+	}
+	return false
+}
+
+// newRunId 生成本次运行的ID，例如 20231019-153000-1a2b3c
+func newRunId() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
 }
 
 // 判断文件或文件夹是否存在
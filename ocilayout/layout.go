@@ -0,0 +1,251 @@
+package ocilayout
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"image-sync/registryserver"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	LayoutFile    = "oci-layout"
+	IndexFile     = "index.json"
+	BlobsDir      = "blobs"
+	LayoutVersion = "1.0.0"
+
+	// AnnotationRefName OCI 规范中的 tag
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+	// AnnotationImageName 完整的镜像名，ctr images import 等工具也使用该 annotation
+	AnnotationImageName = "io.containerd.image.name"
+)
+
+// Layout OCI image-layout 目录，多个镜像共用 blobs 目录，相同的 blob 只保存一次
+type Layout struct {
+	dir      string
+	lock     sync.Mutex
+	index    registryserver.Manifest
+	inflight map[string]*inflightBlob
+}
+
+type inflightBlob struct {
+	done chan struct{}
+	err  error
+}
+
+// Create 创建 OCI image-layout 目录，目录已存在时继续使用其中的 blob 与 index.json
+func Create(dir string) (*Layout, error) {
+	if err := os.MkdirAll(filepath.Join(dir, BlobsDir, "sha256"), 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	data, _ := json.Marshal(map[string]string{"imageLayoutVersion": LayoutVersion})
+	if err := os.WriteFile(filepath.Join(dir, LayoutFile), data, 0644); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	layout, err := Open(dir)
+	if os.IsNotExist(errors.Cause(err)) {
+		return &Layout{
+			dir:      dir,
+			index:    registryserver.Manifest{SchemaVersion: 2, MediaType: registryserver.MediaTypeOCIIndex},
+			inflight: make(map[string]*inflightBlob),
+		}, nil
+	}
+	return layout, err
+}
+
+// Open 打开已有的 OCI image-layout 目录
+func Open(dir string) (*Layout, error) {
+	data, err := os.ReadFile(filepath.Join(dir, IndexFile))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	layout := &Layout{dir: dir, inflight: make(map[string]*inflightBlob)}
+	if err = json.Unmarshal(data, &layout.index); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", IndexFile)
+	}
+	return layout, nil
+}
+
+func (l *Layout) Dir() string {
+	return l.dir
+}
+
+// BlobPath 返回 blob 在目录中的路径，例如 blobs/sha256/<hex>
+func (l *Layout) BlobPath(digest string) (string, error) {
+	algorithm, hexDigest, ok := strings.Cut(digest, ":")
+	if !ok || algorithm != "sha256" || len(hexDigest) != sha256.Size*2 || strings.ContainsAny(hexDigest, "/\\.") {
+		return "", errors.Errorf("unsupported digest %q", digest)
+	}
+	return filepath.Join(l.dir, BlobsDir, algorithm, hexDigest), nil
+}
+
+// HasBlob 判断 blob 是否已经保存
+func (l *Layout) HasBlob(digest string) bool {
+	blobPath, err := l.BlobPath(digest)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(blobPath)
+	return err == nil
+}
+
+// WriteBlob 保存 blob 并校验 digest，blob 已存在时不会调用 open，
+// 多个镜像同时写入同一个 blob 时只写入一次，其余调用等待写入完成，返回是否实际写入
+func (l *Layout) WriteBlob(digest string, open func() (io.ReadCloser, error)) (bool, error) {
+	blobPath, err := l.BlobPath(digest)
+	if err != nil {
+		return false, err
+	}
+	l.lock.Lock()
+	if blob, ok := l.inflight[digest]; ok {
+		l.lock.Unlock()
+		<-blob.done
+		return false, blob.err
+	}
+	if l.HasBlob(digest) {
+		l.lock.Unlock()
+		return false, nil
+	}
+	blob := &inflightBlob{done: make(chan struct{})}
+	l.inflight[digest] = blob
+	l.lock.Unlock()
+
+	blob.err = writeVerified(blobPath, digest, open)
+	l.lock.Lock()
+	delete(l.inflight, digest)
+	l.lock.Unlock()
+	close(blob.done)
+	return blob.err == nil, blob.err
+}
+
+// WriteBlobBytes 保存 manifest 等较小的 blob
+func (l *Layout) WriteBlobBytes(data []byte) (string, error) {
+	digest := registryserver.Digest(data)
+	_, err := l.WriteBlob(digest, func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	})
+	return digest, err
+}
+
+// writeVerified 先写入临时文件，digest 一致后再重命名，避免留下不完整的 blob
+func writeVerified(blobPath, digest string, open func() (io.ReadCloser, error)) error {
+	reader, err := open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tmpFile, err := os.CreateTemp(filepath.Dir(blobPath), ".tmp-*")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(tmpFile.Name())
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmpFile, hash), reader)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return errors.Errorf("blob digest mismatch,expect %s,actual %s", digest, actual)
+	}
+	return errors.WithStack(os.Rename(tmpFile.Name(), blobPath))
+}
+
+// OpenBlob 读取 blob
+func (l *Layout) OpenBlob(digest string) (*os.File, error) {
+	blobPath, err := l.BlobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(blobPath)
+	return file, errors.WithStack(err)
+}
+
+// ReadBlob 读取 manifest 等较小的 blob
+func (l *Layout) ReadBlob(digest string) ([]byte, error) {
+	blobPath, err := l.BlobPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(blobPath)
+	return data, errors.WithStack(err)
+}
+
+// VerifyBlob 重新计算 blob 的 sha256，检查运输过程中是否损坏
+func (l *Layout) VerifyBlob(digest string, size int64) error {
+	file, err := l.OpenBlob(digest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	written, err := io.Copy(hash, file)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if size >= 0 && written != size {
+		return errors.Errorf("blob %s size mismatch,expect %d,actual %d", digest, size, written)
+	}
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return errors.Errorf("blob digest mismatch,expect %s,actual %s", digest, actual)
+	}
+	return nil
+}
+
+// AddManifest 在 index.json 中记录镜像，相同镜像名的旧记录会被替换
+func (l *Layout) AddManifest(descriptor registryserver.Descriptor) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	name := descriptor.Annotations[AnnotationImageName]
+	manifests := l.index.Manifests[:0]
+	for _, manifest := range l.index.Manifests {
+		if name == "" || manifest.Annotations[AnnotationImageName] != name {
+			manifests = append(manifests, manifest)
+		}
+	}
+	l.index.Manifests = append(manifests, descriptor)
+	return l.writeJSON(IndexFile, l.index)
+}
+
+// Manifests 返回 index.json 中记录的所有镜像
+func (l *Layout) Manifests() []registryserver.Descriptor {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]registryserver.Descriptor(nil), l.index.Manifests...)
+}
+
+// WriteJSON 在目录中写入 json 文件，例如导出内容清单
+func (l *Layout) WriteJSON(name string, value interface{}) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.writeJSON(name, value)
+}
+
+func (l *Layout) writeJSON(name string, value interface{}) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmpPath := filepath.Join(l.dir, "."+name+".tmp")
+	if err = os.WriteFile(tmpPath, data, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmpPath, filepath.Join(l.dir, name)))
+}
+
+// ReadJSON 读取目录中的 json 文件
+func (l *Layout) ReadJSON(name string, value interface{}) error {
+	data, err := os.ReadFile(filepath.Join(l.dir, name))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.Wrapf(json.Unmarshal(data, value), "parse %s", name)
+}
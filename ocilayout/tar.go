@@ -0,0 +1,101 @@
+package ocilayout
+
+import (
+	"archive/tar"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Pack 把 OCI image-layout 目录打包为 tar 文件，tar 中的路径相对于目录
+func Pack(dir, tarPath string) error {
+	file, err := os.Create(tarPath + ".tmp")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer os.Remove(file.Name())
+	writer := tar.NewWriter(file)
+	err = filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, filePath)
+		if err != nil || name == "." || strings.HasPrefix(info.Name(), ".") {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err = writer.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		src, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(writer, src)
+		return err
+	})
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(file.Name(), tarPath))
+}
+
+// Unpack 解压 Pack 生成的 tar 文件到目录，拒绝目录之外的路径
+func Unpack(tarPath, dir string) error {
+	file, err := os.Open(tarPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer file.Close()
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return errors.Errorf("invalid path %q in %s", header.Name, tarPath)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err = os.MkdirAll(target, 0755); err != nil {
+				return errors.WithStack(err)
+			}
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return errors.WithStack(err)
+			}
+			dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			_, err = io.Copy(dst, reader)
+			if closeErr := dst.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+	}
+}
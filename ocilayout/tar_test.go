@@ -0,0 +1,116 @@
+package ocilayout
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTar(t *testing.T, headers []*tar.Header) string {
+	tarPath := filepath.Join(t.TempDir(), "images.tar")
+	file, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := tar.NewWriter(file)
+	for _, header := range headers {
+		content := "content of " + header.Name
+		if header.Typeflag == tar.TypeReg {
+			header.Size = int64(len(content))
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if err = writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			writer.Write([]byte(content))
+		}
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tarPath
+}
+
+func TestUnpack(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []*tar.Header
+		wantErr bool
+		want    []string // 解压后应该存在的文件
+	}{
+		{
+			name: "layout",
+			headers: []*tar.Header{
+				{Name: "blobs", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "blobs/sha256/abc", Typeflag: tar.TypeReg},
+				{Name: "./index.json", Typeflag: tar.TypeReg},
+			},
+			want: []string{"blobs/sha256/abc", "index.json"},
+		},
+		{name: "parent", headers: []*tar.Header{{Name: "../evil", Typeflag: tar.TypeReg}}, wantErr: true},
+		{name: "nested parent", headers: []*tar.Header{{Name: "blobs/../../evil", Typeflag: tar.TypeReg}}, wantErr: true},
+		{name: "sibling prefix", headers: []*tar.Header{{Name: "../out-evil/file", Typeflag: tar.TypeReg}}, wantErr: true},
+		{name: "root", headers: []*tar.Header{{Name: ".", Typeflag: tar.TypeDir}}, wantErr: true},
+		{
+			name:    "absolute path stays in dir",
+			headers: []*tar.Header{{Name: "/blobs/sha256/abc", Typeflag: tar.TypeReg}},
+			want:    []string{"blobs/sha256/abc"},
+		},
+		{
+			name:    "symlink ignored",
+			headers: []*tar.Header{{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := t.TempDir()
+			dir := filepath.Join(base, "out")
+			err := Unpack(writeTar(t, tt.headers), dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unpack() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if _, err := os.Lstat(filepath.Join(base, "evil")); err == nil {
+				t.Error("file written outside dir")
+			}
+			if _, err := os.Lstat(filepath.Join(dir, "link")); err == nil {
+				t.Error("symlink should not be created")
+			}
+			for _, name := range tt.want {
+				data, err := os.ReadFile(filepath.Join(dir, name))
+				if err != nil || !strings.HasPrefix(string(data), "content of ") {
+					t.Errorf("file %s = %q,%v", name, data, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPackUnpack(t *testing.T) {
+	src := t.TempDir()
+	os.MkdirAll(filepath.Join(src, "blobs", "sha256"), 0755)
+	os.WriteFile(filepath.Join(src, "blobs", "sha256", "abc"), []byte("blob"), 0644)
+	os.WriteFile(filepath.Join(src, "index.json"), []byte("{}"), 0644)
+	os.WriteFile(filepath.Join(src, ".lock"), []byte("hidden"), 0644)
+	tarPath := filepath.Join(t.TempDir(), "images.tar")
+	if err := Pack(src, tarPath); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := Unpack(tarPath, dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"blobs/sha256/abc": "blob", "index.json": "{}"} {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != want {
+			t.Errorf("file %s = %q,%v, want %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".lock")); err == nil {
+		t.Error("hidden file should not be packed")
+	}
+}
@@ -0,0 +1,181 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-geminidb/model"
+	"image-sync/config"
+	"image-sync/dao"
+	"image-sync/registryserver"
+	"image-sync/secret"
+	"image-sync/update"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	ReportFile = "reconcile-report"
+
+	MissingInRegistry = "missing_in_registry" // image_metadata 中存在但镜像仓库中不存在
+	MissingInMetadata = "missing_in_metadata" // 镜像仓库中存在但 image_metadata 中不存在
+	SizeMismatch      = "size_mismatch"       // 两者记录的镜像大小不一致
+	CheckFailed       = "check_failed"        // 查询镜像仓库失败，无法判断
+)
+
+// Issue image_metadata 与镜像仓库不一致的一条记录
+type Issue struct {
+	Kind         string `json:"kind"`
+	Name         string `json:"name"`
+	Tag          string `json:"tag"`
+	MetadataSize int64  `json:"metadata_size,omitempty"`
+	RegistrySize int64  `json:"registry_size,omitempty"`
+	Fixed        bool   `json:"fixed"`
+	Error        string `json:"error,omitempty"`
+}
+
+// Reconcile 对比目标 AZ 的 image_metadata 与目标镜像仓库中实际存在的镜像，
+// 输出不一致的记录，配置 reconcileFix 时修复 image_metadata
+func Reconcile(authPath string) {
+	azId := config.IMConfig.TargetAzId
+	server := registryserver.Init(config.IMConfig.TargetRegistryAddr, authPath)
+
+	var metaList []model.ImageMetadata
+	err := dao.MySQL().Where("az_id = ?", azId).Find(&metaList)
+	if err != nil {
+		glog.Errorf("get image metadata failed,err:%v", secret.RedactError(err))
+		return
+	}
+	glog.Infof("start reconcile az %s,total image metadata:%d", azId, len(metaList))
+
+	var issues []Issue
+	metaMap := make(map[string]struct{}, len(metaList))
+	for _, meta := range metaList {
+		metaMap[meta.Name+":"+meta.Tag] = struct{}{}
+		size, err := getImageSize(server, meta.Name, meta.Tag)
+		switch {
+		case errors.Cause(err) == registryserver.ErrNotFound:
+			issues = append(issues, Issue{Kind: MissingInRegistry, Name: meta.Name, Tag: meta.Tag, MetadataSize: meta.Size})
+		case err != nil:
+			issues = append(issues, Issue{Kind: CheckFailed, Name: meta.Name, Tag: meta.Tag, Error: secret.Redact(err.Error())})
+		case size != meta.Size:
+			issues = append(issues, Issue{Kind: SizeMismatch, Name: meta.Name, Tag: meta.Tag, MetadataSize: meta.Size, RegistrySize: size})
+		}
+	}
+
+	// 反向遍历镜像仓库，找出没有元数据的镜像
+	registryIssues, err := findMissingInMetadata(server, metaMap)
+	if err != nil {
+		glog.Errorf("walk registry catalog failed,err:%v", secret.RedactError(err))
+	}
+	issues = append(issues, registryIssues...)
+
+	if config.IMConfig.ReconcileFix {
+		for i := range issues {
+			fixIssue(&issues[i], azId)
+		}
+	}
+	recordIssues(issues)
+}
+
+func findMissingInMetadata(server *registryserver.Server, metaMap map[string]struct{}) ([]Issue, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	repositories, err := server.ListRepositories(ctx)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	var issues []Issue
+	for _, repository := range repositories {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		tags, err := server.ListTags(ctx, repository)
+		cancel()
+		if err != nil {
+			glog.Warnf("list tags of %s failed,err:%v", repository, secret.RedactError(err))
+			continue
+		}
+		for _, tag := range tags {
+			if _, ok := metaMap[repository+":"+tag]; ok {
+				continue
+			}
+			size, err := getImageSize(server, repository, tag)
+			if err != nil {
+				issues = append(issues, Issue{Kind: CheckFailed, Name: repository, Tag: tag, Error: secret.Redact(err.Error())})
+				continue
+			}
+			issues = append(issues, Issue{Kind: MissingInMetadata, Name: repository, Tag: tag, RegistrySize: size})
+		}
+	}
+	return issues, nil
+}
+
+// getImageSize 查询镜像所有平台的 layer 大小之和，支持 OCI manifest 以及多平台镜像
+func getImageSize(server *registryserver.Server, name, tag string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	info, err := server.GetImageInfo(ctx, name, tag)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+// fixIssue 通过配置的元数据写入方式以镜像仓库为准修复 image_metadata，镜像仓库中的大小不是正数时不修复
+func fixIssue(issue *Issue, azId string) {
+	sink := update.GetSink()
+	var err error
+	switch issue.Kind {
+	case MissingInRegistry:
+		err = sink.Delete(azId, issue.Name, issue.Tag)
+	case MissingInMetadata, SizeMismatch:
+		if issue.RegistrySize <= 0 {
+			issue.Error = fmt.Sprintf("invalid registry size %d", issue.RegistrySize)
+			return
+		}
+		if issue.Kind == SizeMismatch {
+			err = sink.Update(update.ImageRegistration{AzId: azId, Name: issue.Name, Tag: issue.Tag, Size: &issue.RegistrySize})
+			break
+		}
+		imageMeta := update.NewTargetImageMeta(issue.Name, issue.Tag, issue.RegistrySize, azId)
+		var results []update.ImageResult
+		results, _, err = sink.Upsert([]model.ImageMetadata{imageMeta})
+		if err == nil && len(results) > 0 && results[0].Result == update.ResultFailed {
+			err = errors.New(results[0].Error)
+		}
+	default:
+		return
+	}
+	if err != nil {
+		issue.Error = secret.Redact(err.Error())
+		return
+	}
+	issue.Fixed = true
+}
+
+// recordIssues 输出不一致的记录，并写入 OutputPath 下的 reconcile-report 文件
+func recordIssues(issues []Issue) {
+	counts := make(map[string]int)
+	file, err := os.Create(path.Join(config.IMConfig.OutputPath, ReportFile))
+	if err != nil {
+		glog.Warnf("create reconcile report failed,err:%v", err)
+	} else {
+		defer file.Close()
+	}
+	for _, issue := range issues {
+		counts[issue.Kind]++
+		glog.Warn("image metadata drift", glog.String("kind", issue.Kind), glog.String("image", issue.Name+":"+issue.Tag),
+			glog.String("metadataSize", strconv.FormatInt(issue.MetadataSize, 10)),
+			glog.String("registrySize", strconv.FormatInt(issue.RegistrySize, 10)),
+			glog.String("fixed", strconv.FormatBool(issue.Fixed)), glog.String("error", issue.Error))
+		if file != nil {
+			data, _ := json.Marshal(issue)
+			file.Write(append(data, '\n'))
+		}
+	}
+	glog.Infof("reconcile finished,%s:%d,%s:%d,%s:%d,%s:%d", MissingInRegistry, counts[MissingInRegistry],
+		MissingInMetadata, counts[MissingInMetadata], SizeMismatch, counts[SizeMismatch], CheckFailed, counts[CheckFailed])
+}
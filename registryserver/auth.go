@@ -0,0 +1,110 @@
+package registryserver
+
+import (
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"gopkg.in/yaml.v3"
+	"image-sync/secret"
+	"os"
+	"path/filepath"
+)
+
+// LoadAuthConfig 读取 auth.yaml 并解析其中的密码引用，引用为 credential-helper 且未填写用户名时使用 helper 返回的用户名，
+// 文件不存在时返回空的配置
+func LoadAuthConfig(authPath string) (map[string]RegistryAuthInfo, error) {
+	config := make(map[string]RegistryAuthInfo)
+	dataBytes, err := os.ReadFile(authPath)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = yaml.Unmarshal(dataBytes, &config); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", authPath)
+	}
+	for addr, info := range config {
+		username, password, err := secret.Credentials(info.Password)
+		if err != nil {
+			return nil, errors.Wrapf(err, "resolve password of %s", addr)
+		}
+		if info.Username == "" {
+			info.Username = username
+		}
+		info.Password = password
+		secret.Register(password)
+		config[addr] = info
+	}
+	return config, nil
+}
+
+// ResolveAuthConfig 在 auth.yaml 的基础上，为没有填写用户名的镜像仓库补充 docker login 保存的凭据
+func ResolveAuthConfig(authPath string, registryAddrs ...string) (map[string]RegistryAuthInfo, error) {
+	config, err := LoadAuthConfig(authPath)
+	if err != nil {
+		return nil, err
+	}
+	dockerConfig, err := LoadDockerConfig()
+	if err != nil {
+		return nil, err
+	}
+	if dockerConfig == nil {
+		return config, nil
+	}
+	for _, addr := range registryAddrs {
+		info := config[addr]
+		if info.Username != "" {
+			continue
+		}
+		username, password, found, err := dockerConfig.Credentials(addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "get docker credentials of %s", addr)
+		}
+		if !found {
+			continue
+		}
+		info.Username, info.Password = username, password
+		config[addr] = info
+	}
+	return config, nil
+}
+
+// resolvedAuthPattern 解析后的 auth 文件名
+const resolvedAuthPattern = ".auth-resolved-*.yaml"
+
+// WriteResolvedAuthFile 把解析后的 auth.yaml 写入 dir 下只有当前用户可读写（0600）的临时文件，供 image-syncer 使用，
+// 调用方使用完后需要删除该文件
+func WriteResolvedAuthFile(dir, authPath string, registryAddrs ...string) (string, error) {
+	config, err := ResolveAuthConfig(authPath, registryAddrs...)
+	if err != nil {
+		return "", err
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	file, err := os.CreateTemp(dir, resolvedAuthPattern)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer file.Close()
+	if err = file.Chmod(0600); err != nil {
+		os.Remove(file.Name())
+		return "", errors.WithStack(err)
+	}
+	if _, err = file.Write(data); err != nil {
+		os.Remove(file.Name())
+		return "", errors.WithStack(err)
+	}
+	return file.Name(), nil
+}
+
+// RemoveResolvedAuthFiles 删除 dir 下之前的运行崩溃或者异常退出时留下的解析后的 auth 文件
+func RemoveResolvedAuthFiles(dir string) {
+	files, _ := filepath.Glob(filepath.Join(dir, resolvedAuthPattern))
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			glog.Warnf("remove resolved auth file %s failed,err:%v", file, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package registryserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// BlobExists 查询 repository 中是否已经存在 blob
+func (r *Server) BlobExists(ctx context.Context, imageName, digest string) (bool, error) {
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return false, err
+	}
+	resp, err := registryHttpRequest(r.addr+fmt.Sprintf("/v2/%s/blobs/%s", imageName, digest), http.MethodHead, token, ctx)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, errors.Errorf("head blob %s@%s status code %d", imageName, digest, resp.StatusCode)
+	}
+}
+
+// startUpload 创建 blob 上传会话，返回上传地址
+func (r *Server) startUpload(ctx context.Context, imageName, token string) (string, error) {
+	resp, err := registryHttpRequest(r.addr+fmt.Sprintf("/v2/%s/blobs/uploads/", imageName), http.MethodPost, token, ctx)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", errors.Errorf("start upload %s status code %d", imageName, resp.StatusCode)
+	}
+	return r.resolveLocation(resp.Header.Get("Location"))
+}
+
+// resolveLocation 上传地址可能是相对路径
+func (r *Server) resolveLocation(location string) (string, error) {
+	if location == "" {
+		return "", errors.New("upload location is empty")
+	}
+	base, err := url.Parse(r.addr + "/")
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+func withDigest(location, digest string) string {
+	separator := "?"
+	if strings.Contains(location, "?") {
+		separator = "&"
+	}
+	return location + separator + "digest=" + url.QueryEscape(digest)
+}
+
+// PutManifest 上传 manifest，reference 为 tag 或 digest，返回镜像仓库计算的 digest
+func (r *Server) PutManifest(ctx context.Context, imageName, reference, mediaType string, body []byte) (string, error) {
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPut, r.addr+fmt.Sprintf("/v2/%s/manifests/%s", imageName, reference), bytes.NewReader(body))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	setDefaultHttpHeader(req, token)
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := HttpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", errors.Errorf("put manifest %s:%s status code %d:%s", imageName, reference, resp.StatusCode, data)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = Digest(body)
+	}
+	return digest, nil
+}
@@ -0,0 +1,113 @@
+package registryserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"image-sync/secret"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DockerConfig docker login 写入的 ~/.docker/config.json 中与认证相关的部分
+type DockerConfig struct {
+	Auths       map[string]DockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+type DockerAuth struct {
+	Auth     string `json:"auth"` //base64(username:password)
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// dockerConfigPath 与 docker 命令一致，优先使用 DOCKER_CONFIG 环境变量指定的目录
+func dockerConfigPath() string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	return filepath.Join(dir, "config.json")
+}
+
+// LoadDockerConfig 读取 docker 的配置文件，文件不存在时返回 nil
+func LoadDockerConfig() (*DockerConfig, error) {
+	configPath := dockerConfigPath()
+	if configPath == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	dockerConfig := new(DockerConfig)
+	if err = json.Unmarshal(data, dockerConfig); err != nil {
+		return nil, errors.Wrapf(err, "parse %s", configPath)
+	}
+	return dockerConfig, nil
+}
+
+// Credentials 按照 docker 的顺序查找镜像仓库的凭据：credHelpers 中指定的 helper、auths 中保存的凭据、credsStore，
+// 没有凭据时返回 found 为 false
+func (c *DockerConfig) Credentials(registryAddr string) (username, password string, found bool, err error) {
+	host := normalizeRegistryHost(registryAddr)
+	if helper, ok := c.CredHelpers[host]; ok {
+		return helperCredentials(helper, host)
+	}
+	for key, auth := range c.Auths {
+		if normalizeRegistryHost(key) != host {
+			continue
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return "", "", false, errors.Wrapf(err, "decode auth of %s", key)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return "", "", false, errors.Errorf("invalid auth of %s", key)
+			}
+			secret.Register(parts[1])
+			return parts[0], parts[1], true, nil
+		}
+		if auth.Username != "" {
+			secret.Register(auth.Password)
+			return auth.Username, auth.Password, true, nil
+		}
+	}
+	if c.CredsStore != "" {
+		return helperCredentials(c.CredsStore, host)
+	}
+	return "", "", false, nil
+}
+
+func helperCredentials(helper, host string) (username, password string, found bool, err error) {
+	credentials, err := secret.GetHelperCredentials(helper, host)
+	if err != nil {
+		// helper 中没有该镜像仓库的凭据时视为未登录
+		if strings.Contains(err.Error(), "credentials not found") {
+			return "", "", false, nil
+		}
+		return "", "", false, err
+	}
+	return credentials.Username, credentials.Secret, true, nil
+}
+
+// normalizeRegistryHost 去掉 auths 中的协议与路径，例如 https://10.12.101.14:32402/v1/ 转换为 10.12.101.14:32402
+func normalizeRegistryHost(addr string) string {
+	addr = strings.TrimPrefix(addr, "https://")
+	addr = strings.TrimPrefix(addr, "http://")
+	if index := strings.Index(addr, "/"); index >= 0 {
+		addr = addr[:index]
+	}
+	return addr
+}
@@ -0,0 +1,110 @@
+package registryserver
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeHelper 按照 credential-helper 协议从标准输入读取镜像仓库地址，只有 helper.example 以及 store.example 有凭据
+const fakeHelper = `#!/bin/sh
+read server
+case "$server" in
+  helper.example|store.example) echo "{\"ServerURL\":\"$server\",\"Username\":\"fake-user\",\"Secret\":\"fake-secret-$server\"}" ;;
+  *) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+
+func setupDockerConfig(t *testing.T, dockerConfig string) {
+	binDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(binDir, "docker-credential-fake"), []byte(fakeHelper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	configDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(configDir, "config.json"), []byte(dockerConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOCKER_CONFIG", configDir)
+}
+
+func TestDockerConfigCredentials(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("auths-user:auths-pass"))
+	setupDockerConfig(t, `{
+  "credHelpers": {"helper.example": "fake", "missing.example": "fake"},
+  "auths": {
+    "helper.example": {"auth": "`+auth+`"},
+    "https://auths.example/v1/": {"auth": "`+auth+`"}
+  },
+  "credsStore": "fake"
+}`)
+	dockerConfig, err := LoadDockerConfig()
+	if err != nil || dockerConfig == nil {
+		t.Fatalf("LoadDockerConfig() = %v,%v", dockerConfig, err)
+	}
+	tests := []struct {
+		addr         string
+		wantUsername string
+		wantPassword string
+		wantFound    bool
+	}{
+		// credHelpers 优先于 auths
+		{addr: "helper.example", wantUsername: "fake-user", wantPassword: "fake-secret-helper.example", wantFound: true},
+		// credHelpers 中的 helper 没有凭据时不再查找 auths 以及 credsStore
+		{addr: "missing.example"},
+		// auths 中的地址去掉协议与路径后匹配
+		{addr: "auths.example", wantUsername: "auths-user", wantPassword: "auths-pass", wantFound: true},
+		// 都没有时使用 credsStore
+		{addr: "store.example", wantUsername: "fake-user", wantPassword: "fake-secret-store.example", wantFound: true},
+		{addr: "none.example"},
+	}
+	for _, tt := range tests {
+		username, password, found, err := dockerConfig.Credentials(tt.addr)
+		if err != nil {
+			t.Errorf("Credentials(%s) err = %v", tt.addr, err)
+			continue
+		}
+		if username != tt.wantUsername || password != tt.wantPassword || found != tt.wantFound {
+			t.Errorf("Credentials(%s) = %s,%s,%v, want %s,%s,%v", tt.addr, username, password, found,
+				tt.wantUsername, tt.wantPassword, tt.wantFound)
+		}
+	}
+}
+
+func TestResolveAuthConfig(t *testing.T) {
+	setupDockerConfig(t, `{"credsStore": "fake"}`)
+	authPath := filepath.Join(t.TempDir(), "auth.yaml")
+	err := os.WriteFile(authPath, []byte(`
+helper.example:
+  username: yaml-user
+  password: yaml-pass
+store.example:
+  insecure: true
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := ResolveAuthConfig(authPath, "helper.example", "store.example", "none.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// auth.yaml 中填写了 username 时不使用 docker 的凭据
+	if info := config["helper.example"]; info.Username != "yaml-user" || info.Password != "yaml-pass" {
+		t.Errorf("helper.example = %+v, want auth.yaml credentials", info)
+	}
+	if info := config["store.example"]; info.Username != "fake-user" || !info.Insecure {
+		t.Errorf("store.example = %+v, want helper credentials and insecure", info)
+	}
+	if info := config["none.example"]; info.Username != "" {
+		t.Errorf("none.example = %+v, want anonymous", info)
+	}
+
+	// auth.yaml 格式错误时返回错误，不降级为匿名访问
+	if err = os.WriteFile(authPath, []byte("helper.example: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ResolveAuthConfig(authPath, "helper.example"); err == nil {
+		t.Error("ResolveAuthConfig() with malformed auth.yaml should fail")
+	}
+}
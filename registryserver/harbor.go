@@ -0,0 +1,217 @@
+package registryserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ResourceStorage Harbor 配额中的存储大小，单位 B，-1 表示不限制
+const ResourceStorage = "storage"
+
+// Harbor 项目 metadata 中的字段，取值都是字符串
+const (
+	ProjectMetadataPublic      = "public"
+	ProjectMetadataRetentionId = "retention_id"
+)
+
+// ErrAlreadyExists Harbor 中已经存在同名的资源
+var ErrAlreadyExists = errors.New("already exists")
+
+// HarborClient 调用 Harbor 的管理接口（/api/v2.0），使用目标镜像仓库在 auth.yaml 中的凭据
+type HarborClient struct {
+	endpoint string
+	username string
+	password string
+}
+
+// ProjectSummary Harbor 项目概要中的配额信息
+type ProjectSummary struct {
+	RepoCount int           `json:"repo_count"`
+	Quota     *ProjectQuota `json:"quota,omitempty"`
+}
+
+// ProjectQuota 项目的配额以及已使用的大小，key 为资源类型，例如 storage
+type ProjectQuota struct {
+	Hard map[string]int64 `json:"hard"`
+	Used map[string]int64 `json:"used"`
+}
+
+// StorageLimit 项目的存储配额以及已使用的大小，没有配额时 hard 为 -1
+func (s *ProjectSummary) StorageLimit() (hard, used int64) {
+	if s.Quota == nil {
+		return -1, 0
+	}
+	hard, ok := s.Quota.Hard[ResourceStorage]
+	if !ok {
+		hard = -1
+	}
+	return hard, s.Quota.Used[ResourceStorage]
+}
+
+// HarborProject Harbor 中的项目
+type HarborProject struct {
+	ProjectId int64             `json:"project_id"`
+	Name      string            `json:"name"`
+	Metadata  map[string]string `json:"metadata"`
+}
+
+// Public 项目是否公开
+func (p *HarborProject) Public() bool {
+	return p.Metadata[ProjectMetadataPublic] == "true"
+}
+
+// RetentionId 项目的保留策略ID，没有保留策略时为 0
+func (p *HarborProject) RetentionId() int64 {
+	id, _ := strconv.ParseInt(p.Metadata[ProjectMetadataRetentionId], 10, 64)
+	return id
+}
+
+// ProjectReq 创建项目的请求，StorageLimit 为空时使用 Harbor 的默认配额
+type ProjectReq struct {
+	ProjectName  string            `json:"project_name"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+	StorageLimit *int64            `json:"storage_limit,omitempty"`
+}
+
+// RetentionPolicy 项目的 tag 保留策略，rules、trigger 原样复制，不关心其中的内容
+type RetentionPolicy struct {
+	Id        int64           `json:"id,omitempty"`
+	Algorithm string          `json:"algorithm"`
+	Rules     json.RawMessage `json:"rules"`
+	Trigger   json.RawMessage `json:"trigger"`
+	Scope     RetentionScope  `json:"scope"`
+}
+
+// RetentionScope 保留策略的作用范围，level 为 project 时 ref 为项目ID
+type RetentionScope struct {
+	Level string `json:"level"`
+	Ref   int64  `json:"ref"`
+}
+
+// NewHarborClient endpoint 为 Harbor 的地址，例如 https://10.12.101.13:32402，
+// registryAddr 用于从 auth.yaml、docker 的 config.json 中查找凭据
+func NewHarborClient(endpoint, registryAddr, authPath string) *HarborClient {
+	InitHttpClient()
+	username, password := getRegistryAuthInfo(registryAddr, authPath)
+	return &HarborClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		username: username,
+		password: password,
+	}
+}
+
+// ProjectSummary 查询项目的概要信息，项目不存在时返回 ErrNotFound
+func (c *HarborClient) ProjectSummary(ctx context.Context, project string) (*ProjectSummary, error) {
+	summary := new(ProjectSummary)
+	if err := c.get(ctx, fmt.Sprintf("/api/v2.0/projects/%s/summary", url.PathEscape(project)), summary); err != nil {
+		return nil, errors.Wrapf(err, "get summary of project %s", project)
+	}
+	return summary, nil
+}
+
+// GetProject 查询项目，项目不存在时返回 ErrNotFound
+func (c *HarborClient) GetProject(ctx context.Context, project string) (*HarborProject, error) {
+	result := new(HarborProject)
+	if err := c.get(ctx, "/api/v2.0/projects/"+url.PathEscape(project), result); err != nil {
+		return nil, errors.Wrapf(err, "get project %s", project)
+	}
+	return result, nil
+}
+
+// CreateProject 创建项目，项目已经存在时返回 ErrAlreadyExists
+func (c *HarborClient) CreateProject(ctx context.Context, project ProjectReq) error {
+	if _, err := c.post(ctx, "/api/v2.0/projects", project); err != nil {
+		return errors.Wrapf(err, "create project %s", project.ProjectName)
+	}
+	return nil
+}
+
+// DeleteProject 删除项目，项目中不能有 repository
+func (c *HarborClient) DeleteProject(ctx context.Context, project string) error {
+	resp, err := c.do(ctx, http.MethodDelete, "/api/v2.0/projects/"+url.PathEscape(project), nil)
+	if err != nil {
+		return errors.Wrapf(err, "delete project %s", project)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errors.WithStack(ErrNotFound)
+	default:
+		return errors.Errorf("delete project %s status code %d", project, resp.StatusCode)
+	}
+}
+
+// GetRetention 查询保留策略
+func (c *HarborClient) GetRetention(ctx context.Context, id int64) (*RetentionPolicy, error) {
+	result := new(RetentionPolicy)
+	if err := c.get(ctx, fmt.Sprintf("/api/v2.0/retentions/%d", id), result); err != nil {
+		return nil, errors.Wrapf(err, "get retention %d", id)
+	}
+	return result, nil
+}
+
+// CreateRetention 创建保留策略并关联到 scope 中的项目，返回新策略的ID
+func (c *HarborClient) CreateRetention(ctx context.Context, policy RetentionPolicy) (int64, error) {
+	policy.Id = 0
+	location, err := c.post(ctx, "/api/v2.0/retentions", policy)
+	if err != nil {
+		return 0, errors.Wrapf(err, "create retention for project %d", policy.Scope.Ref)
+	}
+	id, _ := strconv.ParseInt(path.Base(location), 10, 64)
+	return id, nil
+}
+
+func (c *HarborClient) get(ctx context.Context, apiPath string, result interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, apiPath, nil)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, result)
+}
+
+// post 创建资源，返回 Location header 中新资源的地址
+func (c *HarborClient) post(ctx context.Context, apiPath string, body interface{}) (string, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	resp, err := c.do(ctx, http.MethodPost, apiPath, data)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusOK:
+		return resp.Header.Get("Location"), nil
+	case http.StatusConflict:
+		return "", errors.WithStack(ErrAlreadyExists)
+	default:
+		return "", errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+}
+
+func (c *HarborClient) do(ctx context.Context, method, apiPath string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.endpoint+apiPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := HttpClient.Do(req.WithContext(ctx))
+	return resp, errors.WithStack(err)
+}
@@ -8,7 +8,17 @@ import (
 
 var HttpClient *http.Client
 
+// BlobHttpClient 用于传输 blob，不限制单次请求的总时间
+var BlobHttpClient *http.Client
+
 func InitHttpClient() {
+	BlobHttpClient = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+			MaxIdleConns:          20,
+			ResponseHeaderTimeout: time.Minute,
+		},
+	}
 	HttpClient = &http.Client{
 		Timeout: 20 * time.Second,
 		Transport: func() *http.Transport {
@@ -0,0 +1,246 @@
+package registryserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Size        int64             `json:"size"`
+	Digest      string            `json:"digest"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// MatchPlatform platform 是否与 platforms 中的某一个一致，格式为 os/arch[/variant]，
+// 任意一方没有 variant 时只比较 os、arch，platforms 为空时全部匹配
+func MatchPlatform(platform string, platforms []string) bool {
+	if len(platforms) == 0 {
+		return true
+	}
+	os, arch, variant := splitPlatform(platform)
+	for _, pattern := range platforms {
+		patternOS, patternArch, patternVariant := splitPlatform(pattern)
+		if os != patternOS || arch != patternArch {
+			continue
+		}
+		if variant == "" || patternVariant == "" || variant == patternVariant {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterManifests 返回 index 中平台与 platforms 匹配的 manifest，没有平台信息的 manifest（例如 attestation）不会被选中，
+// platforms 为空时返回全部
+func FilterManifests(manifests []Descriptor, platforms []string) []Descriptor {
+	if len(platforms) == 0 {
+		return manifests
+	}
+	var result []Descriptor
+	for _, manifest := range manifests {
+		if manifest.Platform != nil && MatchPlatform(manifest.Platform.String(), platforms) {
+			result = append(result, manifest)
+		}
+	}
+	return result
+}
+
+// RewriteIndex 把 index 中的 manifests 替换为 children，保留 annotations 等其他字段
+func RewriteIndex(body []byte, children []Descriptor) ([]byte, error) {
+	index := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	manifests, err := json.Marshal(children)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	index["manifests"] = manifests
+	body, err = json.Marshal(index)
+	return body, errors.WithStack(err)
+}
+
+func splitPlatform(platform string) (os, arch, variant string) {
+	parts := strings.SplitN(platform, "/", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// Manifest 同时兼容单平台 manifest 以及多平台 index（manifest list）
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        *Descriptor  `json:"config,omitempty"`
+	Layers        []Descriptor `json:"layers,omitempty"`
+	Manifests     []Descriptor `json:"manifests,omitempty"`
+}
+
+func IsIndexMediaType(mediaType string) bool {
+	return mediaType == MediaTypeDockerManifestList || mediaType == MediaTypeOCIIndex
+}
+
+// ImageConfig 镜像 config blob 中需要记录的字段
+type ImageConfig struct {
+	Created      time.Time `json:"created"`
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	Variant      string    `json:"variant,omitempty"`
+	Config       struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// ImageInfo 镜像仓库中镜像的详细信息
+type ImageInfo struct {
+	Digest    string
+	MediaType string
+	Size      int64 // 所有平台的 layer 大小之和
+	Platforms []string
+	Created   time.Time
+	Labels    map[string]string
+}
+
+// GetManifest 查询 manifest 原始内容，返回内容、类型以及 digest
+func (r *Server) GetManifest(ctx context.Context, imageName, reference string) (body []byte, mediaType, digest string, err error) {
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return nil, "", "", err
+	}
+	url := r.addr + fmt.Sprintf("/v2/%s/manifests/%s", imageName, reference)
+	resp, err := manifestHttpRequest(url, http.MethodGet, token, ctx)
+	if err != nil {
+		return nil, "", "", errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, "", "", errors.WithStack(ErrNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", "", errors.Errorf("get manifest %s:%s status code %d", imageName, reference, resp.StatusCode)
+	}
+	body, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", "", errors.WithStack(err)
+	}
+	mediaType = strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	digest = resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		digest = Digest(body)
+	}
+	return body, mediaType, digest, nil
+}
+
+// GetImageConfig 查询镜像的 config blob
+func (r *Server) GetImageConfig(ctx context.Context, imageName, digest string) (*ImageConfig, error) {
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return nil, err
+	}
+	url := r.addr + fmt.Sprintf("/v2/%s/blobs/%s", imageName, digest)
+	resp, err := registryHttpRequest(url, http.MethodGet, token, ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	imageConfig := new(ImageConfig)
+	if err = decodeResponse(resp, imageConfig); err != nil {
+		return nil, err
+	}
+	return imageConfig, nil
+}
+
+// GetImageInfo 查询镜像的 digest、类型、平台、创建时间以及 label，多平台镜像会查询每个平台的 manifest
+func (r *Server) GetImageInfo(ctx context.Context, imageName, reference string) (*ImageInfo, error) {
+	body, mediaType, digest, err := r.GetManifest(ctx, imageName, reference)
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(Manifest)
+	if err = json.Unmarshal(body, manifest); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if mediaType == "" {
+		mediaType = manifest.MediaType
+	}
+	info := &ImageInfo{Digest: digest, MediaType: mediaType}
+	if !IsIndexMediaType(mediaType) {
+		if err = r.fillImageInfo(ctx, imageName, manifest, info); err != nil {
+			return nil, err
+		}
+		return info, nil
+	}
+	for _, child := range manifest.Manifests {
+		childBody, _, _, err := r.GetManifest(ctx, imageName, child.Digest)
+		if err != nil {
+			return nil, err
+		}
+		childManifest := new(Manifest)
+		if err = json.Unmarshal(childBody, childManifest); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if err = r.fillImageInfo(ctx, imageName, childManifest, info); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// fillImageInfo 累加单平台 manifest 的大小，并记录平台、创建时间以及 label
+func (r *Server) fillImageInfo(ctx context.Context, imageName string, manifest *Manifest, info *ImageInfo) error {
+	for _, layer := range manifest.Layers {
+		info.Size += layer.Size
+	}
+	if manifest.Config == nil {
+		return nil
+	}
+	imageConfig, err := r.GetImageConfig(ctx, imageName, manifest.Config.Digest)
+	if err != nil {
+		return err
+	}
+	platform := Platform{OS: imageConfig.OS, Architecture: imageConfig.Architecture, Variant: imageConfig.Variant}
+	info.Platforms = append(info.Platforms, platform.String())
+	if info.Created.Before(imageConfig.Created) {
+		info.Created = imageConfig.Created
+	}
+	if info.Labels == nil && len(imageConfig.Config.Labels) > 0 {
+		info.Labels = imageConfig.Config.Labels
+	}
+	return nil
+}
+
+// Digest 计算内容的 sha256 digest
+func Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
@@ -6,8 +6,18 @@ import (
 	"fmt"
 	"github.com/pkg/errors"
 	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/secret"
 	"io"
 	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound 镜像仓库中不存在对应的镜像
+	ErrNotFound = errors.New("not found")
+	// ErrDigestInvalid 上传的内容与 blob 的 digest 不一致
+	ErrDigestInvalid = errors.New("digest invalid")
 )
 
 type Server struct {
@@ -51,20 +61,20 @@ func (r *Server) GetImageDetail(
 
 	imageName := projectName + "/" + repoName
 	url := r.addr + "/v2" + fmt.Sprintf("/%s/manifests/%s", imageName, tag)
-	var token string
-	if r.authServer != "" {
-		token, err = r.getToken(getScope(imageName))
-		if err != nil {
-			glog.Errorf("get token error, err:%s", err.Error())
-			return 0, errors.WithStack(err)
-		}
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return 0, err
 	}
 
 	resp, err := registryHttpRequest(url, http.MethodGet, token, ctx)
 	if err != nil {
-		glog.Errorf("url:%s, err:%s", url)
+		glog.Errorf("url:%s, err:%s", url, err.Error())
 		return 0, errors.WithStack(err)
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return 0, errors.WithStack(ErrNotFound)
+	}
 	if resp.StatusCode != http.StatusOK {
 		return 0, errors.New("query not ok")
 	}
@@ -80,6 +90,151 @@ func (r *Server) GetImageDetail(
 	return totalSize, nil
 }
 
+// GetManifestDigest 查询 tag 对应的 manifest digest
+func (r *Server) GetManifestDigest(ctx context.Context, imageName, reference string) (string, error) {
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return "", err
+	}
+	url := r.addr + fmt.Sprintf("/v2/%s/manifests/%s", imageName, reference)
+	resp, err := manifestHttpRequest(url, http.MethodHead, token, ctx)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", errors.WithStack(ErrNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("head manifest %s:%s status code %d", imageName, reference, resp.StatusCode)
+	}
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", errors.Errorf("manifest %s:%s has no digest", imageName, reference)
+	}
+	return digest, nil
+}
+
+// DeleteManifest 删除 tag 或 digest 对应的 manifest，删除 manifest 会同时删除指向它的所有 tag
+func (r *Server) DeleteManifest(ctx context.Context, imageName, reference string) error {
+	digest := reference
+	if !strings.HasPrefix(reference, "sha256:") {
+		var err error
+		digest, err = r.GetManifestDigest(ctx, imageName, reference)
+		if err != nil {
+			return err
+		}
+	}
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return err
+	}
+	url := r.addr + fmt.Sprintf("/v2/%s/manifests/%s", imageName, digest)
+	resp, err := registryHttpRequest(url, http.MethodDelete, token, ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errors.WithStack(ErrNotFound)
+	default:
+		return errors.Errorf("delete manifest %s@%s status code %d", imageName, digest, resp.StatusCode)
+	}
+}
+
+// ListRepositories 通过 catalog 接口分页查询镜像仓库中的所有 repository
+func (r *Server) ListRepositories(ctx context.Context) ([]string, error) {
+	token, err := r.token(catalogScope)
+	if err != nil {
+		return nil, err
+	}
+	var repositories []string
+	next := "/v2/_catalog?n=1000"
+	for next != "" {
+		url := next
+		if !strings.HasPrefix(next, "http") {
+			url = r.addr + next
+		}
+		resp, err := registryHttpRequest(url, http.MethodGet, token, ctx)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		var catalog struct {
+			Repositories []string `json:"repositories"`
+		}
+		err = decodeResponse(resp, &catalog)
+		if err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, catalog.Repositories...)
+		next = getNextLink(resp.Header.Get("Link"))
+	}
+	return repositories, nil
+}
+
+// ListTags 查询 repository 下的所有 tag
+func (r *Server) ListTags(ctx context.Context, imageName string) ([]string, error) {
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return nil, err
+	}
+	resp, err := registryHttpRequest(r.addr+fmt.Sprintf("/v2/%s/tags/list", imageName), http.MethodGet, token, ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var tagList struct {
+		Tags []string `json:"tags"`
+	}
+	if err = decodeResponse(resp, &tagList); err != nil {
+		return nil, err
+	}
+	return tagList.Tags, nil
+}
+
+// KeptDigests 查询 repository 中除 removing 之外的 tag 指向的 manifest digest，返回 digest 到 tag 的映射，
+// 删除 manifest 会同时删除指向它的所有 tag，删除前用于跳过仍被其他 tag 引用的 manifest，repository 不存在时返回空
+func (r *Server) KeptDigests(repository string, removing map[string]struct{}) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	tags, err := r.ListTags(ctx, repository)
+	cancel()
+	if errors.Cause(err) == ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[string]string)
+	for _, tag := range tags {
+		if _, ok := removing[tag]; ok {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		digest, err := r.GetManifestDigest(ctx, repository, tag)
+		cancel()
+		if err != nil {
+			return nil, errors.Wrapf(err, "get digest of kept tag %s:%s", repository, tag)
+		}
+		kept[digest] = tag
+	}
+	return kept, nil
+}
+
+// token 镜像仓库开启认证时获取对应 scope 的 token，未开启认证时返回空
+func (r *Server) token(scope string) (string, error) {
+	if r.authServer == "" {
+		return "", nil
+	}
+	token, err := r.getToken(scope)
+	if err != nil {
+		glog.Errorf("get token error, err:%s", secret.Redact(err.Error()))
+		return "", errors.WithStack(err)
+	}
+	return token, nil
+}
+
 func (r *Server) getToken(scope string) (string, error) {
 	// request auth server get token
 	// example pullRequest 	http://10.12.10.149/service/token?account=daijun&scope=repository:djdemo/myds:pull&service=harbor-registry
@@ -0,0 +1,178 @@
+// Package standin 提供 Harbor 管理接口的本地替身，用于测试目标项目的容量检查以及创建项目，数据只保存在内存中
+package standin
+
+import (
+	"encoding/json"
+	"fmt"
+	"image-sync/registryserver"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	projectsPath   = "/api/v2.0/projects"
+	retentionsPath = "/api/v2.0/retentions"
+	standinPrefix  = "/standin/projects/"
+)
+
+// Project 替身中的项目，Hard 为 -1 表示不限制存储
+type Project struct {
+	ProjectId int64             `json:"project_id"`
+	Name      string            `json:"name"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	RepoCount int               `json:"repo_count"`
+	Hard      int64             `json:"hard"`
+	Used      int64             `json:"used"`
+}
+
+type Server struct {
+	lock       sync.Mutex
+	projects   map[string]*Project
+	retentions map[int64]registryserver.RetentionPolicy
+	nextId     int64
+}
+
+func NewServer() *Server {
+	return &Server{projects: make(map[string]*Project), retentions: make(map[int64]registryserver.RetentionPolicy)}
+}
+
+// ServeHTTP 支持的接口
+//
+//	GET  /api/v2.0/projects/{name}          与 Harbor 相同，返回项目以及 metadata
+//	GET  /api/v2.0/projects/{name}/summary  与 Harbor 相同，返回项目的配额
+//	POST /api/v2.0/projects                 与 Harbor 相同，创建项目，已存在时返回 409
+//	DELETE /api/v2.0/projects/{name}        与 Harbor 相同，删除项目
+//	GET  /api/v2.0/retentions/{id}          与 Harbor 相同，返回保留策略
+//	POST /api/v2.0/retentions               与 Harbor 相同，创建保留策略并写入项目的 retention_id
+//	PUT  /standin/projects/{name}           替身专用，写入项目的配额以及已使用的大小，body 为 {"hard":n,"used":n,"metadata":{}}
+//	GET  /standin/projects/                 替身专用，查看所有项目
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch {
+	case r.URL.Path == projectsPath && r.Method == http.MethodPost:
+		s.createProject(w, r)
+	case strings.HasPrefix(r.URL.Path, projectsPath+"/") && r.Method == http.MethodGet:
+		name := strings.TrimPrefix(r.URL.Path, projectsPath+"/")
+		project, ok := s.projects[strings.TrimSuffix(name, "/summary")]
+		if !ok {
+			http.Error(w, `{"errors":[{"code":"NOT_FOUND","message":"project not found"}]}`, http.StatusNotFound)
+			return
+		}
+		if !strings.HasSuffix(name, "/summary") {
+			writeJson(w, project)
+			return
+		}
+		writeJson(w, registryserver.ProjectSummary{
+			RepoCount: project.RepoCount,
+			Quota: &registryserver.ProjectQuota{
+				Hard: map[string]int64{registryserver.ResourceStorage: project.Hard},
+				Used: map[string]int64{registryserver.ResourceStorage: project.Used},
+			},
+		})
+	case strings.HasPrefix(r.URL.Path, projectsPath+"/") && r.Method == http.MethodDelete:
+		name := strings.TrimPrefix(r.URL.Path, projectsPath+"/")
+		if _, ok := s.projects[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(s.projects, name)
+	case r.URL.Path == retentionsPath && r.Method == http.MethodPost:
+		s.createRetention(w, r)
+	case strings.HasPrefix(r.URL.Path, retentionsPath+"/") && r.Method == http.MethodGet:
+		id, _ := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, retentionsPath+"/"), 10, 64)
+		policy, ok := s.retentions[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJson(w, policy)
+	case strings.HasPrefix(r.URL.Path, standinPrefix) && r.Method == http.MethodPut:
+		project := &Project{Hard: -1}
+		if err := json.NewDecoder(r.Body).Decode(project); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		project.Name = strings.TrimPrefix(r.URL.Path, standinPrefix)
+		if project.Name == "" {
+			http.Error(w, "project name is required", http.StatusBadRequest)
+			return
+		}
+		if exist, ok := s.projects[project.Name]; ok {
+			project.ProjectId = exist.ProjectId
+		} else {
+			project.ProjectId = s.newId()
+		}
+		s.projects[project.Name] = project
+		writeJson(w, project)
+	case r.URL.Path == standinPrefix && r.Method == http.MethodGet:
+		projects := make([]*Project, 0, len(s.projects))
+		for _, project := range s.projects {
+			projects = append(projects, project)
+		}
+		writeJson(w, projects)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (s *Server) createProject(w http.ResponseWriter, r *http.Request) {
+	var req registryserver.ProjectReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ProjectName == "" {
+		http.Error(w, "project_name is required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := s.projects[req.ProjectName]; ok {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	project := &Project{ProjectId: s.newId(), Name: req.ProjectName, Metadata: req.Metadata, Hard: -1}
+	if project.Metadata == nil {
+		project.Metadata = make(map[string]string)
+	}
+	if req.StorageLimit != nil {
+		project.Hard = *req.StorageLimit
+	}
+	s.projects[project.Name] = project
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", projectsPath, project.ProjectId))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// createRetention 与 Harbor 一样，保留策略创建后写入 scope 中项目的 retention_id
+func (s *Server) createRetention(w http.ResponseWriter, r *http.Request) {
+	var policy registryserver.RetentionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var project *Project
+	for _, current := range s.projects {
+		if current.ProjectId == policy.Scope.Ref {
+			project = current
+		}
+	}
+	if policy.Scope.Level != "project" || project == nil {
+		http.Error(w, "scope must be an existing project", http.StatusBadRequest)
+		return
+	}
+	policy.Id = s.newId()
+	s.retentions[policy.Id] = policy
+	if project.Metadata == nil {
+		project.Metadata = make(map[string]string)
+	}
+	project.Metadata[registryserver.ProjectMetadataRetentionId] = strconv.FormatInt(policy.Id, 10)
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", retentionsPath, policy.Id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) newId() int64 {
+	s.nextId++
+	return s.nextId
+}
+
+func writeJson(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
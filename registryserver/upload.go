@@ -0,0 +1,182 @@
+package registryserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// StartUpload 创建 blob 上传会话，返回上传地址，分块上传以及断点续传都基于该地址
+func (r *Server) StartUpload(ctx context.Context, imageName string) (string, error) {
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return "", err
+	}
+	return r.startUpload(ctx, imageName, token)
+}
+
+// UploadOffset 查询上传会话中镜像仓库已经确认的字节数，会话过期时返回 ErrNotFound
+func (r *Server) UploadOffset(ctx context.Context, imageName, location string) (string, int64, error) {
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return "", 0, err
+	}
+	resp, err := registryHttpRequest(location, http.MethodGet, token, ctx)
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+	case http.StatusNotFound:
+		return "", 0, errors.WithStack(ErrNotFound)
+	default:
+		return "", 0, errors.Errorf("get upload status %s status code %d", imageName, resp.StatusCode)
+	}
+	return r.uploadProgress(resp, location)
+}
+
+// PatchChunk 上传从 offset 开始的 size 个字节，返回新的上传地址以及已确认的字节数
+func (r *Server) PatchChunk(ctx context.Context, imageName, location string, offset, size int64, reader io.Reader) (string, int64, error) {
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return "", 0, err
+	}
+	req, err := http.NewRequest(http.MethodPatch, location, reader)
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	setDefaultHttpHeader(req, token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+size-1))
+	req.ContentLength = size
+	resp, err := BlobHttpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusNoContent:
+	case http.StatusNotFound:
+		return "", 0, errors.WithStack(ErrNotFound)
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", 0, errors.Errorf("patch blob %s status code %d:%s", imageName, resp.StatusCode, body)
+	}
+	return r.uploadProgress(resp, location)
+}
+
+// CompleteUpload 所有分块上传完成后提交 blob，镜像仓库会校验 digest
+func (r *Server) CompleteUpload(ctx context.Context, imageName, location, digest string) error {
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, withDigest(location, digest), http.NoBody)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	setDefaultHttpHeader(req, token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := BlobHttpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusBadRequest && strings.Contains(string(body), "DIGEST_INVALID") {
+			return errors.Wrapf(ErrDigestInvalid, "complete upload %s@%s:%s", imageName, digest, body)
+		}
+		return errors.Errorf("complete upload %s@%s status code %d:%s", imageName, digest, resp.StatusCode, body)
+	}
+	return nil
+}
+
+// uploadProgress 解析上传接口返回的 Location 以及 Range，Range 为已确认的字节区间，例如 0-1023
+func (r *Server) uploadProgress(resp *http.Response, location string) (string, int64, error) {
+	if next := resp.Header.Get("Location"); next != "" {
+		var err error
+		if location, err = r.resolveLocation(next); err != nil {
+			return "", 0, err
+		}
+	}
+	uploadRange := resp.Header.Get("Range")
+	if uploadRange == "" {
+		return location, 0, nil
+	}
+	uploadRange = strings.TrimPrefix(uploadRange, "bytes=")
+	parts := strings.SplitN(uploadRange, "-", 2)
+	if len(parts) != 2 {
+		return "", 0, errors.Errorf("invalid upload range %q", uploadRange)
+	}
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "invalid upload range %q", uploadRange)
+	}
+	return location, end + 1, nil
+}
+
+// GetBlobFrom 从 offset 开始下载 blob，镜像仓库不支持 Range 时跳过前面的内容
+func (r *Server) GetBlobFrom(ctx context.Context, imageName, digest string, offset int64) (io.ReadCloser, error) {
+	token, err := r.token(getScope(imageName))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, r.addr+fmt.Sprintf("/v2/%s/blobs/%s", imageName, digest), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	setDefaultHttpHeader(req, token)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := BlobHttpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		if _, err = io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, errors.WithStack(err)
+		}
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errors.WithStack(ErrNotFound)
+	default:
+		resp.Body.Close()
+		return nil, errors.Errorf("get blob %s@%s status code %d", imageName, digest, resp.StatusCode)
+	}
+}
+
+// MountBlob 把 fromRepo 中已有的 blob 挂载到 imageName，不需要重新上传，
+// 镜像仓库不支持或者无法挂载时返回 false，此时镜像仓库创建的上传会话会在过期后自动清理
+func (r *Server) MountBlob(ctx context.Context, imageName, digest, fromRepo string) (bool, error) {
+	// 挂载需要同时拥有两个 repository 的权限，token 接口支持多个 scope 参数
+	token, err := r.token(getScope(imageName) + "&scope=repository:" + fromRepo + ":pull")
+	if err != nil {
+		return false, err
+	}
+	url := r.addr + fmt.Sprintf("/v2/%s/blobs/uploads/?mount=%s&from=%s", imageName, digest, fromRepo)
+	resp, err := registryHttpRequest(url, http.MethodPost, token, ctx)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		return false, nil
+	default:
+		return false, errors.Errorf("mount blob %s from %s status code %d", digest, fromRepo, resp.StatusCode)
+	}
+}
@@ -3,32 +3,40 @@ package registryserver
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"github.com/pkg/errors"
 	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
-	"gopkg.in/yaml.v3"
+	"image-sync/secret"
 	"net/http"
-	"os"
 	"strings"
 )
 
+const catalogScope = "registry:catalog:*"
+
+// manifestMediaTypes 查询 manifest digest 时接受的所有 manifest 类型，保证返回的 digest 与镜像仓库中存储的一致
+var manifestMediaTypes = []string{
+	MediaTypeDockerManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeOCIManifest,
+	MediaTypeOCIIndex,
+}
+
 func getScope(imageName string) string {
 	return "repository:" + imageName + ":pull,push,delete"
 }
 
 type RegistryAuthInfo struct {
-	Username string
-	Password string
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"` //支持 env:VAR、file:/path、helper:<helper>:<serverURL> 形式的引用
+	Insecure bool   `yaml:"insecure,omitempty"`
 }
 
+// getRegistryAuthInfo auth.yaml 格式错误、密码引用或者 docker 凭据解析失败时退出，只有没有任何凭据时才匿名访问
 func getRegistryAuthInfo(registryAddr string, authPath string) (username, password string) {
-	dataBytes, err := os.ReadFile(authPath)
-	if err != nil {
-		glog.Fatal(err.Error())
-	}
-	config := make(map[string]RegistryAuthInfo)
-	err = yaml.Unmarshal(dataBytes, &config)
+	config, err := ResolveAuthConfig(authPath, registryAddr)
 	if err != nil {
-		glog.Fatal(err.Error())
+		glog.Fatal(secret.Redact(err.Error()))
 	}
 	return config[registryAddr].Username, config[registryAddr].Password
 }
@@ -48,6 +56,42 @@ func registryHttpRequest(url, method, token string, ctx context.Context) (*http.
 	return response, nil
 }
 
+// decodeResponse 解析接口返回的 json，404 时返回 ErrNotFound
+func decodeResponse(resp *http.Response, result interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errors.WithStack(ErrNotFound)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(result))
+}
+
+// getNextLink 解析分页接口返回的 Link header，例如 </v2/_catalog?last=a&n=1000>; rel="next"
+func getNextLink(link string) string {
+	if !strings.Contains(link, `rel="next"`) {
+		return ""
+	}
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start < 0 || end < start {
+		return ""
+	}
+	return link[start+1 : end]
+}
+
+// manifestHttpRequest 请求 manifest 接口，Accept 中包含所有 manifest 类型
+func manifestHttpRequest(url, method, token string, ctx context.Context) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	setDefaultHttpHeader(req, token)
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ","))
+	return HttpClient.Do(req.WithContext(ctx))
+}
+
 func setDefaultHttpHeader(req *http.Request, token string) {
 	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
@@ -0,0 +1,270 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/blobcache"
+	"image-sync/registryserver"
+	"image-sync/secret"
+	"io"
+	"time"
+)
+
+const (
+	DefaultChunkSize = 64 << 20
+	// blobRetries 单个 blob 上传失败后的重试次数，每次重试都从镜像仓库已确认的位置继续
+	blobRetries = 3
+)
+
+// BlobSource 返回从 offset 开始的 blob 内容
+type BlobSource func(ctx context.Context, offset int64) (io.ReadCloser, error)
+
+// Copier 内置的镜像复制，blob 使用分块上传，上传会话持久化后可以在失败或者重启后断点续传
+type Copier struct {
+	source    *registryserver.Server
+	target    *registryserver.Server
+	targetKey string
+	sessions  *SessionStore
+	chunkSize int64
+	wrap      func(reader io.Reader) io.Reader
+	tracker   *blobTracker
+	cache     *blobcache.Cache
+	// platforms 多平台镜像只复制这些平台，空表示全部复制
+	platforms   []string
+	filterIndex bool
+}
+
+// NewCopier source 为空时只能用于 UploadBlob，wrap 用于限制带宽，可以为空
+func NewCopier(source, target *registryserver.Server, targetAddr string, sessions *SessionStore,
+	chunkSize int64, wrap func(reader io.Reader) io.Reader) *Copier {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if wrap == nil {
+		wrap = func(reader io.Reader) io.Reader { return reader }
+	}
+	return &Copier{
+		source:    source,
+		target:    target,
+		targetKey: targetAddr,
+		sessions:  sessions,
+		chunkSize: chunkSize,
+		wrap:      wrap,
+		tracker:   newBlobTracker(),
+	}
+}
+
+// SetCache 设置本地 blob 缓存，从源镜像仓库读取的 blob 先保存到缓存再上传
+func (c *Copier) SetCache(cache *blobcache.Cache) {
+	c.cache = cache
+}
+
+// SetPlatforms 设置多平台镜像需要复制的平台，filterIndex 为 true 时推送只包含这些平台的 index，
+// 否则只匹配一个平台时直接把该平台的 manifest 推送到 tag
+func (c *Copier) SetPlatforms(platforms []string, filterIndex bool) {
+	c.platforms, c.filterIndex = platforms, filterIndex
+}
+
+// CopyImage 把源镜像仓库中 sourceReference（tag 或 digest）对应的镜像复制到目标镜像仓库同名 repository 的 tag，
+// 多平台镜像会复制每个匹配的平台，返回目标镜像仓库中 manifest 的 digest
+func (c *Copier) CopyImage(ctx context.Context, imageName, sourceReference, tag string) (string, error) {
+	return c.copyManifest(ctx, imageName, sourceReference, tag)
+}
+
+// copyManifest 复制源镜像仓库中 sourceReference 对应的 manifest，推送到目标镜像仓库的 targetReference
+func (c *Copier) copyManifest(ctx context.Context, imageName, sourceReference, targetReference string) (string, error) {
+	body, mediaType, _, err := c.source.GetManifest(ctx, imageName, sourceReference)
+	if err != nil {
+		return "", err
+	}
+	manifest := new(registryserver.Manifest)
+	if err = json.Unmarshal(body, manifest); err != nil {
+		return "", errors.WithStack(err)
+	}
+	if mediaType == "" {
+		mediaType = manifest.MediaType
+	}
+	if !registryserver.IsIndexMediaType(mediaType) {
+		if err = c.copyBlobs(ctx, imageName, manifest); err != nil {
+			return "", err
+		}
+		return c.target.PutManifest(ctx, imageName, targetReference, mediaType, body)
+	}
+	children := registryserver.FilterManifests(manifest.Manifests, c.platforms)
+	if len(children) == 0 {
+		return "", errors.Errorf("image %s:%s has no platform in %v", imageName, sourceReference, c.platforms)
+	}
+	if len(children) < len(manifest.Manifests) {
+		if len(children) == 1 && !c.filterIndex {
+			return c.copyManifest(ctx, imageName, children[0].Digest, targetReference)
+		}
+		if body, err = registryserver.RewriteIndex(body, children); err != nil {
+			return "", err
+		}
+	}
+	for _, child := range children {
+		if _, err = c.copyManifest(ctx, imageName, child.Digest, child.Digest); err != nil {
+			return "", err
+		}
+	}
+	return c.target.PutManifest(ctx, imageName, targetReference, mediaType, body)
+}
+
+func (c *Copier) copyBlobs(ctx context.Context, imageName string, manifest *registryserver.Manifest) error {
+	for _, blob := range manifestDescriptors(manifest) {
+		digest, size := blob.Digest, blob.Size
+		err := c.UploadBlob(ctx, imageName, blob, func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+			load := func(offset int64) (io.ReadCloser, error) {
+				return c.source.GetBlobFrom(ctx, imageName, digest, offset)
+			}
+			if c.cache == nil {
+				return load(offset)
+			}
+			return c.cache.Fetch(digest, size, offset, load)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "copy blob %s", digest)
+		}
+	}
+	return nil
+}
+
+// UploadBlob 目标仓库中不存在 blob 时上传，同一个 blob 只上传一次：其他任务正在上传时等待上传完成，
+// 目标仓库的其他 repository 中已有该 blob 时通过跨 repository 挂载获得
+func (c *Copier) UploadBlob(ctx context.Context, imageName string, blob registryserver.Descriptor, source BlobSource) error {
+	exists, err := c.target.BlobExists(ctx, imageName, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		c.tracker.exists(blob.Digest, imageName)
+		return nil
+	}
+	state, owner := c.tracker.claim(blob.Digest)
+	if !owner {
+		select {
+		case <-state.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if state.err == nil && state.repo != imageName {
+			mounted, err := c.target.MountBlob(ctx, imageName, blob.Digest, state.repo)
+			if err != nil {
+				glog.Warnf("mount blob %s from %s to %s failed,upload instead,err:%v", blob.Digest, state.repo, imageName, secret.RedactError(err))
+			}
+			if mounted {
+				return nil
+			}
+		} else if state.err == nil {
+			return nil
+		}
+		// 挂载失败或者其他任务上传失败时自己上传
+		return c.uploadWithRetry(ctx, imageName, blob, source)
+	}
+	err = c.uploadWithRetry(ctx, imageName, blob, source)
+	c.tracker.finish(blob.Digest, state, imageName, err)
+	return err
+}
+
+// uploadWithRetry 独占上传会话后分块上传，失败后从镜像仓库已确认的位置重试，
+// 等待期间其他任务已经上传完成时不再上传
+func (c *Copier) uploadWithRetry(ctx context.Context, imageName string, blob registryserver.Descriptor, source BlobSource) error {
+	release := c.sessions.Acquire(c.targetKey, imageName, blob.Digest)
+	defer release()
+	exists, err := c.target.BlobExists(ctx, imageName, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	for i := 0; ; i++ {
+		err = c.uploadBlob(ctx, imageName, blob, source)
+		if err == nil || i >= blobRetries || ctx.Err() != nil {
+			return err
+		}
+		glog.Warnf("upload blob %s@%s failed,retry:%d,err:%v", imageName, blob.Digest, i+1, secret.RedactError(err))
+		time.Sleep(time.Duration(i+1) * 5 * time.Second)
+	}
+}
+
+func (c *Copier) uploadBlob(ctx context.Context, imageName string, blob registryserver.Descriptor, source BlobSource) error {
+	session, err := c.resumeSession(ctx, imageName, blob)
+	if err != nil {
+		return err
+	}
+	if session.Offset < blob.Size {
+		reader, err := source(ctx, session.Offset)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		wrapped := c.wrap(reader)
+		for session.Offset < blob.Size {
+			size := c.chunkSize
+			if remain := blob.Size - session.Offset; remain < size {
+				size = remain
+			}
+			location, offset, err := c.target.PatchChunk(ctx, imageName, session.Location, session.Offset, size, io.LimitReader(wrapped, size))
+			if err != nil {
+				return err
+			}
+			if offset == 0 {
+				// 镜像仓库没有返回 Range 时认为整个分块已经确认
+				offset = session.Offset + size
+			}
+			if offset != session.Offset+size {
+				// 镜像仓库确认的位置与发送的不一致，下次重试时从确认的位置继续
+				session.Location, session.Offset = location, offset
+				c.sessions.Save(session)
+				return errors.Errorf("upload offset mismatch,expect %d,acknowledged %d", session.Offset+size, offset)
+			}
+			session.Location, session.Offset = location, offset
+			if err = c.sessions.Save(session); err != nil {
+				glog.Warnf("save upload session failed,err:%v", secret.RedactError(err))
+			}
+		}
+	}
+	if err = c.target.CompleteUpload(ctx, imageName, session.Location, blob.Digest); err != nil {
+		// digest 不一致等情况下会话已经无法继续使用，内容来自缓存时缓存中的 blob 已经损坏，重试时重新下载
+		c.sessions.Delete(session)
+		if errors.Cause(err) == registryserver.ErrDigestInvalid && c.cache != nil {
+			c.cache.Remove(blob.Digest)
+		}
+		return err
+	}
+	c.sessions.Delete(session)
+	return nil
+}
+
+// resumeSession 优先继续之前保存的上传会话，会话已经过期时重新开始
+func (c *Copier) resumeSession(ctx context.Context, imageName string, blob registryserver.Descriptor) (*UploadSession, error) {
+	if session := c.sessions.Load(c.targetKey, imageName, blob.Digest); session != nil {
+		location, offset, err := c.target.UploadOffset(ctx, imageName, session.Location)
+		if offset == 1 && session.Offset == 0 {
+			// 没有上传任何内容时 distribution 返回的 Range 为 0-0，与上传了 1 个字节相同
+			offset = 0
+		}
+		if err == nil && offset <= blob.Size {
+			glog.Infof("resume upload blob %s@%s from %d/%d", imageName, blob.Digest, offset, blob.Size)
+			session.Location, session.Offset = location, offset
+			return session, nil
+		}
+		glog.Warnf("upload session of blob %s@%s expired,restart,err:%v", imageName, blob.Digest, secret.RedactError(err))
+		c.sessions.Delete(session)
+	}
+	location, err := c.target.StartUpload(ctx, imageName)
+	if err != nil {
+		return nil, err
+	}
+	session := &UploadSession{
+		Target:    c.targetKey,
+		ImageName: imageName,
+		Digest:    blob.Digest,
+		Location:  location,
+		Size:      blob.Size,
+	}
+	return session, c.sessions.Save(session)
+}
@@ -0,0 +1,186 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image-sync/registryserver"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// uploadRegistry 支持分块上传的镜像仓库，Range 与 distribution 一样为 0-<已接收字节数-1>，没有接收任何内容时为 0-0；
+// drop 不为空时在之后的分块（不包括第一个分块）中接收到前 drop 个字节后调用 onDrop 并断开连接
+type uploadRegistry struct {
+	lock    sync.Mutex
+	uploads map[string][]byte
+	blobs   map[string][]byte
+	nextId  int
+	drop    int
+	onDrop  func()
+}
+
+func newUploadRegistry(t *testing.T, registry *uploadRegistry) *registryserver.Server {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	registry.uploads, registry.blobs = make(map[string][]byte), make(map[string][]byte)
+	server := httptest.NewTLSServer(registry)
+	t.Cleanup(server.Close)
+	return registryserver.Init(strings.TrimPrefix(server.URL, "https://"), filepath.Join(t.TempDir(), "auth.yaml"))
+}
+
+func (u *uploadRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	switch {
+	case r.URL.Path == "/v2/":
+	case strings.HasSuffix(r.URL.Path, "/blobs/uploads/") && r.Method == http.MethodPost:
+		u.nextId++
+		id := strconv.Itoa(u.nextId)
+		u.uploads[id] = nil
+		u.progress(w, id, http.StatusAccepted)
+	case strings.HasPrefix(r.URL.Path, "/upload/"):
+		id := strings.TrimPrefix(r.URL.Path, "/upload/")
+		data, ok := u.uploads[id]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			u.progress(w, id, http.StatusNoContent)
+		case http.MethodPatch:
+			if !strings.HasPrefix(r.Header.Get("Content-Range"), fmt.Sprintf("%d-", len(data))) {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			if u.drop > 0 && len(data) > 0 {
+				chunk := make([]byte, u.drop)
+				n, _ := io.ReadFull(r.Body, chunk)
+				u.uploads[id] = append(data, chunk[:n]...)
+				u.drop = 0
+				u.onDrop()
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+				return
+			}
+			chunk, _ := io.ReadAll(r.Body)
+			u.uploads[id] = append(data, chunk...)
+			u.progress(w, id, http.StatusAccepted)
+		case http.MethodPut:
+			digest := r.URL.Query().Get("digest")
+			if registryserver.Digest(data) != digest {
+				http.Error(w, "DIGEST_INVALID", http.StatusBadRequest)
+				return
+			}
+			u.blobs[digest] = data
+			delete(u.uploads, id)
+			w.WriteHeader(http.StatusCreated)
+		}
+	case strings.Contains(r.URL.Path, "/blobs/") && r.Method == http.MethodHead:
+		if _, ok := u.blobs[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (u *uploadRegistry) progress(w http.ResponseWriter, id string, status int) {
+	end := len(u.uploads[id]) - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Location", "/upload/"+id)
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+	w.WriteHeader(status)
+}
+
+func TestUploadBlobResumeAfterDrop(t *testing.T) {
+	data := []byte("0123456789")
+	blob := registryserver.Descriptor{Digest: registryserver.Digest(data), Size: int64(len(data))}
+	ctx, cancel := context.WithCancel(context.Background())
+	// 第二个分块只收到 2 个字节时断开连接，取消第一次上传，不在同一次调用中重试
+	registry := &uploadRegistry{drop: 2, onDrop: cancel}
+	target := newUploadRegistry(t, registry)
+	sessions, err := NewSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offsets []int64
+	source := func(ctx context.Context, offset int64) (io.ReadCloser, error) {
+		offsets = append(offsets, offset)
+		return io.NopCloser(bytes.NewReader(data[offset:])), nil
+	}
+
+	copier := NewCopier(nil, target, "target", sessions, 4, nil)
+	if err = copier.UploadBlob(ctx, "p/a", blob, source); err == nil {
+		t.Fatal("UploadBlob() err = nil, want error after connection dropped")
+	}
+	if session := sessions.Load("target", "p/a", blob.Digest); session == nil || session.Offset != 4 {
+		t.Fatalf("saved session = %+v, want offset 4 of the last acknowledged chunk", session)
+	}
+
+	// 重启后使用新的 Copier，从镜像仓库已确认的 6 个字节继续，而不是会话中保存的 4 或者从头开始
+	copier = NewCopier(nil, target, "target", sessions, 4, nil)
+	if err = copier.UploadBlob(context.Background(), "p/a", blob, source); err != nil {
+		t.Fatalf("UploadBlob() resume err = %v", err)
+	}
+	if len(offsets) != 2 || offsets[0] != 0 || offsets[1] != 6 {
+		t.Errorf("source offsets = %v, want [0 6]", offsets)
+	}
+	if !bytes.Equal(registry.blobs[blob.Digest], data) {
+		t.Errorf("uploaded blob = %q, want %q", registry.blobs[blob.Digest], data)
+	}
+	if session := sessions.Load("target", "p/a", blob.Digest); session != nil {
+		t.Errorf("session should be deleted after upload completed, got %+v", session)
+	}
+}
+
+func TestResumeSessionEmptyRange(t *testing.T) {
+	data := []byte("0123456789")
+	blob := registryserver.Descriptor{Digest: registryserver.Digest(data), Size: int64(len(data))}
+	tests := []struct {
+		name       string
+		saved      int64 //会话中保存的位置
+		uploaded   int   //镜像仓库已经接收的字节数，0 与 1 时 Range 都是 0-0
+		wantOffset int64
+	}{
+		{name: "nothing uploaded", saved: 0, uploaded: 0, wantOffset: 0},
+		{name: "one byte uploaded", saved: 1, uploaded: 1, wantOffset: 1},
+		{name: "more than saved", saved: 4, uploaded: 6, wantOffset: 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := &uploadRegistry{}
+			target := newUploadRegistry(t, registry)
+			sessions, err := NewSessionStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			location, err := target.StartUpload(ctx, "p/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			registry.lock.Lock()
+			id := location[strings.LastIndex(location, "/")+1:]
+			registry.uploads[id] = data[:tt.uploaded]
+			registry.lock.Unlock()
+			sessions.Save(&UploadSession{Target: "target", ImageName: "p/a", Digest: blob.Digest, Location: location, Offset: tt.saved})
+
+			session, err := NewCopier(nil, target, "target", sessions, 4, nil).resumeSession(ctx, "p/a", blob)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if session.Location != location || session.Offset != tt.wantOffset {
+				t.Errorf("resumeSession() = %s,%d, want %s,%d", session.Location, session.Offset, location, tt.wantOffset)
+			}
+		})
+	}
+}
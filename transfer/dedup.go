@@ -0,0 +1,148 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/registryserver"
+	"image-sync/secret"
+	"strings"
+	"sync"
+)
+
+// blobState 目标仓库中 blob 的上传状态，repo 为已经存在该 blob 的 repository
+type blobState struct {
+	done chan struct{}
+	repo string
+	err  error
+}
+
+// blobTracker 记录本次运行中每个 blob 的上传状态，同一个 blob 只上传一次，
+// 其他 repository 等待上传完成后通过跨 repository 挂载获得
+type blobTracker struct {
+	lock  sync.Mutex
+	blobs map[string]*blobState
+}
+
+func newBlobTracker() *blobTracker {
+	return &blobTracker{blobs: make(map[string]*blobState)}
+}
+
+// claim 返回 blob 的状态，owner 为 true 时由调用方上传并在结束后调用 finish
+func (t *blobTracker) claim(digest string) (state *blobState, owner bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if state, ok := t.blobs[digest]; ok {
+		return state, false
+	}
+	state = &blobState{done: make(chan struct{})}
+	t.blobs[digest] = state
+	return state, true
+}
+
+// finish 上传失败时移除状态，等待中的任务会自己上传
+func (t *blobTracker) finish(digest string, state *blobState, repo string, err error) {
+	t.lock.Lock()
+	state.repo, state.err = repo, err
+	if err != nil {
+		delete(t.blobs, digest)
+	}
+	t.lock.Unlock()
+	close(state.done)
+}
+
+// exists 记录目标仓库中已经存在的 blob，供其他 repository 挂载
+func (t *blobTracker) exists(digest, repo string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.blobs[digest]; ok {
+		return
+	}
+	state := &blobState{done: make(chan struct{}), repo: repo}
+	close(state.done)
+	t.blobs[digest] = state
+}
+
+// Plan 同步前检查所有镜像的 manifest 得到的 blob 信息
+type Plan struct {
+	Blobs      map[string]int64    //每个 blob 的大小
+	ImageBlobs map[string][]string //每个镜像（ImageRef.String()）引用的 blob
+	TotalSize  int64               //所有镜像 blob 大小之和
+	UniqueSize int64               //去重后 blob 大小之和
+}
+
+// ImageRef 需要检查的镜像，Reference 为 tag 或者 digest
+type ImageRef struct {
+	Name      string
+	Reference string
+}
+
+// String 返回 name:tag 或者 name@digest，同时作为 Plan.ImageBlobs 的 key
+func (r ImageRef) String() string {
+	if strings.HasPrefix(r.Reference, "sha256:") {
+		return r.Name + "@" + r.Reference
+	}
+	return r.Name + ":" + r.Reference
+}
+
+// Inspect 查询源镜像仓库中每个镜像的 manifest，统计镜像之间共用的 blob，
+// 查询失败的镜像跳过（不在 ImageBlobs 中），只有 ctx 结束时返回错误
+func (c *Copier) Inspect(ctx context.Context, images []ImageRef) (*Plan, error) {
+	plan := &Plan{Blobs: make(map[string]int64), ImageBlobs: make(map[string][]string)}
+	for _, image := range images {
+		blobs, err := c.manifestBlobs(ctx, image.Name, image.Reference)
+		if ctx.Err() != nil {
+			return nil, errors.WithStack(ctx.Err())
+		}
+		if err != nil {
+			glog.Warnf("inspect %s failed,skip,err:%v", image, secret.RedactError(err))
+			continue
+		}
+		key := image.String()
+		for _, blob := range blobs {
+			plan.ImageBlobs[key] = append(plan.ImageBlobs[key], blob.Digest)
+			plan.TotalSize += blob.Size
+			if _, ok := plan.Blobs[blob.Digest]; !ok {
+				plan.Blobs[blob.Digest] = blob.Size
+				plan.UniqueSize += blob.Size
+			}
+		}
+	}
+	return plan, nil
+}
+
+// manifestBlobs 返回镜像引用的 config 以及 layer，多平台镜像返回所有需要复制的平台的
+func (c *Copier) manifestBlobs(ctx context.Context, imageName, reference string) ([]registryserver.Descriptor, error) {
+	body, mediaType, _, err := c.source.GetManifest(ctx, imageName, reference)
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(registryserver.Manifest)
+	if err = json.Unmarshal(body, manifest); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if mediaType == "" {
+		mediaType = manifest.MediaType
+	}
+	if !registryserver.IsIndexMediaType(mediaType) {
+		return manifestDescriptors(manifest), nil
+	}
+	var blobs []registryserver.Descriptor
+	for _, child := range registryserver.FilterManifests(manifest.Manifests, c.platforms) {
+		childBlobs, err := c.manifestBlobs(ctx, imageName, child.Digest)
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, childBlobs...)
+	}
+	return blobs, nil
+}
+
+func manifestDescriptors(manifest *registryserver.Manifest) []registryserver.Descriptor {
+	blobs := manifest.Layers
+	if manifest.Config != nil {
+		blobs = append([]registryserver.Descriptor{*manifest.Config}, blobs...)
+	}
+	return blobs
+}
@@ -0,0 +1,70 @@
+package transfer
+
+import (
+	"context"
+	"encoding/json"
+	"image-sync/registryserver"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newFakeRegistry 只提供 manifest 接口的镜像仓库，manifests 的 key 为 name:reference，不存在的镜像返回 500
+func newFakeRegistry(t *testing.T, manifests map[string]registryserver.Manifest) *registryserver.Server {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/v2/")
+		index := strings.Index(path, "/manifests/")
+		if index < 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		manifest, ok := manifests[path[:index]+":"+path[index+len("/manifests/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", manifest.MediaType)
+		json.NewEncoder(w).Encode(manifest)
+	}))
+	t.Cleanup(server.Close)
+	return registryserver.Init(strings.TrimPrefix(server.URL, "https://"), filepath.Join(t.TempDir(), "auth.yaml"))
+}
+
+func TestInspectSkipsFailedImage(t *testing.T) {
+	mediaType := "application/vnd.docker.distribution.manifest.v2+json"
+	shared := registryserver.Descriptor{Digest: "sha256:shared", Size: 100}
+	source := newFakeRegistry(t, map[string]registryserver.Manifest{
+		"p/a:v1": {MediaType: mediaType, Config: &registryserver.Descriptor{Digest: "sha256:ca", Size: 1},
+			Layers: []registryserver.Descriptor{shared, {Digest: "sha256:a", Size: 10}}},
+		"p/c:v1": {MediaType: mediaType, Config: &registryserver.Descriptor{Digest: "sha256:cc", Size: 2},
+			Layers: []registryserver.Descriptor{shared}},
+	})
+	copier := NewCopier(source, nil, "target", nil, 0, nil)
+	plan, err := copier.Inspect(context.Background(), []ImageRef{
+		{Name: "p/a", Reference: "v1"}, {Name: "p/broken", Reference: "v1"}, {Name: "p/c", Reference: "v1"},
+	})
+	if err != nil {
+		t.Fatalf("Inspect() err = %v, want failed image skipped", err)
+	}
+	if _, ok := plan.ImageBlobs["p/broken:v1"]; ok {
+		t.Error("failed image should not be in plan")
+	}
+	if len(plan.ImageBlobs["p/a:v1"]) != 3 || len(plan.ImageBlobs["p/c:v1"]) != 2 {
+		t.Errorf("ImageBlobs = %v", plan.ImageBlobs)
+	}
+	if plan.TotalSize != 213 || plan.UniqueSize != 113 {
+		t.Errorf("TotalSize,UniqueSize = %d,%d, want 213,113", plan.TotalSize, plan.UniqueSize)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = copier.Inspect(ctx, []ImageRef{{Name: "p/a", Reference: "v1"}}); err == nil {
+		t.Error("Inspect() with canceled context should fail")
+	}
+}
@@ -0,0 +1,150 @@
+package transfer
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadSession 持久化的 blob 上传会话，进程重启后从 Offset 继续上传
+type UploadSession struct {
+	Target     string    `json:"target"`
+	ImageName  string    `json:"image_name"`
+	Digest     string    `json:"digest"`
+	Location   string    `json:"location"`
+	Offset     int64     `json:"offset"` //镜像仓库已经确认的字节数
+	Size       int64     `json:"size"`
+	UpdateTime time.Time `json:"update_time"`
+}
+
+// SessionTTL 上传会话的有效期，超过后镜像仓库可能已经清理了未完成的上传（distribution 默认清理 1 周前的上传），
+// 不再尝试继续而是重新开始
+const SessionTTL = 24 * time.Hour
+
+// SessionStore 把上传会话保存在目录中，每个目标仓库、repository、blob 一个文件
+type SessionStore struct {
+	dir  string
+	ttl  time.Duration
+	lock sync.Mutex
+	// keys 正在使用的会话，同一个目标仓库、repository、blob 同时只有一个任务上传
+	keys map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewSessionStore 打开保存上传会话的目录，并删除已经过期的会话
+func NewSessionStore(dir string) (*SessionStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s := &SessionStore{dir: dir, ttl: SessionTTL, keys: make(map[string]*keyLock)}
+	s.prune()
+	return s, nil
+}
+
+// prune 删除过期以及无法解析的会话文件
+func (s *SessionStore) prune() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		sessionPath := path.Join(s.dir, entry.Name())
+		session, err := readSession(sessionPath)
+		if err != nil || s.expired(session) {
+			os.Remove(sessionPath)
+		}
+	}
+}
+
+func (s *SessionStore) expired(session *UploadSession) bool {
+	return time.Since(session.UpdateTime) > s.ttl
+}
+
+// Acquire 独占目标仓库、repository、blob 对应的会话，返回的函数用于释放
+func (s *SessionStore) Acquire(target, imageName, digest string) func() {
+	key := s.path(target, imageName, digest)
+	s.lock.Lock()
+	l, ok := s.keys[key]
+	if !ok {
+		l = new(keyLock)
+		s.keys[key] = l
+	}
+	l.refs++
+	s.lock.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.lock.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(s.keys, key)
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (s *SessionStore) path(target, imageName, digest string) string {
+	name := strings.NewReplacer("/", "_", ":", "_").Replace(target + "_" + imageName + "_" + digest)
+	return path.Join(s.dir, name+".json")
+}
+
+// Load 读取上传会话，不存在或者已经过期时返回 nil，过期的会话会被删除
+func (s *SessionStore) Load(target, imageName, digest string) *UploadSession {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sessionPath := s.path(target, imageName, digest)
+	session, err := readSession(sessionPath)
+	if err != nil {
+		return nil
+	}
+	if s.expired(session) {
+		os.Remove(sessionPath)
+		return nil
+	}
+	return session
+}
+
+func readSession(sessionPath string) (*UploadSession, error) {
+	data, err := os.ReadFile(sessionPath)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	session := new(UploadSession)
+	if err = json.Unmarshal(data, session); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return session, nil
+}
+
+// Save 保存上传会话，先写临时文件再重命名，避免进程退出时留下不完整的文件
+func (s *SessionStore) Save(session *UploadSession) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session.UpdateTime = time.Now()
+	data, err := json.Marshal(session)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sessionPath := s.path(session.Target, session.ImageName, session.Digest)
+	if err = os.WriteFile(sessionPath+".tmp", data, 0644); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(sessionPath+".tmp", sessionPath))
+}
+
+// Delete blob 上传完成或者会话失效后删除
+func (s *SessionStore) Delete(session *UploadSession) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	os.Remove(s.path(session.Target, session.ImageName, session.Digest))
+}
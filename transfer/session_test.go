@@ -0,0 +1,91 @@
+package transfer
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSessionStoreExpire(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewSessionStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := &UploadSession{Target: "t", ImageName: "p/a", Digest: "sha256:1", Location: "/upload/1"}
+	if err = store.Save(fresh); err != nil {
+		t.Fatal(err)
+	}
+	if session := store.Load("t", "p/a", "sha256:1"); session == nil || session.Location != "/upload/1" {
+		t.Fatalf("Load() = %+v, want saved session", session)
+	}
+
+	// Save 会更新 UpdateTime，直接写入过期的会话
+	expired := &UploadSession{Target: "t", ImageName: "p/a", Digest: "sha256:2", UpdateTime: time.Now().Add(-SessionTTL - time.Minute)}
+	data, _ := json.Marshal(expired)
+	expiredPath := store.path("t", "p/a", "sha256:2")
+	if err = os.WriteFile(expiredPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if session := store.Load("t", "p/a", "sha256:2"); session != nil {
+		t.Errorf("Load() expired session = %+v, want nil", session)
+	}
+	if _, err = os.Stat(expiredPath); !os.IsNotExist(err) {
+		t.Errorf("expired session should be removed, stat err = %v", err)
+	}
+
+	// 打开目录时删除过期以及无法解析的会话
+	os.WriteFile(expiredPath, data, 0644)
+	brokenPath := store.path("t", "p/a", "sha256:3")
+	os.WriteFile(brokenPath, []byte("{"), 0644)
+	if store, err = NewSessionStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, removed := range []string{expiredPath, brokenPath} {
+		if _, err = os.Stat(removed); !os.IsNotExist(err) {
+			t.Errorf("%s should be pruned, stat err = %v", removed, err)
+		}
+	}
+	if store.Load("t", "p/a", "sha256:1") == nil {
+		t.Error("fresh session should be kept after prune")
+	}
+}
+
+func TestSessionStoreAcquire(t *testing.T) {
+	store, err := NewSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := store.Acquire("t", "p/a", "sha256:1")
+			defer release()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		}()
+	}
+	// 不同的 blob 不互相等待
+	release := store.Acquire("t", "p/a", "sha256:other")
+	release()
+	wg.Wait()
+	if maxRunning != 1 {
+		t.Errorf("max concurrent holders of one session = %d, want 1", maxRunning)
+	}
+	if len(store.keys) != 0 {
+		t.Errorf("keys should be released, got %d", len(store.keys))
+	}
+}
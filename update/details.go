@@ -0,0 +1,76 @@
+package update
+
+import (
+	"encoding/json"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/config"
+	"image-sync/imagesync"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// ImageDetailsFile image_metadata 表中没有的镜像信息（digest、平台、label 等）保存在 OutputPath 下的该文件中
+const ImageDetailsFile = "image-details"
+
+type ImageDetail struct {
+	AzId         string            `json:"az_id"`
+	Name         string            `json:"name"`
+	Tag          string            `json:"tag"`
+	Size         string            `json:"size"`
+	Digest       string            `json:"digest,omitempty"`
+	SourceDigest string            `json:"source_digest,omitempty"` //同步时固定的源镜像 digest
+	MediaType    string            `json:"media_type,omitempty"`
+	Platforms    []string          `json:"platforms,omitempty"`
+	Created      *time.Time        `json:"created,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	RunId        string            `json:"run_id"`
+	UpdateTime   time.Time         `json:"update_time"`
+}
+
+var detailsLock sync.Mutex
+
+// recordImageDetails 为元数据写入成功的镜像追加详细信息，同一镜像以最后一条记录为准
+func recordImageDetails(azId string, imageList []imagesync.DataImage, results []ImageResult) {
+	succeed := make(map[string]struct{}, len(results))
+	for _, result := range results {
+		if result.Result != ResultFailed {
+			succeed[result.Name+":"+result.Tag] = struct{}{}
+		}
+	}
+	detailsLock.Lock()
+	defer detailsLock.Unlock()
+	file, err := os.OpenFile(path.Join(config.IMConfig.OutputPath, ImageDetailsFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		glog.Warnf("open image details file failed,err:%v", err)
+		return
+	}
+	defer file.Close()
+	for _, image := range imageList {
+		if _, ok := succeed[image.Name+":"+image.Tag]; !ok {
+			continue
+		}
+		data, err := json.Marshal(ImageDetail{
+			AzId:         azId,
+			Name:         image.Name,
+			Tag:          image.Tag,
+			Size:         image.Size,
+			Digest:       image.Digest,
+			SourceDigest: image.SourceDigest,
+			MediaType:    image.MediaType,
+			Platforms:    image.Platforms,
+			Created:      image.Created,
+			Labels:       image.Labels,
+			RunId:        syncRunId(image),
+			UpdateTime:   time.Now(),
+		})
+		if err != nil {
+			continue
+		}
+		if _, err = file.Write(append(data, '\n')); err != nil {
+			glog.Warnf("write image details failed,err:%v", err)
+			return
+		}
+	}
+}
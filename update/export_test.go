@@ -0,0 +1,10 @@
+package update
+
+import (
+	"image-sync/config"
+)
+
+// NewHttpSink 供 update_test 包中的测试使用，平台接口替身 standin 依赖 update 包，只能在外部测试包中使用
+func NewHttpSink(apiConfig config.PlatformApiConfig) MetadataSink {
+	return newHttpSink(apiConfig)
+}
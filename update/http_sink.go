@@ -0,0 +1,253 @@
+package update
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-geminidb/model"
+	"image-sync/config"
+	"image-sync/secret"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// IdempotencyKeyHeader 同一个请求重试时不变的请求头，平台据此返回第一次处理的结果
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// ImageRegistration 平台接口中镜像在某个 AZ 的元数据，未设置的字段保持不变
+type ImageRegistration struct {
+	AzId       string `json:"az_id"`
+	Name       string `json:"name"`
+	Tag        string `json:"tag"`
+	Size       *int64 `json:"size,omitempty"`
+	Status     *int   `json:"status,omitempty"`
+	SyncStatus *int   `json:"sync_status,omitempty"`
+}
+
+// RegistrationResponse 平台接口的返回，previous 为修改前的元数据，新插入时为空
+type RegistrationResponse struct {
+	Result   string             `json:"result"`
+	Previous *ImageRegistration `json:"previous,omitempty"`
+}
+
+// httpSink 调用平台接口写入镜像元数据：
+//
+//	PUT    {endpoint}                           写入或更新，body 为 ImageRegistration，返回 RegistrationResponse
+//	PUT    {endpoint}?update_only=true          只更新已存在的元数据，不存在时返回 404
+//	DELETE {endpoint}?az_id=&name=&tag=         删除，用于回滚
+//
+// 每个请求带有 Idempotency-Key，重试时不变，平台对同一个 key 返回第一次处理的结果，
+// 第一次 PUT 已经写入但响应丢失时，重试仍然返回 inserted，修改记录不会丢失。
+// 平台接口没有跨镜像的事务，单个镜像失败只影响该镜像的结果
+type httpSink struct {
+	endpoint string
+	token    string
+	username string
+	password string
+	retries  int
+	client   *http.Client
+}
+
+func newHttpSink(apiConfig config.PlatformApiConfig) *httpSink {
+	return &httpSink{
+		endpoint: apiConfig.Endpoint,
+		token:    apiConfig.Token,
+		username: apiConfig.Username,
+		password: apiConfig.Password,
+		retries:  apiConfig.Retries,
+		client:   &http.Client{Timeout: apiConfig.Timeout},
+	}
+}
+
+func (h *httpSink) Upsert(batch []model.ImageMetadata) ([]ImageResult, []JournalEntry, error) {
+	runId := config.IMConfig.RunId
+	topology := &config.IMConfig.Topology
+	results := make([]ImageResult, 0, len(batch))
+	var entries []JournalEntry
+	for _, imageMeta := range batch {
+		resp, err := h.upsert(imageMeta)
+		if err != nil {
+			results = append(results, failedResult(imageMeta.Name, imageMeta.Tag, err))
+			continue
+		}
+		entry := JournalEntry{RunId: runId, Name: imageMeta.Name, Tag: imageMeta.Tag, AzId: imageMeta.AzId}
+		switch resp.Result {
+		case ResultInserted:
+			entry.Action = JournalInserted
+			entries = append(entries, entry)
+		case ResultUpdated:
+			entry.Action = JournalUpdated
+			entry.Previous = resp.Previous.toModel()
+			entries = append(entries, entry)
+		}
+
+		result := ImageResult{Name: imageMeta.Name, Tag: imageMeta.Tag, Result: resp.Result}
+		// 同步到中控后，源 AZ 中的镜像标记为已同步回中控，失败时目标 AZ 已经写入并记录，结果保留目标 AZ 的结果并带上错误
+		if topology.IsCentral(imageMeta.AzId) {
+			syncStatus := topology.Transitions.SourceSynced.SyncStatus
+			sourceAzId := config.IMConfig.SourceAzId
+			sourceResp, err := h.register(ImageRegistration{AzId: sourceAzId, Name: imageMeta.Name, Tag: imageMeta.Tag, SyncStatus: &syncStatus}, true)
+			if err != nil {
+				result.Error = errors.Wrap(err, "update source az sync status").Error()
+			} else if sourceResp.Previous != nil {
+				entries = append(entries, JournalEntry{RunId: runId, Action: JournalSourceUpdated,
+					Name: imageMeta.Name, Tag: imageMeta.Tag, AzId: sourceAzId, Previous: sourceResp.Previous.toModel()})
+			}
+		}
+		results = append(results, result)
+	}
+	return results, entries, nil
+}
+
+// upsert 先只更新已存在的元数据，不修改 status（可能已经被运维上线），不存在时再写入包括 status 在内的全部字段
+func (h *httpSink) upsert(imageMeta model.ImageMetadata) (*RegistrationResponse, error) {
+	resp, err := h.register(ImageRegistration{AzId: imageMeta.AzId, Name: imageMeta.Name, Tag: imageMeta.Tag,
+		Size: &imageMeta.Size, SyncStatus: &imageMeta.SyncStatus}, true)
+	if err != nil || resp.Result != "" {
+		return resp, err
+	}
+	return h.register(ImageRegistration{AzId: imageMeta.AzId, Name: imageMeta.Name, Tag: imageMeta.Tag,
+		Size: &imageMeta.Size, Status: &imageMeta.Status, SyncStatus: &imageMeta.SyncStatus}, false)
+}
+
+func (h *httpSink) Revert(entries []JournalEntry) error {
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		var err error
+		switch entry.Action {
+		case JournalInserted:
+			err = h.Delete(entry.AzId, entry.Name, entry.Tag)
+		case JournalUpdated:
+			previous := entry.Previous
+			_, err = h.register(ImageRegistration{AzId: entry.AzId, Name: entry.Name, Tag: entry.Tag,
+				Size: &previous.Size, Status: &previous.Status, SyncStatus: &previous.SyncStatus}, true)
+		case JournalSourceUpdated:
+			_, err = h.register(ImageRegistration{AzId: entry.AzId, Name: entry.Name, Tag: entry.Tag,
+				SyncStatus: &entry.Previous.SyncStatus}, true)
+		default:
+			err = errors.Errorf("unknown journal action %s", entry.Action)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "rollback %s of %s:%s in %s", entry.Action, entry.Name, entry.Tag, entry.AzId)
+		}
+	}
+	return nil
+}
+
+func (h *httpSink) Update(registration ImageRegistration) error {
+	_, err := h.register(registration, true)
+	return err
+}
+
+func (h *httpSink) Delete(azId, name, tag string) error {
+	query := url.Values{"az_id": {azId}, "name": {name}, "tag": {tag}}
+	_, err := h.do(http.MethodDelete, h.endpoint+"?"+query.Encode(), nil, true)
+	return err
+}
+
+// register 写入元数据，updateOnly 为 true 时元数据不存在则不写入，返回的 Result 为空
+func (h *httpSink) register(registration ImageRegistration, updateOnly bool) (*RegistrationResponse, error) {
+	body, err := json.Marshal(registration)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	addr := h.endpoint
+	if updateOnly {
+		addr += "?update_only=true"
+	}
+	data, err := h.do(http.MethodPut, addr, body, updateOnly)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(RegistrationResponse)
+	if data == nil {
+		return resp, nil
+	}
+	if err = json.Unmarshal(data, resp); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.Result == "" {
+		resp.Result = ResultUpdated
+	}
+	return resp, nil
+}
+
+// do 发送请求，网络错误、429 以及 5xx 时按照 1s、2s、4s... 的间隔重试，所有重试使用同一个 Idempotency-Key，
+// allowNotFound 为 true 时（删除或只更新）元数据不存在返回空内容
+func (h *httpSink) do(method, addr string, body []byte, allowNotFound bool) ([]byte, error) {
+	idempotencyKey, err := newIdempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for i := 0; i <= h.retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Second << (i - 1))
+		}
+		req, err := http.NewRequest(method, addr, bytes.NewReader(body))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+		if h.token != "" {
+			req.Header.Set("Authorization", "Bearer "+h.token)
+		} else if h.username != "" {
+			req.SetBasicAuth(h.username, h.password)
+		}
+		resp, err := h.client.Do(req)
+		if err != nil {
+			lastErr = errors.WithStack(err)
+			glog.Warnf("request platform api failed,retry:%d,err:%v", i, secret.RedactError(err))
+			continue
+		}
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch {
+		case err != nil:
+			lastErr = errors.WithStack(err)
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError:
+			lastErr = fmt.Errorf("platform api %s %s status code %d", method, h.endpoint, resp.StatusCode)
+		case resp.StatusCode == http.StatusNotFound && allowNotFound:
+			// 要删除或只更新的元数据不存在
+			return nil, nil
+		case resp.StatusCode >= http.StatusBadRequest:
+			return nil, fmt.Errorf("platform api %s %s status code %d:%s", method, h.endpoint, resp.StatusCode, secret.Redact(string(data)))
+		default:
+			return data, nil
+		}
+		glog.Warnf("request platform api failed,retry:%d,err:%v", i, lastErr)
+	}
+	return nil, lastErr
+}
+
+func newIdempotencyKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func (r *ImageRegistration) toModel() *model.ImageMetadata {
+	if r == nil {
+		return &model.ImageMetadata{}
+	}
+	imageMeta := &model.ImageMetadata{AzId: r.AzId, Name: r.Name, Tag: r.Tag}
+	if r.Size != nil {
+		imageMeta.Size = *r.Size
+	}
+	if r.Status != nil {
+		imageMeta.Status = *r.Status
+	}
+	if r.SyncStatus != nil {
+		imageMeta.SyncStatus = *r.SyncStatus
+	}
+	return imageMeta
+}
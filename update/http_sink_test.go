@@ -0,0 +1,246 @@
+package update_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-geminidb/model"
+	"image-sync/config"
+	"image-sync/update"
+	"image-sync/update/standin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setupHttpSink(t *testing.T, handler http.Handler) update.MetadataSink {
+	config.IMConfig = &config.GlobalConfig{RunId: "run1", SourceAzId: "az2"}
+	config.IMConfig.Topology.CentralAz = "az1"
+	config.IMConfig.Topology.Transitions.SourceSynced.SyncStatus = config.SyncStatusSynced
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return update.NewHttpSink(config.PlatformApiConfig{Endpoint: server.URL, Retries: 1, Timeout: time.Second})
+}
+
+func listImages(t *testing.T, handler http.Handler) map[string]update.ImageRegistration {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	var images []update.ImageRegistration
+	if err := json.Unmarshal(recorder.Body.Bytes(), &images); err != nil {
+		t.Fatal(err)
+	}
+	result := make(map[string]update.ImageRegistration, len(images))
+	for _, image := range images {
+		result[image.AzId+"/"+image.Name+":"+image.Tag] = image
+	}
+	return result
+}
+
+func TestHttpSinkUpsert(t *testing.T) {
+	platform := standin.NewServer()
+	sink := setupHttpSink(t, platform)
+	batch := []model.ImageMetadata{
+		{AzId: "az3", Name: "p/a", Tag: "v1", Size: 100, Status: 2, SyncStatus: 3},
+		{AzId: "az3", Name: "p/b", Tag: "v1", Size: 200, Status: 2, SyncStatus: 3},
+	}
+	tests := []struct {
+		name        string
+		batch       []model.ImageMetadata
+		wantResults []string
+		wantActions []string
+	}{
+		{name: "insert", batch: batch, wantResults: []string{update.ResultInserted, update.ResultInserted},
+			wantActions: []string{update.JournalInserted, update.JournalInserted}},
+		{name: "repeat is unchanged", batch: batch, wantResults: []string{update.ResultUnchanged, update.ResultUnchanged}},
+		{name: "size changed", batch: []model.ImageMetadata{{AzId: "az3", Name: "p/a", Tag: "v1", Size: 300, Status: 2, SyncStatus: 3}},
+			wantResults: []string{update.ResultUpdated}, wantActions: []string{update.JournalUpdated}},
+	}
+	for _, tt := range tests {
+		results, entries, err := sink.Upsert(tt.batch)
+		if err != nil {
+			t.Fatalf("%s: Upsert() err = %v", tt.name, err)
+		}
+		var gotResults, gotActions []string
+		for _, result := range results {
+			gotResults = append(gotResults, result.Result)
+		}
+		for _, entry := range entries {
+			gotActions = append(gotActions, entry.Action)
+			if entry.RunId != "run1" {
+				t.Errorf("%s: journal run id = %q, want run1", tt.name, entry.RunId)
+			}
+		}
+		if !equalStrings(gotResults, tt.wantResults) || !equalStrings(gotActions, tt.wantActions) {
+			t.Errorf("%s: Upsert() results %v actions %v, want %v %v", tt.name, gotResults, gotActions, tt.wantResults, tt.wantActions)
+		}
+		if tt.name == "size changed" && (len(entries) != 1 || entries[0].Previous.Size != 100) {
+			t.Errorf("%s: previous = %+v, want size 100", tt.name, entries)
+		}
+	}
+
+	// 逆序撤销后恢复到写入之前
+	_, insertEntries, _ := sink.Upsert([]model.ImageMetadata{{AzId: "az3", Name: "p/c", Tag: "v1", Size: 1}})
+	_, updateEntries, _ := sink.Upsert([]model.ImageMetadata{{AzId: "az3", Name: "p/a", Tag: "v1", Size: 400, Status: 2, SyncStatus: 3}})
+	if err := sink.Revert(append(insertEntries, updateEntries...)); err != nil {
+		t.Fatal(err)
+	}
+	images := listImages(t, platform)
+	if _, ok := images["az3/p/c:v1"]; ok {
+		t.Error("Revert() should delete inserted p/c:v1")
+	}
+	if size := images["az3/p/a:v1"].Size; size == nil || *size != 300 {
+		t.Errorf("Revert() size of p/a:v1 = %v, want 300", size)
+	}
+}
+
+func TestHttpSinkCentralTarget(t *testing.T) {
+	platform := standin.NewServer()
+	sink := setupHttpSink(t, platform)
+	pending := config.SyncStatusNotSynced
+	if err := sink.Update(update.ImageRegistration{AzId: "az2", Name: "p/a", Tag: "v1", SyncStatus: &pending}); err != nil {
+		t.Fatalf("Update() missing image err = %v", err)
+	}
+	if len(listImages(t, platform)) != 0 {
+		t.Fatal("Update() should not create missing image")
+	}
+	size := int64(100)
+	if _, _, err := sink.Upsert([]model.ImageMetadata{{AzId: "az2", Name: "p/a", Tag: "v1", Size: size, SyncStatus: pending}}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, entries, err := sink.Upsert([]model.ImageMetadata{{AzId: "az1", Name: "p/a", Tag: "v1", Size: size, Status: 1, SyncStatus: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].Action != update.JournalSourceUpdated || entries[1].Previous.SyncStatus != pending {
+		t.Fatalf("Upsert() central entries = %+v, want inserted and source_updated", entries)
+	}
+	if syncStatus := listImages(t, platform)["az2/p/a:v1"].SyncStatus; syncStatus == nil || *syncStatus != config.SyncStatusSynced {
+		t.Errorf("source sync status = %v, want %d", syncStatus, config.SyncStatusSynced)
+	}
+	if err = sink.Revert(entries); err != nil {
+		t.Fatal(err)
+	}
+	images := listImages(t, platform)
+	if syncStatus := images["az2/p/a:v1"].SyncStatus; syncStatus == nil || *syncStatus != pending {
+		t.Errorf("Revert() source sync status = %v, want %d", syncStatus, pending)
+	}
+	if _, ok := images["az1/p/a:v1"]; ok {
+		t.Error("Revert() should delete central image")
+	}
+	if err = sink.Delete("az1", "p/a", "v1"); err != nil {
+		t.Errorf("Delete() missing image err = %v", err)
+	}
+}
+
+// lostResponse 第一次写入新元数据的 PUT 写入后返回 502，模拟写入成功但响应丢失
+type lostResponse struct {
+	http.Handler
+	once sync.Once
+}
+
+func (l *lostResponse) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	lost := false
+	if r.Method == http.MethodPut && r.URL.Query().Get("update_only") == "" {
+		l.once.Do(func() { lost = true })
+	}
+	if !lost {
+		l.Handler.ServeHTTP(w, r)
+		return
+	}
+	l.Handler.ServeHTTP(httptest.NewRecorder(), r)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func TestHttpSinkRetryKeepsInsert(t *testing.T) {
+	handler := &lostResponse{Handler: standin.NewServer()}
+	sink := setupHttpSink(t, handler)
+	results, entries, err := sink.Upsert([]model.ImageMetadata{{AzId: "az3", Name: "p/a", Tag: "v1", Size: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Result != update.ResultInserted {
+		t.Errorf("Upsert() results = %+v, want inserted", results)
+	}
+	if len(entries) != 1 || entries[0].Action != update.JournalInserted {
+		t.Fatalf("Upsert() entries = %+v, want inserted", entries)
+	}
+	if err = sink.Revert(entries); err != nil {
+		t.Fatal(err)
+	}
+	if images := listImages(t, handler); len(images) != 0 {
+		t.Errorf("Revert() left %v", images)
+	}
+}
+
+func TestHttpSinkKeepsOnlineStatus(t *testing.T) {
+	platform := standin.NewServer()
+	sink := setupHttpSink(t, platform)
+	online := config.ImageStatusOnline
+	if _, _, err := sink.Upsert([]model.ImageMetadata{{AzId: "az3", Name: "p/a", Tag: "v1", Size: 100, Status: 2, SyncStatus: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	// 运维上线后再次执行 update
+	if err := sink.Update(update.ImageRegistration{AzId: "az3", Name: "p/a", Tag: "v1", Status: &online}); err != nil {
+		t.Fatal(err)
+	}
+	results, _, err := sink.Upsert([]model.ImageMetadata{{AzId: "az3", Name: "p/a", Tag: "v1", Size: 200, Status: 2, SyncStatus: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Result != update.ResultUpdated {
+		t.Errorf("Upsert() results = %+v, want updated", results)
+	}
+	image := listImages(t, platform)["az3/p/a:v1"]
+	if image.Status == nil || *image.Status != online || image.Size == nil || *image.Size != 200 {
+		t.Errorf("image = status %v size %v, want status %d size 200", image.Status, image.Size, online)
+	}
+}
+
+// failSourceAz 更新源 AZ az2 时返回 400
+type failSourceAz struct {
+	http.Handler
+}
+
+func (f failSourceAz) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		body, _ := io.ReadAll(r.Body)
+		var registration update.ImageRegistration
+		json.Unmarshal(body, &registration)
+		if registration.AzId == "az2" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	f.Handler.ServeHTTP(w, r)
+}
+
+func TestHttpSinkSourceFailedKeepsTargetResult(t *testing.T) {
+	platform := standin.NewServer()
+	sink := setupHttpSink(t, failSourceAz{platform})
+	results, entries, err := sink.Upsert([]model.ImageMetadata{{AzId: "az1", Name: "p/a", Tag: "v1", Size: 100, Status: 1, SyncStatus: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Result != update.ResultInserted || results[0].Error == "" {
+		t.Errorf("Upsert() results = %+v, want inserted with source error", results)
+	}
+	if len(entries) != 1 || entries[0].Action != update.JournalInserted {
+		t.Errorf("Upsert() entries = %+v, want target insert journaled", entries)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
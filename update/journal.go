@@ -0,0 +1,94 @@
+package update
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-geminidb/model"
+	"image-sync/config"
+	"os"
+	"path"
+	"sync"
+)
+
+const (
+	RunsDir = "runs"
+
+	JournalInserted      = "inserted"       // 新插入的目标 AZ 元数据
+	JournalUpdated       = "updated"        // 更新过的目标 AZ 元数据
+	JournalSourceUpdated = "source_updated" // 更新过同步状态的源 AZ 元数据
+)
+
+// JournalEntry 记录一次运行对 image_metadata 的修改，用于回滚
+type JournalEntry struct {
+	RunId    string               `json:"run_id"`
+	Action   string               `json:"action"`
+	Name     string               `json:"name"`
+	Tag      string               `json:"tag"`
+	AzId     string               `json:"az_id"`
+	Previous *model.ImageMetadata `json:"previous,omitempty"`
+}
+
+var journalLock sync.Mutex
+
+func journalPath(runId string) string {
+	return path.Join(config.IMConfig.OutputPath, RunsDir, runId)
+}
+
+// appendJournal 在事务提交后按运行ID追加修改记录
+func appendJournal(entries []JournalEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	journalLock.Lock()
+	defer journalLock.Unlock()
+	if err := os.MkdirAll(path.Join(config.IMConfig.OutputPath, RunsDir), 0755); err != nil {
+		return errors.WithStack(err)
+	}
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for _, entry := range entries {
+		file, ok := files[entry.RunId]
+		if !ok {
+			var err error
+			file, err = os.OpenFile(journalPath(entry.RunId), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			files[entry.RunId] = file
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err = file.Write(append(data, '\n')); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func readJournal(runId string) ([]JournalEntry, error) {
+	file, err := os.Open(journalPath(runId))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer file.Close()
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, errors.WithStack(scanner.Err())
+}
@@ -0,0 +1,113 @@
+package update
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"image-sync/config"
+	"image-sync/imagesync"
+	"image-sync/registryserver"
+	"os"
+	"path"
+	"time"
+)
+
+// Rollback 撤销一次运行：删除该运行插入的 image_metadata，恢复被修改的元数据以及源 AZ 的同步状态，
+// 将该运行同步成功的镜像从 sync-succeed 中移除，deleteManifests 为 true 时同时删除目标镜像仓库中对应的 manifest
+func Rollback(runId string, deleteManifests bool, authPath string) error {
+	if runId == "" {
+		return errors.New("run id can not be empty")
+	}
+	entries, err := readJournal(runId)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		if err = getSink().Revert(entries); err != nil {
+			return err
+		}
+		glog.Infof("rollback %d image metadata changes of run %s", len(entries), runId)
+		if err = os.Rename(journalPath(runId), journalPath(runId)+".rolledback"); err != nil {
+			glog.Warnf("rename run journal failed,err:%v", err)
+		}
+	}
+
+	// 移除后下次运行会重新同步这些镜像，删除 manifest 时只移除删除成功的镜像
+	syncSucceedPath := path.Join(config.IMConfig.OutputPath, "sync-succeed")
+	deleted := make(map[string]struct{})
+	if deleteManifests {
+		deleted = deleteRunManifests(imagesync.GetSyncSucceedImageList(syncSucceedPath), runId, authPath)
+	}
+	syncedImages, err := imagesync.RemoveSyncSucceedImage(syncSucceedPath, runId, func(image imagesync.DataImage) bool {
+		_, ok := deleted[image.Name+":"+image.Tag]
+		return !deleteManifests || ok
+	})
+	if err != nil {
+		return err
+	}
+	glog.Infof("remove %d sync succeed images of run %s", len(syncedImages), runId)
+	if len(entries) == 0 && len(syncedImages) == 0 {
+		glog.Warnf("run %s has nothing to rollback", runId)
+	}
+	return nil
+}
+
+// deleteRunManifests 删除 runId 推送到目标镜像仓库的 manifest，返回删除成功（或者已经不存在）的镜像，
+// manifest 同时被该运行之外的 tag 引用、或者 tag 已经指向其他 manifest 时跳过，避免删除其他镜像
+func deleteRunManifests(imageList []imagesync.DataImage, runId, authPath string) map[string]struct{} {
+	repositories := make(map[string][]imagesync.DataImage)
+	for _, image := range imageList {
+		if image.RunId == runId {
+			repositories[image.Name] = append(repositories[image.Name], image)
+		}
+	}
+	deleted := make(map[string]struct{})
+	if len(repositories) == 0 {
+		return deleted
+	}
+	server := registryserver.Init(config.IMConfig.TargetRegistryAddr, authPath)
+	for repository, images := range repositories {
+		removing := make(map[string]struct{}, len(images))
+		for _, image := range images {
+			removing[image.Tag] = struct{}{}
+		}
+		keptDigests, err := server.KeptDigests(repository, removing)
+		if err != nil {
+			glog.Error("get kept digests failed,skip delete manifests", glog.String("error", err.Error()), glog.String("repository", repository))
+			continue
+		}
+		for _, image := range images {
+			if err = deleteManifest(server, image, keptDigests); err != nil {
+				glog.Error("delete manifest failed,keep it in sync-succeed", glog.String("error", err.Error()), glog.String("image", image.Name+":"+image.Tag))
+				continue
+			}
+			deleted[image.Name+":"+image.Tag] = struct{}{}
+			glog.Info("delete manifest succeed", glog.String("image", image.Name+":"+image.Tag))
+		}
+	}
+	return deleted
+}
+
+func deleteManifest(server *registryserver.Server, image imagesync.DataImage, keptDigests map[string]string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	digest, err := server.GetManifestDigest(ctx, image.Name, image.Tag)
+	if errors.Cause(err) == registryserver.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if image.Digest != "" && digest != image.Digest {
+		return errors.Errorf("tag now points to %s instead of pushed %s", digest, image.Digest)
+	}
+	if tag, ok := keptDigests[digest]; ok {
+		return errors.Errorf("manifest is also referenced by tag %s", tag)
+	}
+	// 同一运行中多个 tag 指向同一个 manifest 时，前面的 tag 已经删除了该 manifest
+	err = server.DeleteManifest(ctx, image.Name, digest)
+	if err != nil && errors.Cause(err) != registryserver.ErrNotFound {
+		return err
+	}
+	return nil
+}
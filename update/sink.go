@@ -0,0 +1,50 @@
+package update
+
+import (
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-geminidb/model"
+	"image-sync/config"
+	"sync"
+)
+
+const (
+	SinkSQL  = "sql"
+	SinkHTTP = "http"
+)
+
+// MetadataSink 镜像元数据的写入方式，默认直接写数据库，也可以通过平台的 HTTP 接口写入
+type MetadataSink interface {
+	// Upsert 写入一批目标 AZ 的元数据，目标 AZ 为中控时同时更新源 AZ 的同步状态，
+	// 返回每个镜像的结果以及用于回滚的修改记录，返回 error 表示整批失败且没有写入任何数据
+	Upsert(batch []model.ImageMetadata) ([]ImageResult, []JournalEntry, error)
+	// Revert 逆序撤销修改记录
+	Revert(entries []JournalEntry) error
+	// Update 只更新已存在元数据中设置了的字段，元数据不存在时不做修改
+	Update(registration ImageRegistration) error
+	// Delete 删除元数据，不存在时不报错
+	Delete(azId, name, tag string) error
+}
+
+// GetSink 返回配置的元数据写入方式，供同步之外修改 image_metadata 的流程使用
+func GetSink() MetadataSink {
+	return getSink()
+}
+
+var (
+	sink     MetadataSink
+	sinkOnce sync.Once
+)
+
+func getSink() MetadataSink {
+	sinkOnce.Do(func() {
+		switch config.IMConfig.MetadataSink {
+		case SinkHTTP:
+			sink = newHttpSink(config.IMConfig.PlatformApi)
+		case "", SinkSQL:
+			sink = sqlSink{}
+		default:
+			glog.Fatal("unsupported metadata sink " + config.IMConfig.MetadataSink)
+		}
+	})
+	return sink
+}
@@ -0,0 +1,201 @@
+package update
+
+import (
+	"github.com/pkg/errors"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-geminidb/model"
+	"image-sync/config"
+	"image-sync/dao"
+	"xorm.io/xorm"
+)
+
+// sqlSink 通过 xorm 直接写入 image_metadata 表，每个批次在一个事务中完成
+type sqlSink struct{}
+
+func (sqlSink) Upsert(batch []model.ImageMetadata) ([]ImageResult, []JournalEntry, error) {
+	session := dao.MySQL().NewSession()
+	defer session.Close()
+	results, entries, err := upsertBatchInSession(session, batch)
+	if err != nil {
+		if rollbackErr := session.Rollback(); rollbackErr != nil {
+			glog.Errorf("rollback image meta failed,err:%v", rollbackErr)
+		}
+		return nil, nil, err
+	}
+	return results, entries, nil
+}
+
+func (sqlSink) Revert(entries []JournalEntry) error {
+	session := dao.MySQL().NewSession()
+	defer session.Close()
+	if err := rollbackJournal(session, entries); err != nil {
+		if rollbackErr := session.Rollback(); rollbackErr != nil {
+			glog.Errorf("rollback transaction failed,err:%v", rollbackErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (sqlSink) Update(registration ImageRegistration) error {
+	imageMeta := registration.toModel()
+	var cols []string
+	if registration.Size != nil {
+		cols = append(cols, "size")
+	}
+	if registration.Status != nil {
+		cols = append(cols, "status")
+	}
+	if registration.SyncStatus != nil {
+		cols = append(cols, "sync_status")
+	}
+	if len(cols) == 0 {
+		return nil
+	}
+	_, err := dao.MySQL().Cols(cols...).Where("name = ?", registration.Name).And("tag = ?", registration.Tag).
+		And("az_id = ?", registration.AzId).Update(imageMeta)
+	return errors.WithStack(err)
+}
+
+func (sqlSink) Delete(azId, name, tag string) error {
+	_, err := dao.MySQL().Where("name = ?", name).And("tag = ?", tag).
+		And("az_id = ?", azId).Delete(new(model.ImageMetadata))
+	return errors.WithStack(err)
+}
+
+// dedupeBatch 去掉同一批次中 az_id、name、tag 相同的重复镜像，保留最后一次出现的元数据，顺序按第一次出现
+func dedupeBatch(batch []model.ImageMetadata) []model.ImageMetadata {
+	indexes := make(map[string]int, len(batch))
+	result := make([]model.ImageMetadata, 0, len(batch))
+	for _, imageMeta := range batch {
+		key := imageMeta.AzId + "/" + imageMeta.Name + ":" + imageMeta.Tag
+		if i, ok := indexes[key]; ok {
+			result[i] = imageMeta
+			continue
+		}
+		indexes[key] = len(result)
+		result = append(result, imageMeta)
+	}
+	return result
+}
+
+// existingChanged 已存在的元数据是否需要更新，status 可能已经被运维上线，更新时保持不变，只比较 size 以及 sync_status
+func existingChanged(exist, imageMeta model.ImageMetadata) bool {
+	return exist.Size != imageMeta.Size || exist.SyncStatus != imageMeta.SyncStatus
+}
+
+// upsertBatchInSession 使用 SELECT ... FOR UPDATE 锁定批次中镜像所在的范围后再插入或更新，
+// 同时运行的多个进程写入同一个 AZ 时串行执行，不会重复插入
+func upsertBatchInSession(session *xorm.Session, batch []model.ImageMetadata) ([]ImageResult, []JournalEntry, error) {
+	if err := session.Begin(); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	batch = dedupeBatch(batch)
+	runId := config.IMConfig.RunId
+	targetAzId := batch[0].AzId
+	names := make([]string, 0, len(batch))
+	for _, imageMeta := range batch {
+		names = append(names, imageMeta.Name)
+	}
+	var existList []model.ImageMetadata
+	err := session.Where("az_id = ?", targetAzId).In("name", names).ForUpdate().Find(&existList)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	existMap := make(map[string]model.ImageMetadata, len(existList))
+	for _, exist := range existList {
+		existMap[exist.Name+":"+exist.Tag] = exist
+	}
+
+	results := make([]ImageResult, 0, len(batch))
+	var entries []JournalEntry
+	var insertList []model.ImageMetadata
+	for _, imageMeta := range batch {
+		result := ImageResult{Name: imageMeta.Name, Tag: imageMeta.Tag}
+		entry := JournalEntry{RunId: runId, Name: imageMeta.Name, Tag: imageMeta.Tag, AzId: targetAzId}
+		exist, has := existMap[imageMeta.Name+":"+imageMeta.Tag]
+		switch {
+		case !has:
+			insertList = append(insertList, imageMeta)
+			result.Result = ResultInserted
+			entry.Action = JournalInserted
+			entries = append(entries, entry)
+		case !existingChanged(exist, imageMeta):
+			result.Result = ResultUnchanged
+		default:
+			_, err = session.Cols("size", "sync_status").
+				Where("name = ?", imageMeta.Name).
+				And("tag = ?", imageMeta.Tag).
+				And("az_id = ?", targetAzId).Update(&imageMeta)
+			if err != nil {
+				return nil, nil, errors.WithStack(err)
+			}
+			result.Result = ResultUpdated
+			entry.Action = JournalUpdated
+			entry.Previous = &exist
+			entries = append(entries, entry)
+		}
+		results = append(results, result)
+	}
+	if len(insertList) > 0 {
+		if _, err = session.Insert(&insertList); err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+	}
+
+	// 同步到中控后，源 AZ 中的镜像标记为已同步回中控
+	if config.IMConfig.Topology.IsCentral(targetAzId) {
+		sourceAzId := config.IMConfig.SourceAzId
+		for _, imageMeta := range batch {
+			var sourceList []model.ImageMetadata
+			err = session.Where("name = ?", imageMeta.Name).
+				And("tag = ?", imageMeta.Tag).
+				And("az_id = ?", sourceAzId).Find(&sourceList)
+			if err != nil {
+				return nil, nil, errors.WithStack(err)
+			}
+			for i := range sourceList {
+				entries = append(entries, JournalEntry{RunId: runId, Action: JournalSourceUpdated,
+					Name: imageMeta.Name, Tag: imageMeta.Tag, AzId: sourceAzId, Previous: &sourceList[i]})
+			}
+			_, err = session.Cols("sync_status").
+				Where("name = ?", imageMeta.Name).
+				And("tag = ?", imageMeta.Tag).
+				And("az_id = ?", sourceAzId).
+				Update(&model.ImageMetadata{SyncStatus: config.IMConfig.Topology.Transitions.SourceSynced.SyncStatus})
+			if err != nil {
+				return nil, nil, errors.WithStack(err)
+			}
+		}
+	}
+	if err = session.Commit(); err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	return results, entries, nil
+}
+
+// rollbackJournal 在事务中逆序撤销修改记录
+func rollbackJournal(session *xorm.Session, entries []JournalEntry) error {
+	if err := session.Begin(); err != nil {
+		return errors.WithStack(err)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		query := session.Where("name = ?", entry.Name).And("tag = ?", entry.Tag).And("az_id = ?", entry.AzId)
+		var err error
+		switch entry.Action {
+		case JournalInserted:
+			_, err = query.Delete(new(model.ImageMetadata))
+		case JournalUpdated:
+			_, err = query.Cols("size", "status", "sync_status").Update(entry.Previous)
+		case JournalSourceUpdated:
+			_, err = query.Cols("sync_status").Update(entry.Previous)
+		default:
+			err = errors.Errorf("unknown journal action %s", entry.Action)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "rollback %s of %s:%s in %s", entry.Action, entry.Name, entry.Tag, entry.AzId)
+		}
+	}
+	return errors.WithStack(session.Commit())
+}
@@ -0,0 +1,64 @@
+package update
+
+import (
+	"gitlab.yellow.virtaitech.com/gemini-platform/public-geminidb/model"
+	"reflect"
+	"testing"
+)
+
+func TestDedupeBatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		batch []model.ImageMetadata
+		want  []model.ImageMetadata
+	}{
+		{name: "empty"},
+		{
+			name:  "no duplicate",
+			batch: []model.ImageMetadata{{AzId: "az1", Name: "p/a", Tag: "v1"}, {AzId: "az1", Name: "p/a", Tag: "v2"}},
+			want:  []model.ImageMetadata{{AzId: "az1", Name: "p/a", Tag: "v1"}, {AzId: "az1", Name: "p/a", Tag: "v2"}},
+		},
+		{
+			name: "duplicate keeps last metadata at first position",
+			batch: []model.ImageMetadata{
+				{AzId: "az1", Name: "p/a", Tag: "v1", Size: 1},
+				{AzId: "az1", Name: "p/b", Tag: "v1", Size: 2},
+				{AzId: "az1", Name: "p/a", Tag: "v1", Size: 3},
+			},
+			want: []model.ImageMetadata{{AzId: "az1", Name: "p/a", Tag: "v1", Size: 3}, {AzId: "az1", Name: "p/b", Tag: "v1", Size: 2}},
+		},
+		{
+			name:  "different az is not duplicate",
+			batch: []model.ImageMetadata{{AzId: "az1", Name: "p/a", Tag: "v1"}, {AzId: "az2", Name: "p/a", Tag: "v1"}},
+			want:  []model.ImageMetadata{{AzId: "az1", Name: "p/a", Tag: "v1"}, {AzId: "az2", Name: "p/a", Tag: "v1"}},
+		},
+	}
+	for _, tt := range tests {
+		got := dedupeBatch(tt.batch)
+		if len(got) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: dedupeBatch() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExistingChanged(t *testing.T) {
+	target := model.ImageMetadata{AzId: "az3", Name: "p/a", Tag: "v1", Size: 100, Status: 2, SyncStatus: 3}
+	tests := []struct {
+		name  string
+		exist model.ImageMetadata
+		want  bool
+	}{
+		{name: "same", exist: target},
+		{name: "online image keeps status", exist: model.ImageMetadata{AzId: "az3", Name: "p/a", Tag: "v1", Size: 100, Status: 1, SyncStatus: 3}},
+		{name: "size changed", exist: model.ImageMetadata{AzId: "az3", Name: "p/a", Tag: "v1", Size: 50, Status: 1, SyncStatus: 3}, want: true},
+		{name: "sync status changed", exist: model.ImageMetadata{AzId: "az3", Name: "p/a", Tag: "v1", Size: 100, Status: 1, SyncStatus: 1}, want: true},
+	}
+	for _, tt := range tests {
+		if got := existingChanged(tt.exist, target); got != tt.want {
+			t.Errorf("%s: existingChanged() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Package standin 提供平台元数据接口的本地替身，用于测试 metadataSink: http，数据只保存在内存中
+package standin
+
+import (
+	"encoding/json"
+	"image-sync/update"
+	"net/http"
+	"sync"
+)
+
+type Server struct {
+	lock      sync.Mutex
+	images    map[string]update.ImageRegistration
+	responses map[string]response //按 Idempotency-Key 保存第一次处理的结果，重试时直接返回
+}
+
+type response struct {
+	status int
+	body   interface{}
+}
+
+func NewServer() *Server {
+	return &Server{images: make(map[string]update.ImageRegistration), responses: make(map[string]response)}
+}
+
+func key(azId, name, tag string) string {
+	return azId + "/" + name + ":" + tag
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	idempotencyKey := r.Header.Get(update.IdempotencyKeyHeader)
+	resp, ok := s.responses[idempotencyKey]
+	if !ok || idempotencyKey == "" {
+		resp = s.handle(r)
+		if idempotencyKey != "" && r.Method != http.MethodGet {
+			s.responses[idempotencyKey] = resp
+		}
+	}
+	if resp.body == nil {
+		w.WriteHeader(resp.status)
+		return
+	}
+	if message, ok := resp.body.(string); ok {
+		http.Error(w, message, resp.status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.status)
+	json.NewEncoder(w).Encode(resp.body)
+}
+
+func (s *Server) handle(r *http.Request) response {
+	switch r.Method {
+	case http.MethodGet:
+		images := make([]update.ImageRegistration, 0, len(s.images))
+		for _, image := range s.images {
+			images = append(images, image)
+		}
+		return response{status: http.StatusOK, body: images}
+	case http.MethodPut:
+		var registration update.ImageRegistration
+		if err := json.NewDecoder(r.Body).Decode(&registration); err != nil {
+			return response{status: http.StatusBadRequest, body: err.Error()}
+		}
+		if registration.AzId == "" || registration.Name == "" || registration.Tag == "" {
+			return response{status: http.StatusBadRequest, body: "az_id, name and tag are required"}
+		}
+		k := key(registration.AzId, registration.Name, registration.Tag)
+		if _, ok := s.images[k]; !ok && r.URL.Query().Get("update_only") == "true" {
+			return response{status: http.StatusNotFound}
+		}
+		return response{status: http.StatusOK, body: s.register(registration)}
+	case http.MethodDelete:
+		query := r.URL.Query()
+		k := key(query.Get("az_id"), query.Get("name"), query.Get("tag"))
+		if _, ok := s.images[k]; !ok {
+			return response{status: http.StatusNotFound}
+		}
+		delete(s.images, k)
+		return response{status: http.StatusNoContent}
+	default:
+		return response{status: http.StatusMethodNotAllowed}
+	}
+}
+
+// register 按照平台接口的约定写入元数据，未设置的字段保持不变
+func (s *Server) register(registration update.ImageRegistration) update.RegistrationResponse {
+	k := key(registration.AzId, registration.Name, registration.Tag)
+	exist, has := s.images[k]
+	if !has {
+		s.images[k] = registration
+		return update.RegistrationResponse{Result: update.ResultInserted}
+	}
+	previous := exist
+	changed := false
+	if registration.Size != nil && (exist.Size == nil || *exist.Size != *registration.Size) {
+		exist.Size, changed = registration.Size, true
+	}
+	if registration.Status != nil && (exist.Status == nil || *exist.Status != *registration.Status) {
+		exist.Status, changed = registration.Status, true
+	}
+	if registration.SyncStatus != nil && (exist.SyncStatus == nil || *exist.SyncStatus != *registration.SyncStatus) {
+		exist.SyncStatus, changed = registration.SyncStatus, true
+	}
+	if !changed {
+		return update.RegistrationResponse{Result: update.ResultUnchanged, Previous: &previous}
+	}
+	s.images[k] = exist
+	return update.RegistrationResponse{Result: update.ResultUpdated, Previous: &previous}
+}
@@ -1,64 +1,168 @@
 package update
 
 import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
 	"gitlab.yellow.virtaitech.com/gemini-platform/public-gemini/glog"
 	"gitlab.yellow.virtaitech.com/gemini-platform/public-geminidb/model"
 	"image-sync/config"
-	"image-sync/dao"
 	"image-sync/imagesync"
+	"image-sync/secret"
+	"os"
 	"path"
 	"strconv"
+	"sync"
 )
 
-const centralAz = "az1"
+const (
+	defaultBatchSize = 100
+	UpdateResultFile = "update-result"
+
+	ResultInserted  = "inserted"
+	ResultUpdated   = "updated"
+	ResultUnchanged = "unchanged"
+	ResultFailed    = "failed"
+
+	// resultPartial 只用于统计，目标 AZ 写入成功但更新源 AZ 失败的镜像
+	resultPartial = "partial"
+)
+
+// ImageResult 单个镜像元数据更新的结果
+type ImageResult struct {
+	RunId  string `json:"run_id"`
+	Name   string `json:"image_name"`
+	Tag    string `json:"image_tag"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"` //result 不为 failed 时表示目标 AZ 已经写入，但更新源 AZ 的同步状态失败
+}
 
 func UpdateImageMeta() {
 	imageList := imagesync.GetSyncSucceedImageList(path.Join(config.IMConfig.OutputPath, "sync-succeed"))
+	UpdateImages(imageList)
+}
 
-	for index, image := range imageList {
-		size, _ := strconv.Atoi(image.Size)
-		imageMeta := model.ImageMetadata{
-			Name:       image.Name,
-			Tag:        image.Tag,
-			Size:       int64(size),
-			AzId:       config.IMConfig.TargetAzId,
-			Status:     2, // 2:offline
-			SyncStatus: 3, // 3:已同步回中控
-		}
-		if config.IMConfig.TargetAzId == centralAz {
-			imageMeta.Status = 1 // 1:online
-		}
-		has, err := dao.MySQL().Where("name = ?", imageMeta.Name).And("tag = ?", imageMeta.Tag).
-			And("az_id = ?", config.IMConfig.TargetAzId).
-			Get(new(model.ImageMetadata))
+// UpdateImages 写入镜像在目标 AZ 的元数据并记录每个镜像的结果，pipeline 模式在镜像同步校验成功后调用
+func UpdateImages(imageList []imagesync.DataImage) {
+	results := UpsertImageMeta(imageList)
+	recordUpdateResult(results)
+}
+
+// UpsertImageMeta 分批在事务中写入目标 AZ 的镜像元数据，目标 AZ 为中控时同时更新源 AZ 的同步状态，
+// 同一批次中任意一条失败时整批回滚，重复执行的结果与执行一次相同。
+// 结果以及元数据修改记录使用同步该镜像的运行ID，rollback --run <同步的运行ID> 可以同时撤销同步以及元数据
+func UpsertImageMeta(imageList []imagesync.DataImage) []ImageResult {
+	batchSize := config.IMConfig.UpdateBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	runIds := make(map[string]string, len(imageList))
+	for _, image := range imageList {
+		runIds[image.Name+":"+image.Tag] = syncRunId(image)
+	}
+	results := make([]ImageResult, 0, len(imageList))
+	var batch []model.ImageMetadata
+	for _, image := range imageList {
+		size, err := strconv.ParseInt(image.Size, 10, 64)
 		if err != nil {
-			glog.Error("get image meta failed", glog.String("error", err.Error()), glog.String("image", image.Name+":"+image.Tag))
-		}
-		if has {
-			glog.Warnf("image meta already exists", glog.String("image", image.Name+":"+image.Tag))
+			results = append(results, failedResult(image.Name, image.Tag, errors.Wrap(err, "parse image size")))
 			continue
 		}
-		_, err = dao.MySQL().Insert(&imageMeta)
-		if err != nil {
-			glog.Error("insert image meta failed", glog.String("error", err.Error()), glog.String("image", image.Name+":"+image.Tag))
+		batch = append(batch, NewTargetImageMeta(image.Name, image.Tag, size, config.IMConfig.TargetAzId))
+		if len(batch) == batchSize {
+			results = append(results, upsertBatch(batch, runIds)...)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		results = append(results, upsertBatch(batch, runIds)...)
+	}
+	for i := range results {
+		results[i].RunId = runIds[results[i].Name+":"+results[i].Tag]
+	}
+	recordImageDetails(config.IMConfig.TargetAzId, imageList, results)
+	return results
+}
+
+// syncRunId 同步该镜像的运行ID，sync-succeed 中没有记录时使用本次运行的ID
+func syncRunId(image imagesync.DataImage) string {
+	if image.RunId != "" {
+		return image.RunId
+	}
+	return config.IMConfig.RunId
+}
+
+// NewTargetImageMeta 构造镜像同步到目标 AZ 后的元数据
+func NewTargetImageMeta(name, tag string, size int64, azId string) model.ImageMetadata {
+	state := config.IMConfig.Topology.TargetState(azId)
+	return model.ImageMetadata{
+		Name:       name,
+		Tag:        tag,
+		Size:       size,
+		AzId:       azId,
+		Status:     state.Status,
+		SyncStatus: state.SyncStatus,
+	}
+}
+
+// upsertBatch 写入一批元数据，修改记录追加到同步对应镜像的运行的记录中
+func upsertBatch(batch []model.ImageMetadata, runIds map[string]string) []ImageResult {
+	results, entries, err := getSink().Upsert(batch)
+	if err != nil {
+		glog.Errorf("upsert image meta batch failed,rollback %d images,err:%v", len(batch), secret.RedactError(err))
+		results = make([]ImageResult, 0, len(batch))
+		for _, imageMeta := range batch {
+			results = append(results, failedResult(imageMeta.Name, imageMeta.Tag, err))
+		}
+		return results
+	}
+	for i := range entries {
+		if runId, ok := runIds[entries[i].Name+":"+entries[i].Tag]; ok {
+			entries[i].RunId = runId
 		}
-		glog.Infof("insert image meta success", glog.String("image", image.Name+":"+image.Tag), glog.Int("index", index))
 	}
+	if err = appendJournal(entries); err != nil {
+		glog.Errorf("append run journal failed,rollback may be incomplete,err:%v", secret.RedactError(err))
+	}
+	return results
+}
+
+func failedResult(name, tag string, err error) ImageResult {
+	return ImageResult{Name: name, Tag: tag, Result: ResultFailed, Error: err.Error()}
+}
 
-	if config.IMConfig.TargetAzId == centralAz {
-		for _, image := range imageList {
-			imageMeta := model.ImageMetadata{
-				Name:       image.Name,
-				Tag:        image.Tag,
-				SyncStatus: 3, // 3:已同步回中控
-			}
-			_, err := dao.MySQL().Cols("sync_status").
-				Where("name = ?", imageMeta.Name).
-				And("tag = ?", imageMeta.Tag).
-				And("az_id = ?", config.IMConfig.SourceAzId).Update(imageMeta)
-			if err != nil {
-				glog.Error("update image meta failed", glog.String("error", err.Error()), glog.String("image", image.Name+":"+image.Tag))
-			}
+var resultLock sync.Mutex
+
+// recordUpdateResult 输出每个镜像的更新结果，并追加到 OutputPath 下的 update-result 文件
+func recordUpdateResult(results []ImageResult) {
+	resultLock.Lock()
+	defer resultLock.Unlock()
+	counts := make(map[string]int)
+	file, err := os.OpenFile(path.Join(config.IMConfig.OutputPath, UpdateResultFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		glog.Warnf("create update result file failed,err:%v", err)
+	} else {
+		defer file.Close()
+	}
+	for _, result := range results {
+		if result.RunId == "" {
+			result.RunId = config.IMConfig.RunId
+		}
+		counts[result.Result]++
+		image := glog.String("image", result.Name+":"+result.Tag)
+		if result.Result == ResultFailed {
+			glog.Error("update image meta failed", glog.String("error", result.Error), image)
+		} else if result.Error != "" {
+			counts[resultPartial]++
+			glog.Warn(fmt.Sprintf("image meta %s,partially failed", result.Result), glog.String("error", result.Error), image)
+		} else {
+			glog.Info(fmt.Sprintf("image meta %s", result.Result), image)
+		}
+		if file != nil {
+			data, _ := json.Marshal(result)
+			file.Write(append(data, '\n'))
 		}
 	}
+	glog.Infof("update image meta finished,total:%d,inserted:%d,updated:%d,unchanged:%d,failed:%d,partially failed:%d",
+		len(results), counts[ResultInserted], counts[ResultUpdated], counts[ResultUnchanged], counts[ResultFailed], counts[resultPartial])
 }